@@ -37,6 +37,7 @@ namespace Postman
 
         public Action OnConnect;
         public Action<PublishMessageData> OnMessage;
+        public Action<StoreChangeData> OnStoreChange;
         public Action OnClose;
         public Action OnPingPong;
 
@@ -50,6 +51,9 @@ namespace Postman
 
         private List<PublishMessageData> messageStack = new List<PublishMessageData>();
 
+        private Dictionary<string, UniTaskCompletionSource<StoreResultMessageData>> storeRequests = new Dictionary<string, UniTaskCompletionSource<StoreResultMessageData>>();
+        private int storeRequestId = 0;
+
         private bool tryReconnect = false;
         private bool reconnecting = false;
 
@@ -126,6 +130,9 @@ namespace Postman
                     if(OnMessage != null)
                         OnMessage(msg);
 
+                    if(OnStoreChange != null && StoreChangeData.IsStoreChange(msg))
+                        OnStoreChange(new StoreChangeData(msg));
+
                     latestMessage = msg;
                 }
             }
@@ -399,6 +406,12 @@ namespace Postman
             if(!e.IsText || e.Data == "")
                 return;
 
+            if(e.Data.StartsWith(PostmanMassageData.ProtocolStoreTag))
+            {
+                OnStoreResult(e.Data.Substring(PostmanMassageData.ProtocolStoreTag.Length));
+                return;
+            }
+
             if(!e.Data.Contains(PostmanMassageData.ProtocolMessageTag))
                 return;
 
@@ -428,6 +441,14 @@ namespace Postman
             isConnect = false;
             invokeOnClose = true;
 
+            // pending store requests are not replied after closed
+            lock(storeRequests)
+            {
+                foreach(var req in storeRequests)
+                    req.Value.TrySetResult(new StoreResultMessageData(req.Key, "fail", "connection closed"));
+                storeRequests.Clear();
+            }
+
             if(reconnectOnClose && !reconnecting)
                 tryReconnect = true;
         }
@@ -523,6 +544,62 @@ namespace Postman
         }
 #endregion
 
+#region store watch
+        // require server option --store-notify
+        public void StoreWatch(string key, bool withChildren = false, string ns = "")
+        {
+            Subscribe(StoreChangeData.BuildChannel(key, withChildren, ns));
+        }
+
+        public void StoreUnwatch(string key, bool withChildren = false, string ns = "")
+        {
+            Unsubscribe(StoreChangeData.BuildChannel(key, withChildren, ns));
+        }
+#endregion
+
+#region store over websocket
+        public async UniTask<StoreResultMessageData> StoreCommandAsync(string cmd, string key = "", string val = "", string ns = "")
+        {
+            if(!isConnect || webSocket == null || !webSocket.IsAlive)
+                return new StoreResultMessageData("", "fail", "not connected");
+
+            UniTaskCompletionSource<StoreResultMessageData> tcs = new UniTaskCompletionSource<StoreResultMessageData>();
+            string id = Interlocked.Increment(ref storeRequestId).ToString();
+            lock(storeRequests)
+                storeRequests[id] = tcs;
+
+            StoreMessageData msg = new StoreMessageData(id, cmd, key, val, ns);
+            string json = JsonConvert.SerializeObject(msg);
+            webSocket.SendAsync(PostmanMassageData.BuildMessage(MessageType.STORE, json), null);
+
+            return await tcs.Task;
+        }
+
+        private void OnStoreResult(string json)
+        {
+            StoreResultMessageData res;
+            try
+            {
+                res = JsonConvert.DeserializeObject<StoreResultMessageData>(json);
+            }
+            catch
+            {
+                return;
+            }
+
+            UniTaskCompletionSource<StoreResultMessageData> tcs;
+            lock(storeRequests)
+            {
+                if(!storeRequests.TryGetValue(res.id, out tcs))
+                    return;
+                storeRequests.Remove(res.id);
+            }
+
+            Debug.Log(string.Format("PostmanClient :: store [ {0} ] ", res.id) + res.result);
+            tcs.TrySetResult(res);
+        }
+#endregion
+
 #region store get
         public string StoreGet(string key)
         {
@@ -1,6 +1,7 @@
 ﻿using System.Collections;
 using System.Collections.Generic;
 using UnityEngine;
+using Newtonsoft.Json.Linq;
 
 namespace Postman
 {
@@ -9,13 +10,15 @@ namespace Postman
         PING = 0,
         SUBSCRIBE,
         UNSUBSCRIBE,
-        PUBLISH
+        PUBLISH,
+        STORE
     }
 
     public class PostmanMassageData
     {
         public const string ProtocolMessageTag = "message ";
         public const string PingReturnString = "\"pong\"";
+        public const string ProtocolStoreTag = "store ";
 
         public static string BuildMessage(MessageType type, string body = "{}")
         {
@@ -27,6 +30,7 @@ namespace Postman
                 case MessageType.SUBSCRIBE: msg = string.Format("subscribe {0}", body); break;
                 case MessageType.UNSUBSCRIBE: msg = string.Format("unsubscribe {0}", body); break;
                 case MessageType.PUBLISH: msg = string.Format("publish {0}", body); break;
+                case MessageType.STORE: msg = string.Format("store {0}", body); break;
             }
 
             return msg;
@@ -78,6 +82,80 @@ namespace Postman
         }
     }
 
+    public class StoreMessageData : PostmanMassageData
+    {
+        public string id;
+        public string cmd;
+        public string key;
+        public string val;
+        public string ns;
+
+        public StoreMessageData(string id, string cmd, string key = "", string val = "", string ns = "")
+        {
+            this.id = id;
+            this.cmd = cmd;
+            this.key = key;
+            this.val = val;
+            this.ns = ns;
+        }
+    }
+
+    public class StoreItemData
+    {
+        public string key;
+        public string value;
+    }
+
+    public class StoreResultMessageData : ResultMessageData
+    {
+        public string id;
+        public List<string> keys;
+        public List<StoreItemData> items;
+        public string cursor;
+        public JToken value; // JGET, JSET, JMERGE and JAPPEND
+
+        public StoreResultMessageData(string id, string result, string error) : base(result, error)
+        {
+            this.id = id;
+        }
+    }
+
+    public class StoreChangeData
+    {
+        public const string ChannelPrefix = "$store/";
+        public const string NamespaceChannelPrefix = "$store:"; // "$store:NAMESPACE/KEY"
+
+        public string key;
+        public string op; // "set", "del" or "expired"
+        public string value;
+
+        public StoreChangeData(PublishMessageData msg)
+        {
+            this.key = msg.extention;
+            this.op = msg.tag;
+            this.value = msg.message;
+        }
+
+        public bool IsDeleted()
+        {
+            return op != "set";
+        }
+
+        public static bool IsStoreChange(PublishMessageData msg)
+        {
+            return msg.channel != null && (msg.channel.StartsWith(ChannelPrefix) || msg.channel.StartsWith(NamespaceChannelPrefix));
+        }
+
+        public static string BuildChannel(string key, bool withChildren = false, string ns = "")
+        {
+            string prefix = (ns == "" ? ChannelPrefix : NamespaceChannelPrefix + ns + "/");
+            if(withChildren)
+                return prefix + (key == "" ? "**" : key.TrimEnd('/') + "/**");
+            else
+                return prefix + key;
+        }
+    }
+
     public class StatusMessageData
     {
         public string version;
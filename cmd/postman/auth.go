@@ -16,6 +16,20 @@ func GenerateToken(scrt string, key string) (string, error) {
 	return tknStr, nil
 }
 
+// GenerateNamespaceToken generates the token which forces the store namespace.
+func GenerateNamespaceToken(scrt string, key string, ns string) (string, error) {
+	tkn := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.MapClaims{
+		"key": key,
+		"ns":  ns,
+	})
+	tknStr, err := tkn.SignedString([]byte(scrt))
+	if err != nil {
+		return "", err
+	}
+
+	return tknStr, nil
+}
+
 func Authenticate(scrt string, tknStr string, key string) (bool, error) {
 	tkn, err := jwt.Parse(tknStr, func(tkn *jwt.Token) (interface{}, error) {
 		return []byte(scrt), nil
@@ -27,3 +41,19 @@ func Authenticate(scrt string, tknStr string, key string) (bool, error) {
 	claims := tkn.Claims.(jwt.MapClaims)
 	return claims["key"].(string) == key, nil
 }
+
+// TokenNamespace returns the store namespace claim of the token, or empty.
+func TokenNamespace(scrt string, tknStr string) string {
+	tkn, err := jwt.Parse(tknStr, func(tkn *jwt.Token) (interface{}, error) {
+		return []byte(scrt), nil
+	})
+	if err != nil {
+		return ""
+	}
+
+	claims := tkn.Claims.(jwt.MapClaims)
+	if ns, ok := claims["ns"].(string); ok {
+		return ns
+	}
+	return ""
+}
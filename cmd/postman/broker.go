@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sharkattack51/golem"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	BROKER_TOPIC      = "postman"
+	BROKER_RETRY_MSEC = 1000
+	BROKER_DIAL_SEC   = 5
+)
+
+// Broker is the fan-out of channel messages.
+type Broker interface {
+	Join(ch string, conn *golem.Connection)
+	Leave(ch string, conn *golem.Connection)
+	LeaveAll(conn *golem.Connection)
+
+	// Attach, Detach and DetachAll are Join, Leave and LeaveAll for other protocols than websocket.
+	Attach(ch string, s Subscriber)
+	Detach(ch string, s Subscriber)
+	DetachAll(s Subscriber)
+
+	// Emit shares the message with every postman using the same backend.
+	Emit(pmsg *PublishSendMessage)
+	// Deliver sends the message only to subscribers connecting to this postman.
+	Deliver(pmsg *PublishSendMessage)
+
+	// Rooms returns the websocket connections for each channel.
+	Rooms() map[string][]*golem.Connection
+	Subscribers() map[string][]Subscriber
+	Close()
+}
+
+// Subscriber receives channel messages without golem websocket connection.
+type Subscriber interface {
+	Info() string
+	RemoteAddr() string
+
+	// Send must not block, returns false when the message is dropped.
+	Send(ch string, pmsg *PublishSendMessage) bool
+}
+
+// FilteredSubscriber receives only the messages it accepts, and the others are neither sent nor dropped.
+type FilteredSubscriber interface {
+	Subscriber
+	Accepts(ch string, pmsg *PublishSendMessage) bool
+}
+
+// BridgeClient carries messages through an external pub/sub server.
+type BridgeClient interface {
+	Publish(data []byte) error
+	Subscribe(fn func(data []byte))
+	Close()
+}
+
+func NewBroker(rawurl string) (Broker, error) {
+	local := NewLocalBroker()
+	if rawurl == "" {
+		return local, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return local, err
+	}
+
+	topic := strings.Trim(u.Path, "/")
+	if topic == "" {
+		topic = BROKER_TOPIC
+	}
+
+	switch u.Scheme {
+	case "redis":
+		pwd, _ := u.User.Password()
+		return NewBridgeBroker(local, NewRedisBridge(u.Host, pwd, topic)), nil
+	case "nats":
+		user := u.User.Username()
+		pwd, _ := u.User.Password()
+		return NewBridgeBroker(local, NewNatsBridge(u.Host, user, pwd, topic)), nil
+	default:
+		return local, errors.New("unknown broker [" + rawurl + "]")
+	}
+}
+
+//
+// Local
+//
+
+type LocalBroker struct {
+	rm *golem.RoomManager
+
+	mu    sync.RWMutex
+	rooms map[string]map[*golem.Connection]bool // channel -> members, as golem rooms are not safe to read
+	sinks map[string]map[Subscriber]bool        // channel -> subscribers
+}
+
+func NewLocalBroker() *LocalBroker {
+	b := &LocalBroker{
+		rm:    golem.NewRoomManager(),
+		rooms: make(map[string]map[*golem.Connection]bool),
+		sinks: make(map[string]map[Subscriber]bool),
+	}
+	return b
+}
+
+func (b *LocalBroker) Join(ch string, conn *golem.Connection) {
+	b.rm.Join(ch, conn)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	members, ok := b.rooms[ch]
+	if !ok {
+		members = make(map[*golem.Connection]bool)
+		b.rooms[ch] = members
+	}
+	members[conn] = true
+}
+
+func (b *LocalBroker) Leave(ch string, conn *golem.Connection) {
+	b.rm.Leave(ch, conn)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if members, ok := b.rooms[ch]; ok {
+		delete(members, conn)
+		if len(members) == 0 {
+			delete(b.rooms, ch)
+		}
+	}
+}
+
+func (b *LocalBroker) LeaveAll(conn *golem.Connection) {
+	b.rm.LeaveAll(conn)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, members := range b.rooms {
+		delete(members, conn)
+		if len(members) == 0 {
+			delete(b.rooms, ch)
+		}
+	}
+}
+
+func (b *LocalBroker) Attach(ch string, s Subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs, ok := b.sinks[ch]
+	if !ok {
+		subs = make(map[Subscriber]bool)
+		b.sinks[ch] = subs
+	}
+	subs[s] = true
+}
+
+func (b *LocalBroker) Detach(ch string, s Subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if subs, ok := b.sinks[ch]; ok {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(b.sinks, ch)
+		}
+	}
+}
+
+func (b *LocalBroker) DetachAll(s Subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, subs := range b.sinks {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(b.sinks, ch)
+		}
+	}
+}
+
+func (b *LocalBroker) Emit(pmsg *PublishSendMessage) {
+	b.Deliver(pmsg)
+}
+
+func (b *LocalBroker) Deliver(pmsg *PublishSendMessage) {
+	chs := []string{pmsg.Channel}
+	if strings.HasSuffix(pmsg.Channel, "/*") {
+		chs = b.matchChannels(pmsg.Channel)
+	}
+
+	if events != nil {
+		events.Record(pmsg)
+	}
+
+	for _, ch := range chs {
+		b.rm.Emit(ch, "message", &pmsg)
+
+		b.mu.RLock()
+		n := len(b.rooms[ch]) // golem emits to every member of the room
+		subs := []Subscriber{}
+		for s := range b.sinks[ch] {
+			subs = append(subs, s)
+		}
+		b.mu.RUnlock()
+
+		if n == 0 && len(subs) == 0 {
+			metrics.Dropped("no_subscriber")
+			continue
+		}
+
+		for _, s := range subs {
+			if f, ok := s.(FilteredSubscriber); ok && !f.Accepts(ch, pmsg) {
+				continue
+			}
+
+			if s.Send(ch, pmsg) {
+				n++
+			} else {
+				metrics.Dropped("subscriber_full")
+			}
+		}
+
+		metrics.Delivered(ch, pmsg, n)
+	}
+}
+
+func (b *LocalBroker) matchChannels(pubCh string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	chs := []string{}
+	for ch := range b.rooms {
+		if ChannelMatch(pubCh, ch) {
+			chs = append(chs, ch)
+		}
+	}
+	for ch := range b.sinks {
+		if ChannelMatch(pubCh, ch) && !slices.Contains(chs, ch) {
+			chs = append(chs, ch)
+		}
+	}
+
+	return chs
+}
+
+func (b *LocalBroker) Rooms() map[string][]*golem.Connection {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	rooms := make(map[string][]*golem.Connection)
+	for ch, members := range b.rooms {
+		for conn := range members {
+			rooms[ch] = append(rooms[ch], conn)
+		}
+	}
+	return rooms
+}
+
+func (b *LocalBroker) Subscribers() map[string][]Subscriber {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	subscribers := make(map[string][]Subscriber)
+	for ch, subs := range b.sinks {
+		for s := range subs {
+			subscribers[ch] = append(subscribers[ch], s)
+		}
+	}
+	return subscribers
+}
+
+func (b *LocalBroker) Close() {
+	// room manager is kept for connections which are still closing
+}
+
+//
+// Bridge
+//
+
+type BridgeBroker struct {
+	*LocalBroker
+	client BridgeClient
+}
+
+func NewBridgeBroker(local *LocalBroker, client BridgeClient) *BridgeBroker {
+	b := &BridgeBroker{
+		LocalBroker: local,
+		client:      client,
+	}
+	client.Subscribe(b.receive)
+	return b
+}
+
+func (b *BridgeBroker) Emit(pmsg *PublishSendMessage) {
+	j, _ := json.Marshal(pmsg)
+	if err := b.client.Publish(j); err != nil {
+		log.Printf("> [Warning] broker publish failed: %s\n", err)
+		if logger != nil {
+			logger.Log(WARN, "broker publish failed", logrus.Fields{"method": "broker", "channel": pmsg.Channel, "error": err.Error()})
+		}
+
+		// deliver to this postman at least
+		b.Deliver(pmsg)
+	}
+}
+
+func (b *BridgeBroker) receive(data []byte) {
+	var pmsg PublishSendMessage
+	if err := json.Unmarshal(data, &pmsg); err != nil || pmsg.Channel == "" {
+		return
+	}
+
+	b.Deliver(&pmsg)
+}
+
+func (b *BridgeBroker) Close() {
+	b.client.Close()
+}
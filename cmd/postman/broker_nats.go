@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NatsBridge uses a NATS subject with one connection for publish and subscribe.
+type NatsBridge struct {
+	addr     string
+	user     string
+	password string
+	topic    string
+
+	mu   sync.Mutex
+	conn net.Conn
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup // receive goroutine
+}
+
+func NewNatsBridge(addr string, user string, password string, topic string) *NatsBridge {
+	b := &NatsBridge{
+		addr:     addr,
+		user:     user,
+		password: password,
+		topic:    topic,
+		stop:     make(chan struct{}),
+	}
+	return b
+}
+
+func (b *NatsBridge) Publish(data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		return errors.New("nats: not connected")
+	}
+
+	b.conn.SetWriteDeadline(time.Now().Add(BROKER_DIAL_SEC * time.Second))
+	_, err := fmt.Fprintf(b.conn, "PUB %s %d\r\n%s\r\n", b.topic, len(data), data)
+	return err
+}
+
+func (b *NatsBridge) Subscribe(fn func(data []byte)) {
+	r, err := b.connect()
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			if err == nil {
+				b.receive(r, fn)
+			} else {
+				log.Printf("> [Warning] nats broker %s: %s\n", b.addr, err)
+			}
+
+			select {
+			case <-b.stop:
+				return
+			case <-time.After(BROKER_RETRY_MSEC * time.Millisecond):
+			}
+			r, err = b.connect()
+		}
+	}()
+}
+
+// Close waits for the receive goroutine, so no message is delivered after it.
+func (b *NatsBridge) Close() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.conn != nil {
+			b.conn.Close()
+		}
+	})
+	b.wg.Wait()
+}
+
+func (b *NatsBridge) stopped() bool {
+	select {
+	case <-b.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *NatsBridge) connect() (*bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, BROKER_DIAL_SEC*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(BROKER_DIAL_SEC * time.Second))
+
+	// INFO {...}
+	line, err := readLine(r)
+	if err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return nil, errors.New("nats: invalid server info")
+	}
+
+	c := map[string]interface{}{"verbose": false, "pedantic": false, "name": "postman"}
+	if b.user != "" {
+		c["user"] = b.user
+		c["pass"] = b.password
+	}
+	j, _ := json.Marshal(c)
+	fmt.Fprintf(conn, "CONNECT %s\r\nSUB %s 1\r\nPING\r\n", j, b.topic)
+
+	// PONG confirms connect and subscription
+	line, err = readLine(r)
+	if err != nil || line != "PONG" {
+		conn.Close()
+		if strings.HasPrefix(line, "-ERR") {
+			return nil, errors.New("nats: " + strings.TrimSpace(line[4:]))
+		}
+		return nil, errors.New("nats: connect failed")
+	}
+	conn.SetDeadline(time.Time{})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.stop:
+		conn.Close()
+		return nil, errors.New("closed")
+	default:
+	}
+	b.conn = conn
+
+	return r, nil
+}
+
+func (b *NatsBridge) receive(r *bufio.Reader, fn func(data []byte)) {
+	defer func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.conn != nil {
+			b.conn.Close()
+			b.conn = nil
+		}
+	}()
+
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return
+		}
+
+		switch {
+		case line == "PING":
+			b.mu.Lock()
+			io.WriteString(b.conn, "PONG\r\n")
+			b.mu.Unlock()
+
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			f := strings.Fields(line)
+			n, err := strconv.Atoi(f[len(f)-1])
+			if err != nil {
+				return
+			}
+			buf := make([]byte, n+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			if !b.stopped() {
+				fn(buf[:n])
+			}
+
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("> [Warning] nats broker %s: %s\n", b.addr, line)
+		}
+	}
+}
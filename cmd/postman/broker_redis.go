@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisBridge uses redis PUBLISH/SUBSCRIBE with separated connections.
+type RedisBridge struct {
+	addr     string
+	password string
+	topic    string
+
+	mu   sync.Mutex
+	pub  net.Conn
+	pubR *bufio.Reader
+	sub  net.Conn
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup // receive goroutine
+}
+
+func NewRedisBridge(addr string, password string, topic string) *RedisBridge {
+	b := &RedisBridge{
+		addr:     addr,
+		password: password,
+		topic:    topic,
+		stop:     make(chan struct{}),
+	}
+	return b
+}
+
+func (b *RedisBridge) Publish(data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pub == nil {
+		conn, r, err := b.dial()
+		if err != nil {
+			return err
+		}
+		b.pub, b.pubR = conn, r
+	}
+
+	b.pub.SetDeadline(time.Now().Add(BROKER_DIAL_SEC * time.Second))
+	_, err := redisCommand(b.pub, b.pubR, "PUBLISH", b.topic, string(data))
+	if err != nil {
+		b.pub.Close()
+		b.pub, b.pubR = nil, nil
+	}
+	return err
+}
+
+func (b *RedisBridge) Subscribe(fn func(data []byte)) {
+	conn, r, err := b.subscribe()
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			if err == nil {
+				b.receive(conn, r, fn)
+			} else {
+				log.Printf("> [Warning] redis broker %s: %s\n", b.addr, err)
+			}
+
+			select {
+			case <-b.stop:
+				return
+			case <-time.After(BROKER_RETRY_MSEC * time.Millisecond):
+			}
+			conn, r, err = b.subscribe()
+		}
+	}()
+}
+
+// Close waits for the receive goroutine, so no message is delivered after it.
+func (b *RedisBridge) Close() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.pub != nil {
+			b.pub.Close()
+		}
+		if b.sub != nil {
+			b.sub.Close()
+		}
+	})
+	b.wg.Wait()
+}
+
+func (b *RedisBridge) stopped() bool {
+	select {
+	case <-b.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *RedisBridge) subscribe() (net.Conn, *bufio.Reader, error) {
+	conn, r, err := b.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(BROKER_DIAL_SEC * time.Second))
+	if _, err := redisCommand(conn, r, "SUBSCRIBE", b.topic); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.stop:
+		conn.Close()
+		return nil, nil, errors.New("closed")
+	default:
+	}
+	b.sub = conn
+
+	return conn, r, nil
+}
+
+func (b *RedisBridge) receive(conn net.Conn, r *bufio.Reader, fn func(data []byte)) {
+	defer conn.Close()
+
+	for {
+		v, err := redisReadReply(r)
+		if err != nil {
+			return
+		}
+
+		// ["message", topic, payload]
+		if arr, ok := v.([]interface{}); ok && len(arr) == 3 {
+			if kind, _ := arr[0].(string); kind == "message" {
+				if payload, ok := arr[2].(string); ok && !b.stopped() {
+					fn([]byte(payload))
+				}
+			}
+		}
+	}
+}
+
+func (b *RedisBridge) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, BROKER_DIAL_SEC*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+
+	if b.password != "" {
+		conn.SetDeadline(time.Now().Add(BROKER_DIAL_SEC * time.Second))
+		if _, err := redisCommand(conn, r, "AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	return conn, r, nil
+}
+
+//
+// RESP
+//
+
+func redisCommand(w io.Writer, r *bufio.Reader, args ...string) (interface{}, error) {
+	buf := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		buf += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(w, buf); err != nil {
+		return nil, err
+	}
+
+	return redisReadReply(r)
+}
+
+func redisReadReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New("redis: " + line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = redisReadReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	default:
+		return nil, errors.New("redis: unknown reply [" + line + "]")
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) >= 2 && line[len(line)-2] == '\r' {
+		return line[:len(line)-2], nil
+	}
+	return line[:len(line)-1], nil
+}
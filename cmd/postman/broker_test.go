@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fake pub/sub servers which fan out messages to every subscribed connection
+type fakePubSub struct {
+	mu   sync.Mutex
+	subs map[net.Conn]bool
+}
+
+func (ps *fakePubSub) Add(conn net.Conn) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.subs[conn] = true
+}
+
+func (ps *fakePubSub) Send(f func(conn net.Conn)) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for conn := range ps.subs {
+		f(conn)
+	}
+	return len(ps.subs)
+}
+
+func StartFakeServer(t *testing.T, serve func(conn net.Conn, ps *fakePubSub)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Cleanup(func() { l.Close() })
+
+	require.NoError(t, err)
+
+	ps := &fakePubSub{subs: make(map[net.Conn]bool)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn, ps)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func fakeRedis(conn net.Conn, ps *fakePubSub) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		v, err := redisReadReply(r)
+		if err != nil {
+			return
+		}
+		args, _ := v.([]interface{})
+
+		switch strings.ToUpper(args[0].(string)) {
+		case "AUTH":
+			io.WriteString(conn, "+OK\r\n")
+		case "SUBSCRIBE":
+			ps.Add(conn)
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1].(string)), args[1])
+		case "PUBLISH":
+			topic, data := args[1].(string), args[2].(string)
+			n := ps.Send(func(c net.Conn) {
+				fmt.Fprintf(c, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(topic), topic, len(data), data)
+			})
+			fmt.Fprintf(conn, ":%d\r\n", n)
+		}
+	}
+}
+
+func fakeNats(conn net.Conn, ps *fakePubSub) {
+	defer conn.Close()
+
+	io.WriteString(conn, "INFO {}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+
+		switch f[0] {
+		case "SUB":
+			ps.Add(conn)
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "PUB":
+			n, _ := strconv.Atoi(f[2])
+			buf := make([]byte, n+2)
+			io.ReadFull(r, buf)
+			ps.Send(func(c net.Conn) {
+				fmt.Fprintf(c, "MSG %s 1 %d\r\n%s\r\n", f[1], n, buf[:n])
+			})
+		}
+	}
+}
+
+func RequireBrokerMessage(t *testing.T, url string) {
+	t.Helper()
+
+	SetOptions(Options{Broker: url})
+	Prepare()
+
+	// start server
+	s := StartMockServer(t)
+
+	// client_1: connect and subscribe
+	c1 := RequireConnectAndSubscribe(t, s.URL, "TEST_CH", "TEST_CLI_1")
+	time.Sleep(100 * time.Millisecond) // wait
+
+	// publish from other postman instance
+	other, err := NewBroker(url)
+	t.Cleanup(other.Close)
+
+	require.NoError(t, err)
+	other.Emit(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "", ""))
+
+	// client_1: recieve message "TEST@MESSAGE"
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err := c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@MESSAGE")
+
+	// client_2: publish on this instance
+	RequireConnectAndPublish(t, s.URL, "TEST_CH", "TEST@MESSAGE_2", "TEST_CLI_2")
+
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err = c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@MESSAGE_2")
+}
+
+func TestBrokerUrl(t *testing.T) {
+	b, err := NewBroker("")
+
+	require.NoError(t, err)
+	require.IsType(t, &LocalBroker{}, b)
+
+	_, err = NewBroker("unknown://127.0.0.1:1234")
+
+	require.Error(t, err)
+}
+
+func TestRedisBroker(t *testing.T) {
+	addr := StartFakeServer(t, fakeRedis)
+	RequireBrokerMessage(t, "redis://:TEST_PASS@"+addr)
+}
+
+func TestNatsBroker(t *testing.T) {
+	addr := StartFakeServer(t, fakeNats)
+	RequireBrokerMessage(t, "nats://"+addr+"/TEST_TOPIC")
+}
+
+func TestBrokerUnreachable(t *testing.T) {
+	SetOptions(Options{Broker: "redis://127.0.0.1:1"})
+	Prepare()
+
+	// start server
+	s := StartMockServer(t)
+
+	// client_1: connect and subscribe
+	c1 := RequireConnectAndSubscribe(t, s.URL, "TEST_CH", "TEST_CLI_1")
+	time.Sleep(100 * time.Millisecond) // wait
+
+	// delivered in this instance at least
+	RequireConnectAndPublish(t, s.URL, "TEST_CH", "TEST@MESSAGE", "TEST_CLI_2")
+
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err := c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@MESSAGE")
+}
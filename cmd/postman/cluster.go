@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CLUSTER_PRESENCE_MSEC = 1000
+	CLUSTER_RETRY_MSEC    = 1000
+	CLUSTER_WRITE_SEC     = 5
+	CLUSTER_SEND_BUFFER   = 512
+)
+
+//
+// Frame
+//
+
+type ClusterFrame struct {
+	Type     string              `json:"type"` // hello, auth, presence, publish
+	Node     string              `json:"node"`
+	Nonce    string              `json:"nonce,omitempty"`
+	Mac      string              `json:"mac,omitempty"`
+	Addr     string              `json:"addr,omitempty"`
+	Peers    []string            `json:"peers,omitempty"`
+	Channels map[string][]string `json:"channels,omitempty"`
+	Message  *PublishSendMessage `json:"message,omitempty"`
+}
+
+type ClusterLink struct {
+	node  string        // set when joined
+	hello *ClusterFrame // waiting for auth
+	nonce string        // challenge sent in our hello
+	conn  net.Conn
+	enc   *json.Encoder
+	out   chan *ClusterFrame // written by writePump not to block the publish path
+	done  chan struct{}
+
+	closeOnce sync.Once
+}
+
+func NewClusterLink(conn net.Conn) *ClusterLink {
+	l := &ClusterLink{
+		nonce: clusterNonce(),
+		conn:  conn,
+		enc:   json.NewEncoder(conn),
+		out:   make(chan *ClusterFrame, CLUSTER_SEND_BUFFER),
+		done:  make(chan struct{}),
+	}
+	return l
+}
+
+// Send must not block, returns false when the frame is dropped.
+func (l *ClusterLink) Send(f *ClusterFrame) bool {
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+
+	select {
+	case l.out <- f:
+		return true
+	default:
+		metrics.Dropped("cluster_queue_full")
+		return false
+	}
+}
+
+func (l *ClusterLink) Close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+func (l *ClusterLink) writePump() {
+	for {
+		select {
+		case <-l.done:
+			return
+		case f := <-l.out:
+			l.conn.SetWriteDeadline(time.Now().Add(CLUSTER_WRITE_SEC * time.Second))
+			if err := l.enc.Encode(f); err != nil {
+				l.Close()
+				return
+			}
+		}
+	}
+}
+
+//
+// Node
+//
+
+type ClusterNode struct {
+	Name     string
+	Addr     string // advertised address for other nodes
+	Deliver  func(pmsg *PublishSendMessage)
+	Presence func() map[string][]string
+	Secret   string // shared secret proved by HMAC of the peer's nonce, and empty is no auth
+
+	listen   string
+	discover bool
+	listener net.Listener
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup // accept, presence, dial and serve goroutines
+
+	mu      sync.RWMutex
+	conns   map[net.Conn]bool              // open connections closed by Stop
+	links   map[string]*ClusterLink        // node name -> link
+	peers   map[string]bool                // dialing addresses
+	remotes map[string]map[string][]string // node name -> channel -> clients
+}
+
+func NewClusterNode(name string, listen string, discover bool) *ClusterNode {
+	addr := listen
+	if strings.HasPrefix(listen, ":") {
+		addr = host + listen
+	}
+
+	n := &ClusterNode{
+		Name:     name,
+		Addr:     addr,
+		Deliver:  func(pmsg *PublishSendMessage) {},
+		Presence: func() map[string][]string { return map[string][]string{} },
+		listen:   listen,
+		discover: discover,
+		stop:     make(chan struct{}),
+		conns:    make(map[net.Conn]bool),
+		links:    make(map[string]*ClusterLink),
+		peers:    make(map[string]bool),
+		remotes:  make(map[string]map[string][]string),
+	}
+	return n
+}
+
+func (n *ClusterNode) Start(peers []string) error {
+	l, err := net.Listen("tcp", n.listen)
+	if err != nil {
+		return err
+	}
+	n.listener = l
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			if !IpValidation(conn.RemoteAddr().String()) {
+				log.Printf("> [Warning] cluster remote ip blocked from %s\n", conn.RemoteAddr().String())
+				metrics.IpBlocked()
+				if logger != nil {
+					logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "cluster", "from": conn.RemoteAddr().String()})
+				}
+
+				conn.Close()
+				continue
+			}
+
+			n.wg.Add(1)
+			go func() {
+				defer n.wg.Done()
+				n.serve(conn)
+			}()
+		}
+	}()
+
+	for _, p := range peers {
+		n.AddPeer(p)
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		ticker := time.NewTicker(CLUSTER_PRESENCE_MSEC * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-n.stop:
+				return
+			case <-ticker.C:
+				n.broadcast(n.presenceFrame())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop closes the listener and connections, and waits for the goroutines.
+func (n *ClusterNode) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+		if n.listener != nil {
+			n.listener.Close()
+		}
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		for conn := range n.conns {
+			conn.Close()
+		}
+	})
+	n.wg.Wait()
+}
+
+func (n *ClusterNode) stopped() bool {
+	select {
+	case <-n.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *ClusterNode) AddPeer(addr string) {
+	if addr == "" || addr == n.Addr || addr == n.listen {
+		return
+	}
+
+	n.mu.Lock()
+	if n.peers[addr] || n.stopped() {
+		n.mu.Unlock()
+		return
+	}
+	n.peers[addr] = true
+	n.wg.Add(1)
+	n.mu.Unlock()
+
+	go func() {
+		defer n.wg.Done()
+		for {
+			conn, err := net.DialTimeout("tcp", addr, CLUSTER_WRITE_SEC*time.Second)
+			if err == nil {
+				if self := n.serve(conn); self {
+					return
+				}
+			}
+
+			select {
+			case <-n.stop:
+				return
+			case <-time.After(CLUSTER_RETRY_MSEC * time.Millisecond):
+			}
+		}
+	}()
+}
+
+// serve returns true when the peer turns out to be this node itself.
+func (n *ClusterNode) serve(conn net.Conn) bool {
+	defer conn.Close()
+
+	n.mu.Lock()
+	if n.stopped() {
+		n.mu.Unlock()
+		return false
+	}
+	n.conns[conn] = true
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.conns, conn)
+		n.mu.Unlock()
+	}()
+
+	link := NewClusterLink(conn)
+	defer link.Close()
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		link.writePump()
+	}()
+	link.Send(n.helloFrame(link.nonce))
+
+	dec := json.NewDecoder(conn)
+	for {
+		var f ClusterFrame
+		if err := dec.Decode(&f); err != nil {
+			break
+		}
+
+		if f.Type == "hello" && f.Node == n.Name {
+			return true
+		}
+		n.handle(link, &f)
+	}
+
+	if link.node != "" {
+		n.mu.Lock()
+		if n.links[link.node] == link {
+			delete(n.links, link.node)
+			delete(n.remotes, link.node)
+		}
+		n.mu.Unlock()
+
+		log.Printf("> [Cluster] node %s left\n", link.node)
+		if logger != nil {
+			logger.Log(INFO, "cluster node left", logrus.Fields{"method": "cluster", "node": link.node})
+		}
+	}
+
+	return false
+}
+
+func (n *ClusterNode) handle(link *ClusterLink, f *ClusterFrame) {
+	switch f.Type {
+	case "hello":
+		if link.node != "" || link.hello != nil {
+			return
+		}
+		if n.Secret == "" {
+			n.join(link, f)
+			return
+		}
+
+		// answer the challenge of the peer, and wait for the answer to ours
+		link.hello = f
+		link.Send(&ClusterFrame{Type: "auth", Node: n.Name, Mac: n.mac(f.Nonce, n.Name)})
+
+	case "auth":
+		if link.node != "" || link.hello == nil {
+			return
+		}
+		if !hmac.Equal([]byte(f.Mac), []byte(n.mac(link.nonce, link.hello.Node))) {
+			log.Printf("> [Warning] cluster authentication failed from %s\n", link.conn.RemoteAddr().String())
+			if logger != nil {
+				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "cluster", "node": link.hello.Node, "from": link.conn.RemoteAddr().String()})
+			}
+
+			link.Close()
+			return
+		}
+		n.join(link, link.hello)
+
+	case "presence":
+		if link.node == "" {
+			return
+		}
+		n.mu.Lock()
+		n.remotes[link.node] = f.Channels
+		n.mu.Unlock()
+
+	case "publish":
+		if link.node == "" || f.Message == nil {
+			return
+		}
+		n.Deliver(f.Message)
+	}
+}
+
+func (n *ClusterNode) join(link *ClusterLink, hello *ClusterFrame) {
+	link.node = hello.Node
+	n.mu.Lock()
+	n.links[hello.Node] = link
+	n.mu.Unlock()
+
+	log.Printf("> [Cluster] node %s joined from %s\n", hello.Node, link.conn.RemoteAddr().String())
+	if logger != nil {
+		logger.Log(INFO, "cluster node joined", logrus.Fields{"method": "cluster", "node": hello.Node, "from": link.conn.RemoteAddr().String()})
+	}
+
+	if n.discover {
+		n.AddPeer(hello.Addr)
+		for _, p := range hello.Peers {
+			n.AddPeer(p)
+		}
+	}
+
+	link.Send(n.presenceFrame())
+}
+
+// Relay sends the message to the nodes which have subscribers for its channel.
+func (n *ClusterNode) Relay(pmsg *PublishSendMessage) {
+	f := &ClusterFrame{Type: "publish", Node: n.Name, Message: pmsg}
+
+	n.mu.RLock()
+	targets := []*ClusterLink{}
+	for node, chs := range n.remotes {
+		for ch := range chs {
+			if ChannelMatch(pmsg.Channel, ch) {
+				if l, ok := n.links[node]; ok {
+					targets = append(targets, l)
+				}
+				break
+			}
+		}
+	}
+	n.mu.RUnlock()
+
+	for _, l := range targets {
+		l.Send(f)
+	}
+}
+
+// Nodes returns the channels and clients of every node including this node.
+func (n *ClusterNode) Nodes() map[string]map[string][]string {
+	nodes := make(map[string]map[string][]string)
+	nodes[n.Name] = n.Presence()
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for node, chs := range n.remotes {
+		nodes[node] = chs
+	}
+
+	return nodes
+}
+
+func (n *ClusterNode) broadcast(f *ClusterFrame) {
+	n.mu.RLock()
+	links := []*ClusterLink{}
+	for _, l := range n.links {
+		links = append(links, l)
+	}
+	n.mu.RUnlock()
+
+	for _, l := range links {
+		l.Send(f)
+	}
+}
+
+func (n *ClusterNode) helloFrame(nonce string) *ClusterFrame {
+	n.mu.RLock()
+	peers := []string{}
+	for p := range n.peers {
+		peers = append(peers, p)
+	}
+	n.mu.RUnlock()
+
+	return &ClusterFrame{Type: "hello", Node: n.Name, Addr: n.Addr, Peers: peers, Nonce: nonce}
+}
+
+func (n *ClusterNode) presenceFrame() *ClusterFrame {
+	return &ClusterFrame{Type: "presence", Node: n.Name, Channels: n.Presence()}
+}
+
+// mac signs the nonce with the node name of the answer, then the answer can not be reflected to its sender.
+func (n *ClusterNode) mac(nonce string, node string) string {
+	h := hmac.New(sha256.New, []byte(n.Secret))
+	h.Write([]byte(nonce + "/" + node))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func clusterNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type clusterInbox struct {
+	mu   sync.Mutex
+	msgs []*PublishSendMessage
+}
+
+func (ib *clusterInbox) Deliver(pmsg *PublishSendMessage) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	ib.msgs = append(ib.msgs, pmsg)
+}
+
+func (ib *clusterInbox) Len() int {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	return len(ib.msgs)
+}
+
+func RequireClusterNode(t *testing.T, name string, listen string, discover bool, peers []string, channels map[string][]string) (*ClusterNode, *clusterInbox) {
+	t.Helper()
+
+	ib := &clusterInbox{}
+	n := NewClusterNode(name, listen, discover)
+	n.Deliver = ib.Deliver
+	n.Presence = func() map[string][]string { return channels }
+
+	err := n.Start(peers)
+	t.Cleanup(n.Stop)
+
+	require.NoError(t, err)
+
+	return n, ib
+}
+
+func RequireClusterNodes(t *testing.T, n *ClusterNode, count int) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		return len(n.Nodes()) == count
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestClusterRelay(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	// static peers
+	a, ibA := RequireClusterNode(t, "node_a", "127.0.0.1:17901", false, []string{"127.0.0.1:17902", "127.0.0.1:17903"}, map[string][]string{})
+	_, ibB := RequireClusterNode(t, "node_b", "127.0.0.1:17902", false, []string{}, map[string][]string{"TEST_CH/1": {"TEST_CLI_B@127.0.0.1:50000"}})
+	_, ibC := RequireClusterNode(t, "node_c", "127.0.0.1:17903", false, []string{}, map[string][]string{"OTHER_CH": {"TEST_CLI_C@127.0.0.1:50001"}})
+
+	RequireClusterNodes(t, a, 3)
+
+	nodes := a.Nodes()
+	require.Equal(t, nodes["node_b"]["TEST_CH/1"], []string{"TEST_CLI_B@127.0.0.1:50000"})
+	require.Equal(t, nodes["node_c"]["OTHER_CH"], []string{"TEST_CLI_C@127.0.0.1:50001"})
+
+	// relay only to nodes which have subscribers
+	a.Relay(NewPublishSendMessage("TEST_CH/1", "TEST@MESSAGE", "", ""))
+	a.Relay(NewPublishSendMessage("TEST_CH/*", "TEST@GROUP", "", ""))
+	a.Relay(NewPublishSendMessage("NO_SUB_CH", "TEST@MESSAGE", "", ""))
+
+	require.Eventually(t, func() bool { return ibB.Len() == 2 }, 3*time.Second, 50*time.Millisecond)
+	time.Sleep(200 * time.Millisecond) // wait
+
+	require.Equal(t, ibA.Len(), 0)
+	require.Equal(t, ibB.Len(), 2)
+	require.Equal(t, ibC.Len(), 0)
+	require.Equal(t, ibB.msgs[1].Message, "TEST@GROUP")
+}
+
+func TestClusterLinkQueue(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	// the peer does not read, and frames wait in the queue without writePump
+	c, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	l := NewClusterLink(c)
+	t.Cleanup(l.Close)
+
+	f := &ClusterFrame{Type: "publish", Node: "node_a", Message: NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "", "")}
+	for i := 0; i < CLUSTER_SEND_BUFFER; i++ {
+		require.True(t, l.Send(f))
+	}
+	require.False(t, l.Send(f))
+	require.Equal(t, metrics.dropped.Snapshot()["cluster_queue_full"], int64(1))
+
+	// closed link drops without counting
+	l.Close()
+	require.False(t, l.Send(f))
+	require.Equal(t, metrics.dropped.Snapshot()["cluster_queue_full"], int64(1))
+}
+
+func TestClusterDiscovery(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	// node_b and node_c know only the seed node_a
+	RequireClusterNode(t, "node_a", "127.0.0.1:17911", true, []string{}, map[string][]string{})
+	b, _ := RequireClusterNode(t, "node_b", "127.0.0.1:17912", true, []string{"127.0.0.1:17911"}, map[string][]string{})
+	_, ibC := RequireClusterNode(t, "node_c", "127.0.0.1:17913", true, []string{"127.0.0.1:17911"}, map[string][]string{"TEST_CH": {"TEST_CLI_C@127.0.0.1:50001"}})
+
+	RequireClusterNodes(t, b, 3)
+
+	b.Relay(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "", ""))
+
+	require.Eventually(t, func() bool { return ibC.Len() == 1 }, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestClusterSelfPeer(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	// same peer list on every node contains itself
+	a, _ := RequireClusterNode(t, "node_a", "127.0.0.1:17921", false, []string{"127.0.0.1:17921", "127.0.0.1:17922"}, map[string][]string{})
+	RequireClusterNode(t, "node_b", "127.0.0.1:17922", false, []string{"127.0.0.1:17921", "127.0.0.1:17922"}, map[string][]string{})
+
+	RequireClusterNodes(t, a, 2)
+}
+
+func TestClusterStatus(t *testing.T) {
+	SetOptions(Options{ClusterName: "node_local", ClusterAddr: "127.0.0.1:17931"})
+	Prepare()
+	t.Cleanup(func() {
+		if cluster != nil {
+			cluster.Stop()
+			cluster = nil
+		}
+	})
+
+	StartCluster()
+	RequireClusterNode(t, "node_remote", "127.0.0.1:17932", false, []string{"127.0.0.1:17931"}, map[string][]string{"TEST_CH": {"TEST_CLI@127.0.0.1:50000"}})
+
+	RequireClusterNodes(t, cluster, 2)
+
+	msg := NewStatusMessage(broker)
+
+	require.Equal(t, msg.Node, "node_local")
+	require.Equal(t, msg.Nodes["node_remote"]["TEST_CH"], []string{"TEST_CLI@127.0.0.1:50000"})
+}
+
+func TestClusterSecret(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	start := func(name string, listen string, secret string, peers []string, channels map[string][]string) (*ClusterNode, *clusterInbox) {
+		ib := &clusterInbox{}
+		n := NewClusterNode(name, listen, false)
+		n.Deliver = ib.Deliver
+		n.Presence = func() map[string][]string { return channels }
+		n.Secret = secret
+
+		require.NoError(t, n.Start(peers))
+		t.Cleanup(n.Stop)
+		return n, ib
+	}
+
+	// same secret
+	a, _ := start("node_a", "127.0.0.1:17941", "TEST_SECRET", []string{"127.0.0.1:17942", "127.0.0.1:17943"}, map[string][]string{})
+	_, ibB := start("node_b", "127.0.0.1:17942", "TEST_SECRET", []string{}, map[string][]string{"TEST_CH": {"TEST_CLI_B@127.0.0.1:50000"}})
+
+	// wrong secret
+	c, _ := start("node_c", "127.0.0.1:17943", "WRONG_SECRET", []string{}, map[string][]string{"TEST_CH": {"TEST_CLI_C@127.0.0.1:50001"}})
+
+	RequireClusterNodes(t, a, 2)
+	time.Sleep(500 * time.Millisecond) // wait
+
+	require.Len(t, a.Nodes(), 2)
+	require.Len(t, c.Nodes(), 1)
+
+	a.Relay(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "", ""))
+
+	require.Eventually(t, func() bool { return ibB.Len() == 1 }, 3*time.Second, 50*time.Millisecond)
+
+	// publish without auth is ignored
+	conn, err := net.Dial("tcp", "127.0.0.1:17942")
+
+	require.NoError(t, err)
+	defer conn.Close()
+
+	enc := json.NewEncoder(conn)
+	enc.Encode(&ClusterFrame{Type: "hello", Node: "node_x", Nonce: "TEST_NONCE"})
+	enc.Encode(&ClusterFrame{Type: "auth", Node: "node_x", Mac: "TEST_MAC"})
+	enc.Encode(&ClusterFrame{Type: "publish", Node: "node_x", Message: NewPublishSendMessage("TEST_CH", "TEST@INJECT", "", "")})
+	time.Sleep(500 * time.Millisecond) // wait
+
+	require.Equal(t, ibB.Len(), 1)
+}
+
+func TestClusterSecureMode(t *testing.T) {
+	SetOptions(Options{SecureMode: true, ClusterName: "node_local", ClusterAddr: "127.0.0.1:17951"})
+	Prepare()
+	t.Cleanup(func() {
+		if cluster != nil {
+			cluster.Stop()
+			cluster = nil
+		}
+	})
+
+	// disabled without secret
+	t.Setenv(ENV_CLUSTER_SECRET, "")
+	RequireContainsStdLog(t, StartCluster, "cluster is disabled in secure mode", 0)
+	require.Nil(t, cluster)
+
+	// enabled with secret
+	t.Setenv(ENV_CLUSTER_SECRET, "TEST_SECRET")
+	StartCluster()
+
+	require.NotNil(t, cluster)
+	require.Equal(t, cluster.Secret, "TEST_SECRET")
+}
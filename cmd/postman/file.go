@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ServeFilePath resolves the slash separated path in SERVE_FILES_DIR, and the path out of the directory is invalid.
+// Empty path is the directory itself.
+func ServeFilePath(name string) (string, error) {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return SERVE_FILES_DIR, nil
+	}
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", errors.New("file path is invalid")
+	}
+	path := filepath.Join(SERVE_FILES_DIR, filepath.FromSlash(name))
+
+	// symbolic links must not point out of the directory
+	root, err := filepath.EvalSymlinks(SERVE_FILES_DIR)
+	if err != nil {
+		return "", err
+	}
+	for p := path; p != SERVE_FILES_DIR; p = filepath.Dir(p) {
+		if real, err := filepath.EvalSymlinks(p); err == nil {
+			if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+				return "", errors.New("file path is invalid")
+			}
+			break
+		}
+	}
+
+	return path, nil
+}
+
+// FileStat returns the metadata of the file, and the hash is sha256 of the content only when it is needed.
+func FileStat(path string, hash bool) (*FileInfo, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rel, _ := filepath.Rel(SERVE_FILES_DIR, path)
+	info := &FileInfo{
+		Name:  st.Name(),
+		Path:  filepath.ToSlash(rel),
+		Dir:   st.IsDir(),
+		Size:  st.Size(),
+		Mtime: st.ModTime(),
+	}
+	if info.Path == "." {
+		info.Path = ""
+	}
+	if st.IsDir() {
+		info.Size = 0
+		return info, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// content type by the extension, or sniffed from the head
+	info.Type = mime.TypeByExtension(filepath.Ext(path))
+	if info.Type == "" {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		info.Type = http.DetectContentType(head[:n])
+		f.Seek(0, io.SeekStart)
+	}
+	if !hash {
+		return info, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	info.Hash = hex.EncodeToString(h.Sum(nil))
+
+	return info, nil
+}
+
+// FileList returns the metadata of entries in the directory in order of names.
+func FileList(dir string, hash bool) ([]*FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []*FileInfo{}
+	for _, e := range entries {
+		info, err := FileStat(filepath.Join(dir, e.Name()), hash)
+		if err != nil {
+			continue // removed while listing, or broken link
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+// FileNeedsPost reports whether the command changes files, which is not accepted by GET.
+func FileNeedsPost(cmd string) bool {
+	switch strings.ToLower(cmd) {
+	case "mkdir", "del", "move":
+		return true
+	default:
+		return false
+	}
+}
+
+// FileCommand runs the file command, and returns *ResultMessage, *FileListMessage or *FileStatMessage.
+func FileCommand(msg *FileMessage, from string) interface{} {
+	cmd := strings.ToLower(msg.Command())
+
+	path, err := ServeFilePath(msg.Path)
+	if err == nil && path == SERVE_FILES_DIR && (cmd == "del" || cmd == "move") {
+		err = errors.New("file path is invalid")
+	}
+	if err != nil {
+		log.Printf("> [Warning] file path is invalid \"%s\" from %s\n", msg.Path, from)
+		if logger != nil {
+			logger.Log(WARN, "file path is invalid", logrus.Fields{"method": "file", "command": msg.Command(), "path": msg.Path, "from": from})
+		}
+		return NewResultMessage("fail", "file path is invalid")
+	}
+
+	log.Printf("> [File] cmd:%s path:%s from %s\n", msg.Command(), msg.Path, from)
+	if logger != nil {
+		logger.Log(INFO, "request file "+cmd, logrus.Fields{"method": "file", "command": msg.Command(), "path": msg.Path, "to": msg.To, "from": from})
+	}
+
+	switch cmd {
+	case "list":
+		files, err := FileList(path, msg.Hash)
+		if err != nil {
+			return NewResultMessage("fail", fmt.Sprintf("directory not found \"%s\"", msg.Path))
+		}
+		return NewFileListMessage("success", "", files)
+
+	case "stat":
+		info, err := FileStat(path, msg.Hash)
+		if err != nil {
+			return NewResultMessage("fail", fmt.Sprintf("file not found \"%s\"", msg.Path))
+		}
+		return NewFileStatMessage("success", "", info)
+
+	case "mkdir":
+		if err := os.MkdirAll(path, 0777); err != nil {
+			return NewResultMessage("fail", fmt.Sprintf("could not create directory \"%s\"", msg.Path))
+		}
+		return NewResultMessage("success", "")
+
+	case "del":
+		if !IsExist(path) {
+			return NewResultMessage("fail", fmt.Sprintf("file not found \"%s\"", msg.Path))
+		}
+		// directories must be empty
+		if err := os.Remove(path); err != nil {
+			return NewResultMessage("fail", fmt.Sprintf("could not delete \"%s\"", msg.Path))
+		}
+		return NewResultMessage("success", "")
+
+	case "move":
+		to, err := ServeFilePath(msg.To)
+		if err != nil || to == SERVE_FILES_DIR {
+			return NewResultMessage("fail", "file path is invalid")
+		}
+		if !IsExist(path) {
+			return NewResultMessage("fail", fmt.Sprintf("file not found \"%s\"", msg.Path))
+		}
+		if IsExist(to) {
+			return NewResultMessage("fail", fmt.Sprintf("file already exists \"%s\"", msg.To))
+		}
+		if err := os.Rename(path, to); err != nil {
+			return NewResultMessage("fail", fmt.Sprintf("could not move \"%s\"", msg.Path))
+		}
+		return NewResultMessage("success", "")
+
+	default:
+		log.Printf("> [Warning] file command not found from %s\n", from)
+		if logger != nil {
+			logger.Log(WARN, "command not found", logrus.Fields{"method": "file", "command": msg.Command(), "from": from})
+		}
+		return NewResultMessage("fail", "file command not found")
+	}
+}
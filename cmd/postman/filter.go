@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sharkattack51/golem"
+)
+
+const FILTER_SEND_BUFFER = 512
+
+//
+// Filter
+//
+
+// SubscribeFilter is evaluated for each message before sending to the subscriber. All conditions must match.
+type SubscribeFilter struct {
+	Tag       string            `json:"tag"`        // tag equals
+	Tags      []string          `json:"tags"`       // tag is in the set
+	ExtPrefix string            `json:"ext_prefix"` // extention starts with
+	Json      []*FieldPredicate `json:"json"`       // message is a JSON object and fields match
+}
+
+type FieldPredicate struct {
+	Path  string      `json:"path"` // dot separated field name (e.g. "sensor.temp")
+	Op    string      `json:"op"`   // "==", "!=", ">", ">=", "<", "<=", "exists"
+	Value interface{} `json:"value"`
+}
+
+var filterOps = []string{"==", "!=", ">", ">=", "<", "<=", "exists"}
+
+func (f *SubscribeFilter) Validate() error {
+	for _, p := range f.Json {
+		if p.Path == "" {
+			return errors.New("filter json path is empty")
+		}
+		if !slices.Contains(filterOps, p.Op) {
+			return errors.New("filter json op is invalid [" + p.Op + "]")
+		}
+	}
+	return nil
+}
+
+func (f *SubscribeFilter) Match(pmsg *PublishSendMessage) bool {
+	if f.Tag != "" && f.Tag != pmsg.Tag {
+		return false
+	}
+	if len(f.Tags) > 0 && !slices.Contains(f.Tags, pmsg.Tag) {
+		return false
+	}
+	if f.ExtPrefix != "" && !strings.HasPrefix(pmsg.Extention, f.ExtPrefix) {
+		return false
+	}
+
+	if len(f.Json) > 0 {
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(pmsg.Message), &doc); err != nil {
+			return false
+		}
+		for _, p := range f.Json {
+			if !p.Match(doc) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (p *FieldPredicate) Match(doc map[string]interface{}) bool {
+	var v interface{} = doc
+	for _, k := range strings.Split(p.Path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if v, ok = m[k]; !ok {
+			return false
+		}
+	}
+
+	switch p.Op {
+	case "exists":
+		return true
+	case "==":
+		return reflect.DeepEqual(v, p.Value)
+	case "!=":
+		return !reflect.DeepEqual(v, p.Value)
+	}
+
+	// ordering of numbers or strings
+	cmp := 0
+	switch a := v.(type) {
+	case float64:
+		b, ok := p.Value.(float64)
+		if !ok {
+			return false
+		}
+		if a < b {
+			cmp = -1
+		} else if a > b {
+			cmp = 1
+		}
+	case string:
+		b, ok := p.Value.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(a, b)
+	default:
+		return false
+	}
+
+	switch p.Op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+//
+// Filtered Connection
+//
+
+// FilteredConnection is a websocket connection subscribing channels with filters.
+// It is attached to the broker as a Subscriber instead of joining golem rooms which emit to all members.
+type FilteredConnection struct {
+	conn *golem.Connection
+	out  chan *PublishSendMessage // emitted by writePump not to block the publish path
+	done chan struct{}
+
+	pumpOnce  sync.Once
+	closeOnce sync.Once
+
+	mu      sync.RWMutex
+	filters map[string]*SubscribeFilter // channel -> filter
+}
+
+func NewFilteredConnection(conn *golem.Connection) *FilteredConnection {
+	fc := &FilteredConnection{
+		conn:    conn,
+		out:     make(chan *PublishSendMessage, FILTER_SEND_BUFFER),
+		done:    make(chan struct{}),
+		filters: make(map[string]*SubscribeFilter),
+	}
+	return fc
+}
+
+func (fc *FilteredConnection) Info() string {
+	if v, exist := cliInfos.Load(fc.RemoteAddr()); exist {
+		return v.(string)
+	}
+	return ""
+}
+
+func (fc *FilteredConnection) RemoteAddr() string {
+	return fc.conn.GetSocket().RemoteAddr().String()
+}
+
+// Accepts reports whether the message matches the filter of the channel.
+func (fc *FilteredConnection) Accepts(ch string, pmsg *PublishSendMessage) bool {
+	fc.mu.RLock()
+	f, ok := fc.filters[ch]
+	fc.mu.RUnlock()
+
+	return ok && f.Match(pmsg)
+}
+
+func (fc *FilteredConnection) Send(ch string, pmsg *PublishSendMessage) bool {
+	// filtered out is not dropped
+	if !fc.Accepts(ch, pmsg) {
+		return true
+	}
+
+	// started by the first message, because LoadOrStore may discard the connection
+	fc.pumpOnce.Do(func() { go fc.writePump() })
+
+	select {
+	case <-fc.done:
+		return false
+	default:
+	}
+
+	select {
+	case fc.out <- pmsg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (fc *FilteredConnection) Close() {
+	fc.closeOnce.Do(func() {
+		close(fc.done)
+	})
+}
+
+func (fc *FilteredConnection) writePump() {
+	for {
+		select {
+		case <-fc.done:
+			return
+		case pmsg := <-fc.out:
+			// the hub may close the connection at any time
+			if !SafeEmit(fc.conn, "message", &pmsg) {
+				fc.Close()
+				return
+			}
+		}
+	}
+}
+
+func (fc *FilteredConnection) Set(ch string, f *SubscribeFilter) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.filters[ch] = f
+}
+
+func (fc *FilteredConnection) Remove(ch string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	delete(fc.filters, ch)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func RequireSubscribeWithFilter(t *testing.T, c *websocket.Conn, ch string, ci string, f *SubscribeFilter) {
+	t.Helper()
+
+	j, _ := json.Marshal(&SubscribeMessage{RawChannel: ch, RawClientInfo: ci, Filter: f})
+	sub := "subscribe " + string(j)
+	err := c.WriteMessage(websocket.TextMessage, []byte(sub))
+
+	require.NoError(t, err)
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	// start server
+	s := StartMockServer(t)
+	c1 := RequireConnectAndPing(t, s.URL)
+	c1.ReadMessage()
+	RequireSubscribeWithFilter(t, c1, "TEST_CH", "TEST_CLI_1", &SubscribeFilter{Tags: []string{"A", "B"}})
+	RequireSubscribeWithFilter(t, c1, "TEST_GROUP/1", "TEST_CLI_1", &SubscribeFilter{Tag: "A"})
+	c2 := RequireConnectAndSubscribe(t, s.URL, "TEST_CH", "TEST_CLI_2")
+	time.Sleep(100 * time.Millisecond) // wait
+
+	// status contains filtered connection
+	require.Equal(t, len(NewStatusMessage(broker).Channels["TEST_CH"]), 2)
+
+	EmitMessage(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE_1", "C", ""))
+	EmitMessage(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE_2", "B", ""))
+
+	// filtered
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err := c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@MESSAGE_2")
+
+	// not filtered
+	c2.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err = c2.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@MESSAGE_1")
+
+	// group publish
+	EmitMessage(NewPublishSendMessage("TEST_GROUP/*", "TEST@MESSAGE_3", "B", ""))
+	EmitMessage(NewPublishSendMessage("TEST_GROUP/*", "TEST@MESSAGE_4", "A", ""))
+
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err = c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@MESSAGE_4")
+
+	// unsubscribe
+	RequireUnsubscribe(t, c1, "TEST_CH", "TEST_CLI_1")
+	time.Sleep(100 * time.Millisecond) // wait
+
+	require.Equal(t, len(NewStatusMessage(broker).Channels["TEST_CH"]), 1)
+}
+
+func TestSubscribeFilterMatch(t *testing.T) {
+	pmsg := NewPublishSendMessage("TEST_CH", `{"sensor":{"temp":30.5,"name":"door"},"on":true}`, "TAG", "EXT/1")
+
+	var tests = []struct {
+		filter *SubscribeFilter
+		expect bool
+	}{
+		{&SubscribeFilter{}, true},
+		{&SubscribeFilter{Tag: "TAG"}, true},
+		{&SubscribeFilter{Tag: "OTHER"}, false},
+		{&SubscribeFilter{Tags: []string{"OTHER", "TAG"}}, true},
+		{&SubscribeFilter{ExtPrefix: "EXT/"}, true},
+		{&SubscribeFilter{ExtPrefix: "OTHER/"}, false},
+		{&SubscribeFilter{Json: []*FieldPredicate{{Path: "sensor.temp", Op: ">", Value: 30.0}}}, true},
+		{&SubscribeFilter{Json: []*FieldPredicate{{Path: "sensor.temp", Op: "<=", Value: 30.0}}}, false},
+		{&SubscribeFilter{Json: []*FieldPredicate{{Path: "sensor.name", Op: "==", Value: "door"}}}, true},
+		{&SubscribeFilter{Json: []*FieldPredicate{{Path: "on", Op: "!=", Value: false}}}, true},
+		{&SubscribeFilter{Json: []*FieldPredicate{{Path: "sensor.none", Op: "exists"}}}, false},
+		{&SubscribeFilter{Tag: "TAG", Json: []*FieldPredicate{{Path: "sensor", Op: "exists"}}}, true},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.filter.Match(pmsg), tt.expect)
+	}
+
+	// not json
+	f := &SubscribeFilter{Json: []*FieldPredicate{{Path: "a", Op: "exists"}}}
+
+	require.False(t, f.Match(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "", "")))
+
+	// invalid op
+	f = &SubscribeFilter{Json: []*FieldPredicate{{Path: "a", Op: "~"}}}
+
+	require.Error(t, f.Validate())
+}
+
+func TestFilteredConnectionSend(t *testing.T) {
+	pmsg := NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "TAG", "")
+
+	fc := NewFilteredConnection(nil)
+	fc.Set("TEST_CH", &SubscribeFilter{Tag: "TAG"})
+	fc.pumpOnce.Do(func() {}) // no pump
+
+	// filtered out is not dropped
+	require.True(t, fc.Send("OTHER_CH", pmsg))
+
+	// full buffer is dropped without blocking
+	for i := 0; i < FILTER_SEND_BUFFER; i++ {
+		require.True(t, fc.Send("TEST_CH", pmsg))
+	}
+	require.False(t, fc.Send("TEST_CH", pmsg))
+
+	// closed
+	fc.Close()
+
+	require.False(t, fc.Send("TEST_CH", pmsg))
+}
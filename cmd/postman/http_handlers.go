@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -24,6 +26,7 @@ func PublishHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !IpValidation(r.RemoteAddr) {
 		log.Printf("> [Warning] remote ip blocked from %s\n", r.RemoteAddr)
+		metrics.IpBlocked()
 		if logger != nil {
 			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
 		}
@@ -39,6 +42,7 @@ func PublishHandler(w http.ResponseWriter, r *http.Request) {
 		res, err := Authenticate(secret, smsg.Token(), host)
 		if !res || err != nil {
 			log.Printf("> [Warning] authentication failed from %s\n", r.RemoteAddr)
+			metrics.AuthFailed()
 			if logger != nil {
 				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "publish", "token": smsg.Token(), "from": r.RemoteAddr})
 			}
@@ -103,20 +107,11 @@ func PublishHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		pmsg := NewPublishSendMessage(msg.Channel(), msg.Message(), msg.Tag(), msg.Extention())
-		if roomMg != nil {
-			if strings.HasSuffix(msg.Channel(), "/*") {
-				groupCh := strings.TrimSuffix(msg.Channel(), "/*")
-				for _, ri := range roomMg.GetRoomInfos() {
-					if strings.HasPrefix(ri.Topic, groupCh) {
-						ck := strings.TrimPrefix(ri.Topic, groupCh)
-						if len(ck) > 0 && strings.HasPrefix(ck, "/") {
-							roomMg.Emit(ri.Topic, "message", &pmsg)
-						}
-					}
-				}
-			} else {
-				roomMg.Emit(msg.Channel(), "message", &pmsg)
-			}
+		if err := EmitMessage(pmsg); err != nil {
+			res := NewResultMessage("fail", err.Error())
+			j, _ := json.Marshal(res)
+			fmt.Fprint(w, string(j))
+			return
 		}
 
 		res := NewResultMessage("success", "")
@@ -130,6 +125,7 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !IpValidation(r.RemoteAddr) {
 		log.Printf("> [Warning] remote ip blocked from %s\n", r.RemoteAddr)
+		metrics.IpBlocked()
 		if logger != nil {
 			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
 		}
@@ -145,6 +141,7 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 		res, err := Authenticate(secret, smsg.Token(), host)
 		if !res || err != nil {
 			log.Printf("> [Warning] authentication failed from %s\n", r.RemoteAddr)
+			metrics.AuthFailed()
 			if logger != nil {
 				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "status", "token": smsg.Token(), "from": r.RemoteAddr})
 			}
@@ -161,7 +158,7 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 		logger.Log(INFO, "get status", logrus.Fields{"method": "status", "from": r.RemoteAddr})
 	}
 
-	msg := NewStatusMessage(roomMg)
+	msg := NewStatusMessage(broker)
 	j, _ := json.Marshal(msg)
 	fmt.Fprint(w, string(j))
 }
@@ -171,6 +168,7 @@ func StatusPpHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !IpValidation(r.RemoteAddr) {
 		log.Printf("> [Warning] remote ip blocked from %s\n", r.RemoteAddr)
+		metrics.IpBlocked()
 		if logger != nil {
 			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
 		}
@@ -186,6 +184,7 @@ func StatusPpHandler(w http.ResponseWriter, r *http.Request) {
 		res, err := Authenticate(secret, smsg.Token(), host)
 		if !res || err != nil {
 			log.Printf("> [Warning] authentication failed from %s\n", r.RemoteAddr)
+			metrics.AuthFailed()
 			if logger != nil {
 				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "status_pp", "token": smsg.Token(), "from": r.RemoteAddr})
 			}
@@ -202,16 +201,17 @@ func StatusPpHandler(w http.ResponseWriter, r *http.Request) {
 		logger.Log(INFO, "get status pp", logrus.Fields{"method": "status_pp", "from": r.RemoteAddr})
 	}
 
-	msg := NewStatusMessage(roomMg)
+	msg := NewStatusMessage(broker)
 	j, _ := json.MarshalIndent(msg, "", "    ")
 	fmt.Fprint(w, string(j))
 }
 
-func StoreHandler(w http.ResponseWriter, r *http.Request) {
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
 	AllowCORS(w)
 
 	if !IpValidation(r.RemoteAddr) {
 		log.Printf("> [Warning] remote ip blocked from %s\n", r.RemoteAddr)
+		metrics.IpBlocked()
 		if logger != nil {
 			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
 		}
@@ -227,8 +227,9 @@ func StoreHandler(w http.ResponseWriter, r *http.Request) {
 		res, err := Authenticate(secret, smsg.Token(), host)
 		if !res || err != nil {
 			log.Printf("> [Warning] authentication failed from %s\n", r.RemoteAddr)
+			metrics.AuthFailed()
 			if logger != nil {
-				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "store", "token": smsg.Token(), "from": r.RemoteAddr})
+				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "metrics", "token": smsg.Token(), "from": r.RemoteAddr})
 			}
 
 			msg := NewResultMessage("fail", "security error")
@@ -238,21 +239,90 @@ func StoreHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if !opts.UseStoreApi || kvsDB == nil {
-		log.Printf("> [Warning] key-value store api is disable from %s\n", r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Expose(w)
+}
+
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	AllowCORS(w)
+
+	if !ProbeValidation(w, r, "healthz") {
+		return
+	}
+
+	msg := NewResultMessage("success", "")
+	j, _ := json.Marshal(msg)
+	fmt.Fprint(w, string(j))
+}
+
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	AllowCORS(w)
+
+	if !ProbeValidation(w, r, "readyz") {
+		return
+	}
+
+	checks, reasons := CheckReadiness()
+	if len(reasons) > 0 {
+		msg := NewReadinessMessage("fail", strings.Join(reasons, ", "), checks)
+		j, _ := json.Marshal(msg)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	msg := NewReadinessMessage("success", "", checks)
+	j, _ := json.Marshal(msg)
+	fmt.Fprint(w, string(j))
+}
+
+// ProbeValidation checks the remote ip and the token of the probe request unless the probes are open.
+func ProbeValidation(w http.ResponseWriter, r *http.Request, method string) bool {
+	if opts.OpenProbe {
+		return true
+	}
+
+	if !IpValidation(r.RemoteAddr) {
+		log.Printf("> [Warning] remote ip blocked from %s\n", r.RemoteAddr)
+		metrics.IpBlocked()
 		if logger != nil {
-			logger.Log(WARN, "key-value store api is disable", logrus.Fields{"method": "file", "from": r.RemoteAddr})
+			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
 		}
 
-		msg := NewResultMessage("fail", "key-value store api is disable")
+		msg := NewResultMessage("fail", "remote ip blocked")
 		j, _ := json.Marshal(msg)
+		w.WriteHeader(http.StatusForbidden)
 		fmt.Fprint(w, string(j))
-		return
+		return false
 	}
 
+	if opts.SecureMode {
+		smsg := SecureHandler(r)
+		res, err := Authenticate(secret, smsg.Token(), host)
+		if !res || err != nil {
+			log.Printf("> [Warning] authentication failed from %s\n", r.RemoteAddr)
+			metrics.AuthFailed()
+			if logger != nil {
+				logger.Log(WARN, "authentication failed", logrus.Fields{"method": method, "token": smsg.Token(), "from": r.RemoteAddr})
+			}
+
+			msg := NewResultMessage("fail", "security error")
+			j, _ := json.Marshal(msg)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, string(j))
+			return false
+		}
+	}
+
+	return true
+}
+
+func StoreHandler(w http.ResponseWriter, r *http.Request) {
+	AllowCORS(w)
+
 	params := make(map[string]string)
 	query := r.URL.Query()
-	for _, s := range []string{"command", "cmd", "key", "value", "val"} {
+	for _, s := range []string{"command", "cmd", "key", "value", "val", "ttl", "prefix", "start", "end", "limit", "cursor", "ops", "ns", "name", "path"} {
 		param := query[s]
 		if len(param) > 0 {
 			params[s] = param[0]
@@ -262,12 +332,27 @@ func StoreHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	hasQuery := false
-	if (params["command"] != "" || params["cmd"] != "") && params["key"] != "" {
+	if (params["command"] != "" || params["cmd"] != "") && (params["key"] != "" || !StoreNeedsKey(params["command"]+params["cmd"])) {
 		hasQuery = true
 	}
 
 	// for GET url-param
 	msg := NewStoreMessage(params["command"], params["cmd"], params["key"], params["value"], params["val"])
+	msg.Ttl, _ = strconv.Atoi(params["ttl"])
+	msg.Prefix = params["prefix"]
+	msg.Start = params["start"]
+	msg.End = params["end"]
+	msg.Limit, _ = strconv.Atoi(params["limit"])
+	msg.Cursor = params["cursor"]
+	msg.Ns = params["ns"]
+	msg.Name = params["name"]
+	msg.Path = params["path"]
+	if params["ops"] != "" {
+		json.Unmarshal([]byte(params["ops"]), &msg.Ops)
+	}
+	if old, ok := query["old"]; ok && len(old) > 0 {
+		msg.Old = &old[0]
+	}
 
 	// for POST form-data
 	if !hasQuery {
@@ -281,111 +366,105 @@ func StoreHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if msg.Command() != "" {
-		if msg.Key() != "" {
-			switch strings.ToLower(msg.Command()) {
-			case "get":
-				log.Printf("> [Store] cmd:%s key:%s from %s\n", msg.Command(), msg.Key(), r.RemoteAddr)
-				if logger != nil {
-					logger.Log(INFO, "request store get", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "from": r.RemoteAddr})
-				}
-
-				v, err := StoreGet(kvsDB, msg)
-				if err != nil {
-					res := NewResultMessage("", "") // Key無しの場合
-					j, _ := json.Marshal(res)
-					fmt.Fprint(w, string(j))
-					return
-				}
-
-				res := NewResultMessage(v, "")
-				j, _ := json.Marshal(res)
-				fmt.Fprint(w, string(j))
-
-			case "set":
-				log.Printf("> [Store] cmd:%s key:%s val:%s from %s\n", msg.Command(), msg.Key(), msg.Value(), r.RemoteAddr)
-				if logger != nil {
-					logger.Log(INFO, "request store set", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "val": msg.Value(), "from": r.RemoteAddr})
-				}
-
-				err := StoreSet(kvsDB, msg)
-				if err != nil {
-					res := NewResultMessage("fail", err.Error())
-					j, _ := json.Marshal(res)
-					fmt.Fprint(w, string(j))
-					return
-				}
+	if res := StoreAccess(msg, r.RemoteAddr, SecureHandler(r).Token()); res != nil {
+		j, _ := json.Marshal(res)
+		fmt.Fprint(w, string(j))
+		return
+	}
 
-				res := NewResultMessage("success", "")
-				j, _ := json.Marshal(res)
-				fmt.Fprint(w, string(j))
+	// streaming commands
+	switch strings.ToLower(msg.Command()) {
+	case "snapshot", "export":
+		StoreDumpHandler(w, r, msg)
+		return
+	case "import":
+		StoreImportHandler(w, r, msg)
+		return
+	}
 
-			case "has":
-				log.Printf("> [Store] cmd:%s key:%s from %s\n", msg.Command(), msg.Key(), r.RemoteAddr)
-				if logger != nil {
-					logger.Log(INFO, "request store haskey", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "from": r.RemoteAddr})
-				}
+	res := StoreCommand(msg, r.RemoteAddr)
+	j, _ := json.Marshal(res)
+	fmt.Fprint(w, string(j))
+}
 
-				b, err := StoreHas(kvsDB, msg)
-				if err != nil {
-					res := NewResultMessage("fail", err.Error())
-					j, _ := json.Marshal(res)
-					fmt.Fprint(w, string(j))
-					return
-				}
+// StoreDumpHandler streams JSON lines of the snapshot or the export.
+func StoreDumpHandler(w http.ResponseWriter, r *http.Request, msg *StoreMessage) {
+	snapshot := strings.ToLower(msg.Command()) == "snapshot"
+	if snapshot && msg.Ns != "" {
+		res := NewResultMessage("fail", "store namespace is not allowed")
+		j, _ := json.Marshal(res)
+		fmt.Fprint(w, string(j))
+		return
+	}
+	if !StoreValidNamespace(msg.Ns) {
+		res := NewResultMessage("fail", "store namespace is invalid")
+		j, _ := json.Marshal(res)
+		fmt.Fprint(w, string(j))
+		return
+	}
 
-				res := NewResultMessage(strconv.FormatBool(b), "")
-				j, _ := json.Marshal(res)
-				fmt.Fprint(w, string(j))
+	metrics.StoreOp(msg.Command())
 
-			case "del":
-				log.Printf("> [Store] cmd:%s key:%s from %s\n", msg.Command(), msg.Key(), r.RemoteAddr)
-				if logger != nil {
-					logger.Log(INFO, "request store delete", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "from": r.RemoteAddr})
-				}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"postman-"+strings.ToLower(msg.Command())+STORE_BACKUP_EXT+"\"")
 
-				err := StoreDelete(kvsDB, msg)
-				if err != nil {
-					res := NewResultMessage("fail", err.Error())
-					j, _ := json.Marshal(res)
-					fmt.Fprint(w, string(j))
-					return
-				}
+	n, err := StoreDump(kvsDB, w, msg, snapshot)
+	if err != nil {
+		log.Printf("> [Warning] store %s failed: %s from %s\n", strings.ToLower(msg.Command()), err, r.RemoteAddr)
+		if logger != nil {
+			logger.Log(WARN, "store dump failed", logrus.Fields{"method": "store", "command": msg.Command(), "ns": msg.Ns, "error": err.Error(), "from": r.RemoteAddr})
+		}
+		return
+	}
 
-				res := NewResultMessage("success", "")
-				j, _ := json.Marshal(res)
-				fmt.Fprint(w, string(j))
+	log.Printf("> [Store] cmd:%s ns:%s records:%d from %s\n", msg.Command(), msg.Ns, n, r.RemoteAddr)
+	if logger != nil {
+		logger.Log(INFO, "request store "+strings.ToLower(msg.Command()), logrus.Fields{"method": "store", "command": msg.Command(), "ns": msg.Ns, "records": n, "from": r.RemoteAddr})
+	}
+}
 
-			default:
-				log.Printf("> [Warning] store command nou found from %s\n", r.RemoteAddr)
-				if logger != nil {
-					logger.Log(WARN, "command not found", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "value": msg.Value(), "from": r.RemoteAddr})
-				}
+// StoreImportHandler writes JSON lines in the request body.
+func StoreImportHandler(w http.ResponseWriter, r *http.Request, msg *StoreMessage) {
+	if r.Method != http.MethodPost {
+		res := NewResultMessage("fail", "store import needs POST")
+		j, _ := json.Marshal(res)
+		fmt.Fprint(w, string(j))
+		return
+	}
+	if !StoreValidNamespace(msg.Ns) {
+		res := NewResultMessage("fail", "store namespace is invalid")
+		j, _ := json.Marshal(res)
+		fmt.Fprint(w, string(j))
+		return
+	}
 
-				res := NewResultMessage("fail", "store command not found")
-				j, _ := json.Marshal(res)
-				fmt.Fprint(w, string(j))
-			}
-		} else {
-			log.Printf("> [Warning] store key is empty from %s\n", r.RemoteAddr)
-			if logger != nil {
-				logger.Log(WARN, "store key is empty", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "value": msg.Value(), "from": r.RemoteAddr})
-			}
+	metrics.StoreOp(msg.Command())
 
-			res := NewResultMessage("fail", "store key is empty")
-			j, _ := json.Marshal(res)
-			fmt.Fprint(w, string(j))
-		}
-	} else {
-		log.Printf("> [Warning] store command is empty from %s\n", r.RemoteAddr)
+	n, err := StoreImport(kvsDB, http.MaxBytesReader(w, r.Body, StoreImportBytes()), msg)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		err = errors.New("store import is too large")
+	}
+	if err != nil {
+		log.Printf("> [Warning] store import failed: %s from %s\n", err, r.RemoteAddr)
 		if logger != nil {
-			logger.Log(WARN, "store command is empty", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "value": msg.Value(), "from": r.RemoteAddr})
+			logger.Log(WARN, "store import failed", logrus.Fields{"method": "store", "command": msg.Command(), "ns": msg.Ns, "error": err.Error(), "from": r.RemoteAddr})
 		}
 
-		res := NewResultMessage("fail", "store command is empty")
+		res := NewResultMessage("fail", err.Error())
 		j, _ := json.Marshal(res)
 		fmt.Fprint(w, string(j))
+		return
+	}
+
+	log.Printf("> [Store] cmd:%s ns:%s records:%d from %s\n", msg.Command(), msg.Ns, n, r.RemoteAddr)
+	if logger != nil {
+		logger.Log(INFO, "request store import", logrus.Fields{"method": "store", "command": msg.Command(), "ns": msg.Ns, "records": n, "from": r.RemoteAddr})
 	}
+
+	res := NewResultMessage(strconv.Itoa(n), "")
+	j, _ := json.Marshal(res)
+	fmt.Fprint(w, string(j))
 }
 
 func SecureHandler(r *http.Request) *SecureMessage {
@@ -428,6 +507,7 @@ func FileHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !IpValidation(r.RemoteAddr) {
 		log.Printf("> [Warning] remote ip blocked from %s\n", r.RemoteAddr)
+		metrics.IpBlocked()
 		if logger != nil {
 			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
 		}
@@ -443,6 +523,7 @@ func FileHandler(w http.ResponseWriter, r *http.Request) {
 		res, err := Authenticate(secret, smsg.Token(), host)
 		if !res || err != nil {
 			log.Printf("> [Warning] authentication failed from %s\n", r.RemoteAddr)
+			metrics.AuthFailed()
 			if logger != nil {
 				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "store", "token": smsg.Token(), "from": r.RemoteAddr})
 			}
@@ -478,6 +559,56 @@ func FileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	params := make(map[string]string)
+	query := r.URL.Query()
+	for _, s := range []string{"command", "cmd", "path", "to", "hash"} {
+		param := query[s]
+		if len(param) > 0 {
+			params[s] = param[0]
+		} else {
+			params[s] = ""
+		}
+	}
+
+	hasQuery := false
+	if params["command"] != "" || params["cmd"] != "" {
+		hasQuery = true
+	}
+
+	// for GET url-param
+	msg := NewFileMessage(params["command"], params["cmd"], params["path"], params["to"], params["hash"] == "1")
+
+	// for POST form-data
+	if !hasQuery && r.Method == "POST" {
+		r.ParseForm()
+		if len(r.Form) > 0 {
+			if data, ok := r.Form["json"]; ok {
+				if len(data) > 0 {
+					json.Unmarshal([]byte(data[0]), msg)
+				}
+			}
+		}
+	}
+
+	if FileNeedsPost(msg.Command()) && r.Method != "POST" {
+		log.Printf("> [Warning] file command needs POST from %s\n", r.RemoteAddr)
+		if logger != nil {
+			logger.Log(WARN, "file command needs POST", logrus.Fields{"method": "file", "command": msg.Command(), "from": r.RemoteAddr})
+		}
+
+		msg := NewResultMessage("fail", "file command needs POST")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	if msg.Command() != "" {
+		res := FileCommand(msg, r.RemoteAddr)
+		j, _ := json.Marshal(res)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
 	if r.Method == "POST" {
 		formFile, header, err := r.FormFile("file")
 		if err != nil {
@@ -493,7 +624,21 @@ func FileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer formFile.Close()
 
-		path := filepath.Join(SERVE_FILES_DIR, header.Filename)
+		// upload into the sub directory with "path"
+		dir, err := ServeFilePath(r.FormValue("path"))
+		if err != nil {
+			log.Printf("> [Warning] file path is invalid \"%s\" from %s\n", r.FormValue("path"), r.RemoteAddr)
+			if logger != nil {
+				logger.Log(WARN, "file path is invalid", logrus.Fields{"method": "file post", "path": r.FormValue("path"), "from": r.RemoteAddr})
+			}
+
+			msg := NewResultMessage("fail", "file path is invalid")
+			j, _ := json.Marshal(msg)
+			fmt.Fprint(w, string(j))
+			return
+		}
+
+		path := filepath.Join(dir, filepath.Base(header.Filename))
 		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
 		if err != nil {
 			log.Printf("> [Warning] could not write file \"%s\" from %s\n", header.Filename, r.RemoteAddr)
@@ -519,7 +664,7 @@ func FileHandler(w http.ResponseWriter, r *http.Request) {
 		j, _ := json.Marshal(msg)
 		fmt.Fprint(w, string(j))
 
-	} else if r.Method == "GET" {
+	} else if r.Method == "GET" || r.Method == "HEAD" {
 		urls := strings.Split(r.URL.Path, "/postman/file/")
 		pathToFile := ""
 		if len(urls) >= 2 {
@@ -530,9 +675,26 @@ func FileHandler(w http.ResponseWriter, r *http.Request) {
 			pathToFile = "index.html"
 		}
 
-		path := filepath.Join(SERVE_FILES_DIR, pathToFile)
+		path, err := ServeFilePath(pathToFile)
+		if err != nil {
+			log.Printf("> [Warning] file path is invalid \"%s\" from %s\n", pathToFile, r.RemoteAddr)
+			if logger != nil {
+				logger.Log(WARN, "file path is invalid", logrus.Fields{"method": "file get", "name": pathToFile, "from": r.RemoteAddr})
+			}
+
+			msg := NewResultMessage("fail", "file path is invalid")
+			j, _ := json.Marshal(msg)
+			fmt.Fprint(w, string(j))
+			return
+		}
 
 		if !IsExist(path) {
+			// HEAD has no body
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
 			log.Printf("> [Warning] file not found \"%s\" from %s\n", pathToFile, r.RemoteAddr)
 			if logger != nil {
 				logger.Log(WARN, "file not found", logrus.Fields{"method": "file get", "name": pathToFile, "from": r.RemoteAddr})
@@ -549,6 +711,14 @@ func FileHandler(w http.ResponseWriter, r *http.Request) {
 			logger.Log(INFO, "file served", logrus.Fields{"method": "file get", "file": pathToFile, "from": r.RemoteAddr})
 		}
 
+		// metadata of the file in headers without body, and the hash only with hash=1
+		if r.Method == "HEAD" && r.FormValue("hash") == "1" {
+			if info, err := FileStat(path, true); err == nil && !info.Dir {
+				w.Header().Set("ETag", "\""+info.Hash+"\"")
+				w.Header().Set("X-Content-Sha256", info.Hash)
+			}
+		}
+
 		// return file
 		http.ServeFile(w, r, path)
 	}
@@ -559,6 +729,7 @@ func PluginHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !IpValidation(r.RemoteAddr) {
 		log.Printf("> [Warning] remote ip blocked from %s\n", r.RemoteAddr)
+		metrics.IpBlocked()
 		if logger != nil {
 			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
 		}
@@ -574,6 +745,7 @@ func PluginHandler(w http.ResponseWriter, r *http.Request) {
 		res, err := Authenticate(secret, smsg.Token(), host)
 		if !res || err != nil {
 			log.Printf("> [Warning] authentication failed from %s\n", r.RemoteAddr)
+			metrics.AuthFailed()
 			if logger != nil {
 				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "store", "token": smsg.Token(), "from": r.RemoteAddr})
 			}
@@ -648,7 +820,10 @@ func PluginHandler(w http.ResponseWriter, r *http.Request) {
 				logger.Log(INFO, "call plugin", logrus.Fields{"method": "plugin", "command": msg.Command(), "from": r.RemoteAddr})
 			}
 
+			start := time.Now()
 			ret := ExecPlugin(proc.Proc, proc.Args)
+			metrics.PluginExecuted(msg.Command(), time.Since(start))
+
 			fmt.Fprint(w, ret)
 		} else {
 			log.Printf("> [Warning] plugin command not found from %s\n", r.RemoteAddr)
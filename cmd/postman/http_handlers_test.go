@@ -13,9 +13,11 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,7 +26,7 @@ import (
 //
 
 func HttpPublishTester(t *testing.T, o Options, r *http.Request, preFn func(w *httptest.ResponseRecorder, r *http.Request), postFn func(w *httptest.ResponseRecorder)) {
-	opts = o
+	SetOptions(o)
 	Prepare()
 
 	w := httptest.NewRecorder()
@@ -123,6 +125,17 @@ func TestHttpPublishApi(t *testing.T) {
 			RequireResponseIsSuccess(t, w.Body.Bytes())
 		})
 
+	// [GET] store channels are reserved for store notifications
+	for _, ch := range []string{"$store/k", "$store/*", "$store:TEST_NS_B/k"} {
+		HttpPublishTester(t,
+			Options{},
+			httptest.NewRequest(http.MethodGet, "/postman/publish?ch="+url.QueryEscape(ch)+"&msg=TEST@FORGED", nil),
+			nil,
+			func(w *httptest.ResponseRecorder) {
+				RequireResponseIsFail(t, w.Body.Bytes(), "store channel is reserved")
+			})
+	}
+
 	// [GET] ip address validation fail
 	HttpPublishTester(t,
 		Options{IpAddresses: "192.168.0.1"},
@@ -147,7 +160,7 @@ func TestHttpPublishApi(t *testing.T) {
 //
 
 func HttpStatusTester(t *testing.T, o Options, r *http.Request, preFn func(w *httptest.ResponseRecorder, r *http.Request), postFn func(*httptest.ResponseRecorder)) {
-	opts = o
+	SetOptions(o)
 	Prepare()
 
 	w := httptest.NewRecorder()
@@ -234,14 +247,263 @@ func TestHttpStatusApi(t *testing.T) {
 		})
 }
 
+//
+// Metrics
+//
+
+func HttpMetricsTester(t *testing.T, o Options, r *http.Request, preFn func(w *httptest.ResponseRecorder, r *http.Request), postFn func(*httptest.ResponseRecorder)) {
+	SetOptions(o)
+	Prepare()
+
+	w := httptest.NewRecorder()
+	if preFn != nil {
+		preFn(w, r)
+	}
+
+	// request
+	MetricsHandler(w, r)
+
+	// response
+	require.Equal(t, w.Code, http.StatusOK)
+
+	if postFn != nil {
+		postFn(w)
+	}
+}
+
+func TestHttpMetricsApi(t *testing.T) {
+	// [GET] metrics after publish
+	HttpMetricsTester(t,
+		Options{},
+		httptest.NewRequest(http.MethodGet, "/postman/metrics", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			// start server
+			s := StartMockServer(t)
+
+			// client connect and subscribe
+			RequireConnectAndSubscribe(t, s.URL, "TEST_CH", "TEST_CLI")
+
+			time.Sleep(100 * time.Millisecond) // wait
+
+			EmitMessage(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "", ""))
+			EmitMessage(NewPublishSendMessage("TEST_NO_SUB_CH", "TEST@MESSAGE", "", ""))
+		},
+		func(w *httptest.ResponseRecorder) {
+			require.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+			body := w.Body.String()
+			require.Contains(t, body, "postman_connections 1\n")
+			require.Contains(t, body, "postman_connections_total 1\n")
+			require.Contains(t, body, `postman_subscriptions{channel="TEST_CH"} 1`)
+			require.Contains(t, body, `postman_publish_total{channel="TEST_CH"} 1`)
+			require.Contains(t, body, `postman_publish_total{channel="TEST_NO_SUB_CH"} 1`)
+			require.Contains(t, body, `postman_deliveries_total{channel="TEST_CH"} 1`)
+			require.Contains(t, body, `postman_messages_dropped_total{reason="no_subscriber"} 1`)
+			require.Contains(t, body, "postman_sent_bytes_total 19\n")
+		})
+
+	// [GET] metrics for blocked requests
+	HttpMetricsTester(t,
+		Options{SecureMode: true},
+		httptest.NewRequest(http.MethodGet, "/postman/metrics", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			StatusHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/postman/status?tkn=@@@", nil))
+			metrics.PluginExecuted("TEST_CMD", 30*time.Millisecond)
+			opts.SecureMode = false
+		},
+		func(w *httptest.ResponseRecorder) {
+			body := w.Body.String()
+			require.Contains(t, body, "postman_auth_failures_total 1\n")
+			require.Contains(t, body, `postman_plugin_duration_seconds_bucket{plugin="TEST_CMD",le="0.025"} 0`)
+			require.Contains(t, body, `postman_plugin_duration_seconds_bucket{plugin="TEST_CMD",le="0.05"} 1`)
+			require.Contains(t, body, `postman_plugin_duration_seconds_count{plugin="TEST_CMD"} 1`)
+		})
+
+	// [GET] metrics labels are bounded
+	HttpMetricsTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/metrics", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			for i := 0; i <= METRICS_CHANNEL_LABELS; i++ {
+				EmitMessage(NewPublishSendMessage(fmt.Sprintf("TEST_CH_%d", i), "TEST@MESSAGE", "", ""))
+			}
+
+			StoreCommand(&StoreMessage{RawCmd: "SET", RawKey: "TEST_KEY", RawVal: "TEST_VAL"}, "")
+			StoreCommand(&StoreMessage{RawCmd: "TEST_CMD", RawKey: "TEST_KEY"}, "")
+		},
+		func(w *httptest.ResponseRecorder) {
+			body := w.Body.String()
+			require.Contains(t, body, `postman_publish_total{channel="TEST_CH_0"} 1`)
+			require.Contains(t, body, `postman_publish_total{channel="other"} 1`)
+			require.NotContains(t, body, fmt.Sprintf(`channel="TEST_CH_%d"`, METRICS_CHANNEL_LABELS))
+			require.Contains(t, body, `postman_store_operations_total{command="set"} 1`)
+			require.Contains(t, body, `postman_store_operations_total{command="unknown"} 1`)
+			require.NotContains(t, body, `command="test_cmd"`)
+		})
+
+	// [GET] filtered out is not delivered
+	HttpMetricsTester(t,
+		Options{},
+		httptest.NewRequest(http.MethodGet, "/postman/metrics", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			fc := NewFilteredConnection(nil)
+			fc.Set("TEST_CH", &SubscribeFilter{Tag: "A"})
+			broker.Attach("TEST_CH", fc)
+
+			EmitMessage(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "B", ""))
+		},
+		func(w *httptest.ResponseRecorder) {
+			body := w.Body.String()
+			require.Contains(t, body, `postman_publish_total{channel="TEST_CH"} 1`)
+			require.NotContains(t, body, "postman_deliveries_total{")
+			require.NotContains(t, body, "postman_messages_dropped_total{")
+			require.Contains(t, body, "postman_sent_bytes_total 0\n")
+		})
+
+	// [GET] ip address validation fail
+	HttpMetricsTester(t,
+		Options{IpAddresses: "192.168.0.1"},
+		httptest.NewRequest(http.MethodGet, "/postman/metrics", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "remote ip blocked")
+		})
+
+	// [GET] secure mode fail
+	HttpMetricsTester(t,
+		Options{SecureMode: true},
+		httptest.NewRequest(http.MethodGet, "/postman/metrics", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "security error")
+		})
+}
+
+//
+// Health
+//
+
+func HttpHealthTester(t *testing.T, o Options, r *http.Request, code int, preFn func(w *httptest.ResponseRecorder, r *http.Request), postFn func(*httptest.ResponseRecorder)) {
+	SetOptions(o)
+	Prepare()
+
+	w := httptest.NewRecorder()
+	if preFn != nil {
+		preFn(w, r)
+	}
+
+	// request
+	if strings.Contains(r.URL.String(), "readyz") {
+		ReadyzHandler(w, r)
+	} else {
+		HealthzHandler(w, r)
+	}
+
+	// response
+	require.Equal(t, w.Code, code)
+
+	if postFn != nil {
+		postFn(w)
+	}
+}
+
+func TestHttpHealthApi(t *testing.T) {
+	// [GET] healthz
+	HttpHealthTester(t,
+		Options{},
+		httptest.NewRequest(http.MethodGet, "/postman/healthz", nil),
+		http.StatusOK,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+		})
+
+	// [GET] readyz
+	HttpHealthTester(t,
+		Options{UseStoreApi: true, UseFileApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/readyz", nil),
+		http.StatusOK,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			var msg ReadinessMessage
+			err := json.Unmarshal(w.Body.Bytes(), &msg)
+
+			require.NoError(t, err)
+			require.Equal(t, msg.Result, "success")
+			require.Equal(t, msg.Checks, map[string]bool{"store": true, "file": true, "serving": true})
+
+			kvsDB.Close()
+		})
+
+	// [GET] readyz store db is not opened
+	HttpHealthTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/readyz", nil),
+		http.StatusServiceUnavailable,
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			kvsDB.Close()
+			kvsDB = nil
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), fmt.Sprintf("could not open \"%s\"", DB_FILE))
+		})
+
+	// [GET] readyz while draining
+	HttpHealthTester(t,
+		Options{},
+		httptest.NewRequest(http.MethodGet, "/postman/readyz", nil),
+		http.StatusServiceUnavailable,
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			draining.Store(true)
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "server is draining")
+			draining.Store(false)
+		})
+
+	// [GET] secure mode fail
+	HttpHealthTester(t,
+		Options{SecureMode: true},
+		httptest.NewRequest(http.MethodGet, "/postman/healthz", nil),
+		http.StatusForbidden,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "security error")
+		})
+
+	// [GET] ip address validation fail as readyz
+	HttpHealthTester(t,
+		Options{IpAddresses: "192.168.0.1"},
+		httptest.NewRequest(http.MethodGet, "/postman/readyz", nil),
+		http.StatusForbidden,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "remote ip blocked")
+		})
+
+	// [GET] open probe skips ip and token checks
+	HttpHealthTester(t,
+		Options{SecureMode: true, IpAddresses: "192.168.0.1", OpenProbe: true},
+		httptest.NewRequest(http.MethodGet, "/postman/readyz", nil),
+		http.StatusOK,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+		})
+}
+
 //
 // Store
 //
 
 func HttpStoreTester(t *testing.T, o Options, r *http.Request, preFn func(w *httptest.ResponseRecorder, r *http.Request), postFn func(*httptest.ResponseRecorder)) {
-	opts = o
+	SetOptions(o)
 	Prepare()
-	defer kvsDB.Close()
+	defer func() {
+		if kvsDB != nil {
+			kvsDB.Close()
+		}
+	}()
 
 	w := httptest.NewRecorder()
 	if preFn != nil {
@@ -456,117 +718,941 @@ func TestHttpStoreApi(t *testing.T) {
 		})
 }
 
-//
-// File
-//
-
-func HttpFileTester(t *testing.T, o Options, r *http.Request, preFn func(w *httptest.ResponseRecorder, r *http.Request), postFn func(*httptest.ResponseRecorder)) {
-	opts = o
-	Prepare()
-
-	w := httptest.NewRecorder()
-	if preFn != nil {
-		preFn(w, r)
-	}
-
-	// request
-	FileHandler(w, r)
-
-	// response
-	require.Equal(t, w.Code, http.StatusOK)
-
-	if postFn != nil {
-		postFn(w)
-	}
-}
-
-func HttpFilePostTester(t *testing.T, o Options, tgt string, src string, dst string, preFn func(w *httptest.ResponseRecorder, r *http.Request), postFn func(*httptest.ResponseRecorder)) {
-	var b bytes.Buffer
-	ctype := ""
-
-	if src != "" && dst != "" {
-		if IsExist(filepath.Join(SERVE_FILES_DIR, dst)) {
-			os.Remove(filepath.Join(SERVE_FILES_DIR, dst))
+func TestHttpStoreKeys(t *testing.T) {
+	setKeys := func(w *httptest.ResponseRecorder, r *http.Request) {
+		for _, k := range []string{"TEST_A/1", "TEST_A/2", "TEST_A/3", "TEST_B/1"} {
+			kvsDB.Put([]byte(k), []byte("VAL_"+k))
 		}
+		kvsDB.Put([]byte(STORE_INTERNAL_PREFIX+"TEST"), []byte("INTERNAL"))
+	}
 
-		mpw := multipart.NewWriter(&b)
-		fw, _ := mpw.CreateFormFile("file", dst)
-		f, _ := os.Open(filepath.Join(SERVE_FILES_DIR, src))
-		io.Copy(fw, f)
-		f.Close()
-		mpw.Close()
+	var cursor string
 
-		ctype = mpw.FormDataContentType()
-	}
+	// [GET] store keys with prefix and limit
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=KEYS&prefix=TEST_A/&limit=2", nil),
+		setKeys,
+		func(w *httptest.ResponseRecorder) {
+			var msg StoreKeysMessage
+			err := json.Unmarshal(w.Body.Bytes(), &msg)
 
-	r := httptest.NewRequest(http.MethodPost, tgt, &b)
-	r.Header.Set("Content-Type", ctype)
+			require.NoError(t, err)
+			require.Equal(t, msg.Result, "success")
+			require.Equal(t, msg.Keys, []string{"TEST_A/1", "TEST_A/2"})
+			require.NotEmpty(t, msg.Cursor)
 
-	HttpFileTester(t, o, r, preFn, postFn)
-}
+			cursor = msg.Cursor
+		})
 
-func TestHttpFileApi(t *testing.T) {
-	// [GET] standard get file
-	HttpFileTester(t,
-		Options{UseFileApi: true},
-		httptest.NewRequest(http.MethodGet, "/postman/file/test.txt", nil),
+	// [POST] store scan next page
+	HttpStorePostTester(t,
+		Options{UseStoreApi: true},
+		"/postman/store",
+		`{"cmd":"SCAN","prefix":"TEST_A/","limit":2,"cursor":"`+cursor+`"}`,
 		nil,
 		func(w *httptest.ResponseRecorder) {
-			require.Equal(t, w.Body.String(), "test")
+			var msg StoreScanMessage
+			err := json.Unmarshal(w.Body.Bytes(), &msg)
+
+			require.NoError(t, err)
+			require.Equal(t, len(msg.Items), 1)
+			require.Equal(t, msg.Items[0].Key, "TEST_A/3")
+			require.Equal(t, msg.Items[0].Value, "VAL_TEST_A/3")
+			require.Empty(t, msg.Cursor)
 		})
 
-	// [GET] ip address validation fail
-	HttpFileTester(t,
-		Options{UseFileApi: true, IpAddresses: "192.168.0.1"},
-		httptest.NewRequest(http.MethodGet, "/postman/file/test.txt", nil),
+	// [GET] store keys in range without internal keys
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=keys&start=TEST_A/2&end=TEST_B/1", nil),
 		nil,
 		func(w *httptest.ResponseRecorder) {
-			RequireResponseIsFail(t, w.Body.Bytes(), "remote ip blocked")
+			var msg StoreKeysMessage
+			err := json.Unmarshal(w.Body.Bytes(), &msg)
+
+			require.NoError(t, err)
+			require.Equal(t, msg.Keys, []string{"TEST_A/2", "TEST_A/3"})
 		})
 
-	// [GET] secure mode fail
-	HttpFileTester(t,
-		Options{UseFileApi: true, SecureMode: true},
-		httptest.NewRequest(http.MethodGet, "/postman/file/test.txt?token=TOKEN", nil),
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=keys&end=TEST_A/2", nil),
 		nil,
 		func(w *httptest.ResponseRecorder) {
-			RequireResponseIsFail(t, w.Body.Bytes(), "security error")
+			var msg StoreKeysMessage
+			err := json.Unmarshal(w.Body.Bytes(), &msg)
+
+			require.NoError(t, err)
+			require.NotContains(t, msg.Keys, STORE_INTERNAL_PREFIX+"TEST")
+			require.Contains(t, msg.Keys, "TEST_A/1")
 		})
 
-	// [GET] disable file api
-	HttpFileTester(t,
-		Options{},
-		httptest.NewRequest(http.MethodGet, "/postman/file/test.txt", nil),
-		nil,
+	// [GET] store scan invalid cursor
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=scan&cursor=@@@", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			// cleanup
+			for _, k := range []string{"TEST_A/1", "TEST_A/2", "TEST_A/3", "TEST_B/1", STORE_INTERNAL_PREFIX + "TEST"} {
+				kvsDB.Delete([]byte(k))
+			}
+		},
 		func(w *httptest.ResponseRecorder) {
-			RequireResponseIsFail(t, w.Body.Bytes(), "file server api is disable")
+			RequireResponseIsFail(t, w.Body.Bytes(), "store cursor is invalid")
 		})
+}
 
-	// [GET] not found file serve directory
-	HttpFileTester(t,
-		Options{UseFileApi: true},
-		httptest.NewRequest(http.MethodGet, "/postman/file/test.txt", nil),
+func TestHttpStoreBatch(t *testing.T) {
+	// [POST] store batch
+	HttpStorePostTester(t,
+		Options{UseStoreApi: true},
+		"/postman/store",
+		`{"cmd":"BATCH","ops":[{"cmd":"set","key":"TEST#SCENE","val":"A"},{"cmd":"set","key":"TEST#VERSION","val":"1"},{"cmd":"del","key":"TEST#OLD"}]}`,
 		func(w *httptest.ResponseRecorder, r *http.Request) {
-			os.Rename(SERVE_FILES_DIR, "_"+SERVE_FILES_DIR)
+			kvsDB.Put([]byte("TEST#OLD"), []byte("OLD"))
 		},
 		func(w *httptest.ResponseRecorder) {
-			RequireResponseIsFail(t, w.Body.Bytes(), fmt.Sprintf("directory not found \"%s\"", SERVE_FILES_DIR)) // fail
-			os.Rename("_"+SERVE_FILES_DIR, SERVE_FILES_DIR)
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+
+			v, _ := kvsDB.Get([]byte("TEST#SCENE"))
+			require.Equal(t, string(v), "A")
+			has, _ := kvsDB.Has([]byte("TEST#OLD"))
+			require.False(t, has)
 		})
 
-	// [GET] not found file serve file
-	HttpFileTester(t,
-		Options{UseFileApi: true},
-		httptest.NewRequest(http.MethodGet, "/postman/file/notfound.txt", nil),
+	// [POST] store batch is not applied partially
+	HttpStorePostTester(t,
+		Options{UseStoreApi: true},
+		"/postman/store",
+		`{"cmd":"batch","ops":[{"cmd":"set","key":"TEST#SCENE","val":"B"},{"cmd":"get","key":"TEST#VERSION"}]}`,
 		nil,
 		func(w *httptest.ResponseRecorder) {
-			RequireResponseIsFail(t, w.Body.Bytes(), "file not found \"notfound.txt\"")
+			RequireResponseIsFail(t, w.Body.Bytes(), "store batch command not found [1]")
+
+			v, _ := kvsDB.Get([]byte("TEST#SCENE"))
+			require.Equal(t, string(v), "A")
 		})
 
-	// [GET] index.html access
-	HttpFileTester(t,
-		Options{UseFileApi: true},
-		httptest.NewRequest(http.MethodGet, "/postman/file", nil),
+	// [GET] store cas
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=CAS&key=TEST%23SCENE&old=A&val=C", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			var msg ResultMessage
+			json.Unmarshal(w.Body.Bytes(), &msg)
+
+			require.Equal(t, msg.Result, "true")
+		})
+
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=CAS&key=TEST%23SCENE&old=A&val=D", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			var msg ResultMessage
+			json.Unmarshal(w.Body.Bytes(), &msg)
+
+			require.Equal(t, msg.Result, "false")
+
+			v, _ := kvsDB.Get([]byte("TEST#SCENE"))
+			require.Equal(t, string(v), "C")
+		})
+
+	// [POST] store cas without old value for new key
+	HttpStorePostTester(t,
+		Options{UseStoreApi: true},
+		"/postman/store",
+		`{"cmd":"cas","key":"TEST#SCENE","val":"E"}`,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			var msg ResultMessage
+			json.Unmarshal(w.Body.Bytes(), &msg)
+
+			require.Equal(t, msg.Result, "false")
+		})
+
+	// [GET] store incr and decr
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=INCR&key=TEST%23VERSION&val=10", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			var msg ResultMessage
+			json.Unmarshal(w.Body.Bytes(), &msg)
+
+			require.Equal(t, msg.Result, "11")
+		})
+
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=DECR&key=TEST%23COUNTER", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			var msg ResultMessage
+			json.Unmarshal(w.Body.Bytes(), &msg)
+
+			require.Equal(t, msg.Result, "-1")
+		})
+
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=INCR&key=TEST%23SCENE", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			kvsDB.Put([]byte("TEST#SCENE"), []byte("A"))
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "store value is not integer")
+
+			// cleanup
+			for _, k := range []string{"TEST#SCENE", "TEST#VERSION", "TEST#COUNTER"} {
+				kvsDB.Delete([]byte(k))
+			}
+		})
+}
+
+func TestHttpStoreTtl(t *testing.T) {
+	ttlResult := func(w *httptest.ResponseRecorder) string {
+		var msg ResultMessage
+		json.Unmarshal(w.Body.Bytes(), &msg)
+		return msg.Result
+	}
+
+	// [POST] store set with ttl
+	HttpStorePostTester(t,
+		Options{UseStoreApi: true},
+		"/postman/store",
+		`{"cmd":"SET","key":"TEST#LOCK","val":"1","ttl":60}`,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+		})
+
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=TTL&key=TEST%23LOCK", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, ttlResult(w), "60")
+		})
+
+	// [GET] store expired key is absent before swept
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=HAS&key=TEST%23LOCK", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			kvsDB.Put(storeTtlKey("TEST#LOCK"), []byte("1"))
+		},
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, ttlResult(w), "false")
+
+			v, _ := StoreGet(kvsDB, &StoreMessage{RawKey: "TEST#LOCK"})
+			require.Equal(t, v, "")
+			keys, _, _ := StoreKeys(kvsDB, &StoreMessage{Prefix: "TEST#"})
+			require.NotContains(t, keys, "TEST#LOCK")
+			ttl, _ := StoreTtl(kvsDB, &StoreMessage{RawKey: "TEST#LOCK"})
+			require.Equal(t, ttl, int64(-2))
+
+			// swept
+			require.Equal(t, sweeper.Sweep(), 1)
+			has, _ := kvsDB.Has([]byte("TEST#LOCK"))
+			require.False(t, has)
+			has, _ = kvsDB.Has(storeTtlKey("TEST#LOCK"))
+			require.False(t, has)
+		})
+
+	// [GET] store expire
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=EXPIRE&key=TEST%23FLAG&ttl=30", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			StoreSet(kvsDB, &StoreMessage{RawKey: "TEST#FLAG", RawVal: "1"})
+		},
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, ttlResult(w), "true")
+
+			ttl, _ := StoreTtl(kvsDB, &StoreMessage{RawKey: "TEST#FLAG"})
+			require.Equal(t, ttl, int64(30))
+
+			// set without ttl removes ttl
+			StoreSet(kvsDB, &StoreMessage{RawKey: "TEST#FLAG", RawVal: "2"})
+			ttl, _ = StoreTtl(kvsDB, &StoreMessage{RawKey: "TEST#FLAG"})
+			require.Equal(t, ttl, int64(-1))
+
+			StoreDelete(kvsDB, &StoreMessage{RawKey: "TEST#FLAG"})
+		})
+
+	// [GET] store expire not exist key
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=EXPIRE&key=TEST%23NONE&ttl=30", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, ttlResult(w), "false")
+		})
+}
+
+type storeLockProbe struct {
+	fn func()
+	n  atomic.Int32
+}
+
+func (p *storeLockProbe) Info() string       { return "TEST_PROBE" }
+func (p *storeLockProbe) RemoteAddr() string { return "127.0.0.1:0" }
+func (p *storeLockProbe) Send(ch string, pmsg *PublishSendMessage) bool {
+	p.fn()
+	p.n.Add(1)
+	return true
+}
+
+func TestHttpStoreNotify(t *testing.T) {
+	var c1, c2 *websocket.Conn
+
+	// [GET] store set publishes to the key and the parent channels
+	HttpStoreTester(t,
+		Options{UseStoreApi: true, StoreNotify: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=SET&key=TEST%23CONF/color&val=red", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			s := StartMockServer(t)
+			c1 = RequireConnectAndSubscribe(t, s.URL, "$store/TEST#CONF/color", "TEST_CLI_1")
+			c2 = RequireConnectAndSubscribe(t, s.URL, "$store/TEST#CONF/**", "TEST_CLI_2")
+			time.Sleep(100 * time.Millisecond) // wait
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+
+			for _, c := range []*websocket.Conn{c1, c2} {
+				c.SetReadDeadline(time.Now().Add(1 * time.Second))
+				_, rcv, err := c.ReadMessage()
+
+				require.NoError(t, err)
+
+				var msg PublishMessage
+				json.Unmarshal(rcv[8:], &msg)
+				require.Equal(t, msg.Message(), "red")
+				require.Equal(t, msg.Tag(), "set")
+				require.Equal(t, msg.Extention(), "TEST#CONF/color")
+			}
+
+			// delete
+			StoreDelete(kvsDB, &StoreMessage{RawKey: "TEST#CONF/color"})
+
+			c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+			_, rcv, err := c1.ReadMessage()
+
+			require.NoError(t, err)
+			require.Contains(t, string(rcv), `"tag":"del"`)
+		})
+
+	// [GET] store set publishes out of the write lock
+	var locked atomic.Bool
+	probe := &storeLockProbe{fn: func() {
+		if storeMu.TryLock() {
+			storeMu.Unlock()
+		} else {
+			locked.Store(true)
+		}
+	}}
+	HttpStoreTester(t,
+		Options{UseStoreApi: true, StoreNotify: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=SET&key=TEST%23CONF/color&val=green", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			broker.Attach("$store/TEST#CONF/color", probe)
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+
+			require.Equal(t, probe.n.Load(), int32(1))
+			require.False(t, locked.Load())
+
+			broker.Detach("$store/TEST#CONF/color", probe)
+			StoreDelete(kvsDB, &StoreMessage{RawKey: "TEST#CONF/color"})
+		})
+
+	// [GET] store set does not publish without option
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=SET&key=TEST%23CONF/color&val=blue", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			s := StartMockServer(t)
+			c1 = RequireConnectAndSubscribe(t, s.URL, "$store/TEST#CONF/color", "TEST_CLI_1")
+			time.Sleep(100 * time.Millisecond) // wait
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+
+			c1.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, _, err := c1.ReadMessage()
+
+			require.Error(t, err)
+
+			StoreDelete(kvsDB, &StoreMessage{RawKey: "TEST#CONF/color"})
+		})
+}
+
+func TestHttpStoreNamespace(t *testing.T) {
+	result := func(w *httptest.ResponseRecorder) string {
+		var msg ResultMessage
+		json.Unmarshal(w.Body.Bytes(), &msg)
+		return msg.Result
+	}
+
+	// [GET] store same key in namespaces
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=GET&key=volume&ns=TEST_NS_A", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "volume", RawVal: "1"})
+			StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_B", RawKey: "volume", RawVal: "2"})
+		},
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, result(w), "1")
+
+			v, _ := StoreGet(kvsDB, &StoreMessage{Ns: "TEST_NS_B", RawKey: "volume"})
+			require.Equal(t, v, "2")
+			has, _ := StoreHas(kvsDB, &StoreMessage{RawKey: "volume"})
+			require.False(t, has)
+
+			// keys in the namespace
+			keys, _, _ := StoreKeys(kvsDB, &StoreMessage{Ns: "TEST_NS_A"})
+			require.Equal(t, keys, []string{"volume"})
+			keys, _, _ = StoreKeys(kvsDB, &StoreMessage{})
+			require.NotContains(t, keys, "volume")
+		})
+
+	// [GET] store drop namespace
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=DROP&ns=TEST_NS_A", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, result(w), "1")
+
+			has, _ := StoreHas(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "volume"})
+			require.False(t, has)
+			has, _ = StoreHas(kvsDB, &StoreMessage{Ns: "TEST_NS_B", RawKey: "volume"})
+			require.True(t, has)
+
+			StoreDrop(kvsDB, &StoreMessage{Ns: "TEST_NS_B"})
+		})
+
+	// [GET] store quota
+	HttpStoreTester(t,
+		Options{UseStoreApi: true, StoreNsKeys: 2, StoreNsBytes: 16},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=SET&key=c&val=3&ns=TEST_NS_A", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "a", RawVal: "1"})
+			StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "b", RawVal: "2"})
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "store namespace key quota exceeded [TEST_NS_A]")
+
+			// overwrite is not counted
+			err := StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "b", RawVal: "22"})
+			require.NoError(t, err)
+
+			err = StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "b", RawVal: "2222222222222222"})
+			require.EqualError(t, err, "store namespace size quota exceeded [TEST_NS_A]")
+
+			// deleted and expired keys are not counted
+			StoreDelete(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "a"})
+			err = StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "c", RawVal: "3", Ttl: 1})
+			require.NoError(t, err)
+			kvsDB.Put(storeTtlKey(storeNsKey("TEST_NS_A", "c")), []byte("0"))
+			require.Equal(t, sweeper.Sweep(), 1)
+			err = StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "d", RawVal: "4"})
+			require.NoError(t, err)
+
+			// usage is kept by the writes
+			n, size := StoreUsage(kvsDB, "TEST_NS_A")
+			require.Equal(t, *storeUsages["TEST_NS_A"], storeUsage{keys: n, size: size})
+
+			// default namespace is not limited
+			err = StoreSet(kvsDB, &StoreMessage{RawKey: "TEST#QUOTA", RawVal: "1"})
+			require.NoError(t, err)
+
+			StoreDelete(kvsDB, &StoreMessage{RawKey: "TEST#QUOTA"})
+			StoreDrop(kvsDB, &StoreMessage{Ns: "TEST_NS_A"})
+			require.NotContains(t, storeUsages, "TEST_NS_A")
+		})
+
+	// [GET] store namespace forced by token
+	HttpStoreTester(t,
+		Options{UseStoreApi: true, SecureMode: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=SET&key=volume&val=3&ns=TEST_NS_B", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			secret = "SECRET"
+			tkn, _ := GenerateNamespaceToken(secret, host, "TEST_NS_A")
+			r.URL.RawQuery += "&tkn=" + tkn
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+
+			v, _ := StoreGet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "volume"})
+			require.Equal(t, v, "3")
+			has, _ := StoreHas(kvsDB, &StoreMessage{Ns: "TEST_NS_B", RawKey: "volume"})
+			require.False(t, has)
+
+			StoreDrop(kvsDB, &StoreMessage{Ns: "TEST_NS_A"})
+		})
+
+	// [GET] store invalid namespace
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=GET&key=volume&ns=TEST/NS", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "store namespace is invalid")
+		})
+
+	// [GET] store internal key of other namespace
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=GET&key=%00ns/TEST_NS_B/volume", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_B", RawKey: "volume", RawVal: "2"})
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "store key is invalid")
+
+			StoreDrop(kvsDB, &StoreMessage{Ns: "TEST_NS_B"})
+		})
+
+	// [GET] store internal key of schedules
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=SET&key=%00schedule/TEST&val={}", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "store key is invalid")
+
+			has, _ := kvsDB.Has([]byte(SCHEDULE_PREFIX + "TEST"))
+			require.False(t, has)
+		})
+
+	// [POST] store internal key in batch
+	HttpStorePostTester(t,
+		Options{UseStoreApi: true},
+		"/postman/store",
+		`{"cmd":"BATCH","ops":[{"cmd":"set","key":"TEST#SCENE","val":"A"},{"cmd":"del","key":"\u0000ttl/TEST#SCENE"}]}`,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "store key is invalid [1]")
+
+			has, _ := kvsDB.Has([]byte("TEST#SCENE"))
+			require.False(t, has)
+		})
+}
+
+func TestHttpStoreJson(t *testing.T) {
+	request := func(cmd string, path string, val string) *http.Request {
+		q := url.Values{"cmd": {cmd}, "key": {"TEST#DOC"}, "path": {path}, "val": {val}}
+		return httptest.NewRequest(http.MethodGet, "/postman/store?"+q.Encode(), nil)
+	}
+	value := func(w *httptest.ResponseRecorder) string {
+		var msg StoreJsonMessage
+		err := json.Unmarshal(w.Body.Bytes(), &msg)
+
+		require.NoError(t, err)
+		require.Equal(t, msg.Result, "success", w.Body.String())
+		return string(msg.Value)
+	}
+
+	// [GET] store jset creates objects on the way
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		request("JSET", "/scene/light", `{"on":true,"level":0.5}`),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			StoreSet(kvsDB, &StoreMessage{RawKey: "TEST#DOC", RawVal: `{"name":"kiosk","tags":["a"]}`, Ttl: 60})
+		},
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, value(w), `{"name":"kiosk","scene":{"light":{"level":0.5,"on":true}},"tags":["a"]}`)
+
+			// TTL is kept
+			ttl, _ := StoreTtl(kvsDB, &StoreMessage{RawKey: "TEST#DOC"})
+			require.Greater(t, ttl, int64(0))
+		})
+
+	// [GET] store jget sub-path as json
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		request("JGET", "/scene/light/level", ""),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, w.Body.String(), `{"result":"success","error":"","value":0.5}`)
+		})
+
+	// [GET] store jmerge
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		request("JMERGE", "/scene", `{"light":{"on":null},"sound":{"volume":3}}`),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, value(w), `{"name":"kiosk","scene":{"light":{"level":0.5},"sound":{"volume":3}},"tags":["a"]}`)
+		})
+
+	// [GET] store jappend to existing and new arrays
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		request("JAPPEND", "/tags", `"b"`),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			_, err := StoreJsonAppend(kvsDB, &StoreMessage{RawKey: "TEST#DOC", Path: "/log", RawVal: `{"at":1}`})
+			require.NoError(t, err)
+		},
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, value(w), `{"log":[{"at":1}],"name":"kiosk","scene":{"light":{"level":0.5},"sound":{"volume":3}},"tags":["a","b"]}`)
+
+			// json pointer escape and array index
+			v, _ := StoreJsonSet(kvsDB, &StoreMessage{RawKey: "TEST#DOC", Path: "/a~1b", RawVal: `[1]`})
+			require.Contains(t, string(v), `"a/b":[1]`)
+			v, _ = StoreJsonSet(kvsDB, &StoreMessage{RawKey: "TEST#DOC", Path: "/a~1b/-", RawVal: `2`})
+			require.Contains(t, string(v), `"a/b":[1,2]`)
+			v, _ = StoreJsonGet(kvsDB, &StoreMessage{RawKey: "TEST#DOC", Path: "/a~1b/1"})
+			require.Equal(t, string(v), `2`)
+		})
+
+	// [GET] store json errors
+	var tests = []struct {
+		cmd    string
+		path   string
+		val    string
+		expect string
+	}{
+		{"JGET", "/none", "", "store json path not found"},
+		{"JGET", "tags", "", "store json path is invalid"},
+		{"JGET", "/tags/01", "", "store json path not found"},
+		{"JSET", "/name", "kiosk", "store value is not json"},
+		{"JSET", "/name/first", `"a"`, "store json path not found"},
+		{"JSET", "/tags/5", `"a"`, "store json path not found"},
+		{"JAPPEND", "/name", `"a"`, "store json value is not array"},
+	}
+
+	for _, tt := range tests {
+		HttpStoreTester(t,
+			Options{UseStoreApi: true},
+			request(tt.cmd, tt.path, tt.val),
+			nil,
+			func(w *httptest.ResponseRecorder) {
+				RequireResponseIsFail(t, w.Body.Bytes(), tt.expect)
+			})
+	}
+
+	// [GET] store json of not json value and missing key
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		request("JSET", "/a", "1"),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			StoreSet(kvsDB, &StoreMessage{RawKey: "TEST#DOC", RawVal: "TEXT"})
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "store value is not json")
+
+			StoreDelete(kvsDB, &StoreMessage{RawKey: "TEST#DOC"})
+			_, err := StoreJsonGet(kvsDB, &StoreMessage{RawKey: "TEST#DOC"})
+			require.EqualError(t, err, "store key not found")
+		})
+}
+
+func TestHttpStoreBackend(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, backend := range []string{KVS_BOLT, KVS_MEMORY} {
+		// [GET] store set and get in the backend at the path
+		HttpStoreTester(t,
+			Options{UseStoreApi: true, StoreBackend: backend, StoreDB: filepath.Join(dir, "test_"+backend+".db")},
+			httptest.NewRequest(http.MethodGet, "/postman/store?cmd=GET&key=TEST#SCENE", nil),
+			func(w *httptest.ResponseRecorder, r *http.Request) {
+				require.NoError(t, StoreSet(kvsDB, &StoreMessage{RawKey: "TEST#SCENE", RawVal: "A", Ttl: 60}))
+			},
+			func(w *httptest.ResponseRecorder) {
+				var msg ResultMessage
+				json.Unmarshal(w.Body.Bytes(), &msg)
+
+				require.Equal(t, msg.Result, "A")
+
+				ttl, _ := StoreTtl(kvsDB, &StoreMessage{RawKey: "TEST#SCENE"})
+				require.Greater(t, ttl, int64(0))
+				keys, _, _ := StoreKeys(kvsDB, &StoreMessage{})
+				require.Equal(t, keys, []string{"TEST#SCENE"})
+			})
+	}
+
+	require.FileExists(t, filepath.Join(dir, "test_bolt.db"))
+	require.NoFileExists(t, filepath.Join(dir, "test_memory.db"))
+
+	// backend not found
+	SetOptions(Options{UseStoreApi: true, StoreBackend: "none"})
+	Prepare()
+
+	require.Nil(t, kvsDB)
+}
+
+func TestHttpStoreBackup(t *testing.T) {
+	dir := t.TempDir()
+	result := func(w *httptest.ResponseRecorder) string {
+		var msg ResultMessage
+		json.Unmarshal(w.Body.Bytes(), &msg)
+		return msg.Result
+	}
+
+	// [GET] store export in namespace
+	var exported string
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=EXPORT&ns=TEST_NS_A", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "a", RawVal: "1"})
+			StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "b", RawVal: "2", Ttl: 60})
+			StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "c", RawVal: "\xff"})
+		},
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, w.Header().Get("Content-Type"), "application/x-ndjson")
+
+			lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+			require.Equal(t, len(lines), 3)
+			require.JSONEq(t, lines[0], `{"key":"a","value":"1"}`)
+			require.JSONEq(t, lines[1], `{"key":"b","value":"2","ttl":60}`)
+			require.Contains(t, lines[2], `"encoding":"base64"`)
+
+			exported = w.Body.String()
+			StoreDrop(kvsDB, &StoreMessage{Ns: "TEST_NS_A"})
+		})
+
+	// [POST] store import into other namespace
+	r := httptest.NewRequest(http.MethodPost, "/postman/store?cmd=IMPORT&ns=TEST_NS_B", strings.NewReader(exported))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		r,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, result(w), "3")
+
+			v, _ := StoreGet(kvsDB, &StoreMessage{Ns: "TEST_NS_B", RawKey: "c"})
+			require.Equal(t, v, "\xff")
+			ttl, _ := StoreTtl(kvsDB, &StoreMessage{Ns: "TEST_NS_B", RawKey: "b"})
+			require.Equal(t, ttl, int64(60))
+
+			StoreDrop(kvsDB, &StoreMessage{Ns: "TEST_NS_B"})
+		})
+
+	// [POST] store import invalid line
+	r = httptest.NewRequest(http.MethodPost, "/postman/store?cmd=IMPORT", strings.NewReader("{\"key\":\"TEST#IMPORT\",\"value\":\"1\"}\n@@@\n"))
+	HttpStoreTester(t,
+		Options{UseStoreApi: true},
+		r,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "store import record is invalid [2]")
+
+			has, _ := StoreHas(kvsDB, &StoreMessage{RawKey: "TEST#IMPORT"})
+			require.False(t, has)
+		})
+
+	// [POST] store import over the request bytes
+	r = httptest.NewRequest(http.MethodPost, "/postman/store?cmd=IMPORT", strings.NewReader("{\"key\":\"TEST#IMPORT\",\"value\":\"1\"}\n"))
+	HttpStoreTester(t,
+		Options{UseStoreApi: true, StoreImBytes: 10},
+		r,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "store import is too large")
+
+			has, _ := StoreHas(kvsDB, &StoreMessage{RawKey: "TEST#IMPORT"})
+			require.False(t, has)
+		})
+
+	// [POST] store import over the records
+	r = httptest.NewRequest(http.MethodPost, "/postman/store?cmd=IMPORT", strings.NewReader("{\"key\":\"TEST#IMPORT\",\"value\":\"1\"}\n{\"key\":\"TEST#IMPORT_2\",\"value\":\"2\"}\n"))
+	HttpStoreTester(t,
+		Options{UseStoreApi: true, StoreImRecs: 1},
+		r,
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "store import has too many records")
+
+			has, _ := StoreHas(kvsDB, &StoreMessage{RawKey: "TEST#IMPORT"})
+			require.False(t, has)
+		})
+
+	// [GET] store backup and restore
+	var name string
+	HttpStoreTester(t,
+		Options{UseStoreApi: true, StoreBkDir: dir, StoreBkKeep: 2},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=BACKUP", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			StoreSet(kvsDB, &StoreMessage{RawKey: "TEST#BACKUP", RawVal: "1"})
+			scheds.Add(&ScheduledMessage{Id: "TEST_BEFORE", Channel: "TEST_CH", Next: time.Now().Add(time.Hour)})
+		},
+		func(w *httptest.ResponseRecorder) {
+			name = result(w)
+			require.FileExists(t, filepath.Join(dir, name))
+
+			// snapshot has the same records
+			b, _ := os.ReadFile(filepath.Join(dir, name))
+			sw := httptest.NewRecorder()
+			StoreHandler(sw, httptest.NewRequest(http.MethodGet, "/postman/store?cmd=SNAPSHOT", nil))
+			require.Equal(t, sw.Body.String(), string(b))
+
+			StoreSet(kvsDB, &StoreMessage{RawKey: "TEST#BACKUP", RawVal: "2"})
+			StoreSet(kvsDB, &StoreMessage{RawKey: "TEST#AFTER", RawVal: "1"})
+			scheds.Cancel("TEST_BEFORE")
+			scheds.Add(&ScheduledMessage{Id: "TEST_AFTER", Channel: "TEST_CH", Next: time.Now().Add(time.Hour)})
+		})
+
+	HttpStoreTester(t,
+		Options{UseStoreApi: true, StoreBkDir: dir, StoreBkKeep: 2},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=RESTORE&name="+url.QueryEscape(name), nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			require.NotEqual(t, result(w), "fail")
+
+			v, _ := StoreGet(kvsDB, &StoreMessage{RawKey: "TEST#BACKUP"})
+			require.Equal(t, v, "1")
+			has, _ := StoreHas(kvsDB, &StoreMessage{RawKey: "TEST#AFTER"})
+			require.False(t, has)
+
+			// schedules are reloaded from the backup
+			list := scheds.List()
+			require.Equal(t, len(list), 1)
+			require.Equal(t, list[0].Id, "TEST_BEFORE")
+
+			scheds.Cancel("TEST_BEFORE")
+			StoreDelete(kvsDB, &StoreMessage{RawKey: "TEST#BACKUP"})
+
+			// retention
+			for i := 0; i < 3; i++ {
+				_, err := StoreBackup(kvsDB, dir, 2)
+				require.NoError(t, err)
+				time.Sleep(10 * time.Millisecond)
+			}
+			names, _ := StoreBackups(dir)
+			require.Equal(t, len(names), 2)
+			require.NotContains(t, names, name)
+		})
+
+	// [GET] store restore outside of the backup directory
+	HttpStoreTester(t,
+		Options{UseStoreApi: true, StoreBkDir: dir},
+		httptest.NewRequest(http.MethodGet, "/postman/store?cmd=RESTORE&name=../TEST.jsonl", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "store backup name is invalid")
+		})
+}
+
+//
+// File
+//
+
+func HttpFileTester(t *testing.T, o Options, r *http.Request, preFn func(w *httptest.ResponseRecorder, r *http.Request), postFn func(*httptest.ResponseRecorder)) {
+	SetOptions(o)
+	Prepare()
+
+	w := httptest.NewRecorder()
+	if preFn != nil {
+		preFn(w, r)
+	}
+
+	// request
+	FileHandler(w, r)
+
+	// response
+	require.Equal(t, w.Code, http.StatusOK)
+
+	if postFn != nil {
+		postFn(w)
+	}
+}
+
+func HttpFilePostTester(t *testing.T, o Options, tgt string, src string, dst string, preFn func(w *httptest.ResponseRecorder, r *http.Request), postFn func(*httptest.ResponseRecorder)) {
+	var b bytes.Buffer
+	ctype := ""
+
+	if src != "" && dst != "" {
+		if IsExist(filepath.Join(SERVE_FILES_DIR, dst)) {
+			os.Remove(filepath.Join(SERVE_FILES_DIR, dst))
+		}
+
+		mpw := multipart.NewWriter(&b)
+		fw, _ := mpw.CreateFormFile("file", dst)
+		f, _ := os.Open(filepath.Join(SERVE_FILES_DIR, src))
+		io.Copy(fw, f)
+		f.Close()
+		mpw.Close()
+
+		ctype = mpw.FormDataContentType()
+	}
+
+	r := httptest.NewRequest(http.MethodPost, tgt, &b)
+	r.Header.Set("Content-Type", ctype)
+
+	HttpFileTester(t, o, r, preFn, postFn)
+}
+
+func TestHttpFileApi(t *testing.T) {
+	// [GET] standard get file
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/file/test.txt", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			require.Equal(t, w.Body.String(), "test")
+		})
+
+	// [GET] ip address validation fail
+	HttpFileTester(t,
+		Options{UseFileApi: true, IpAddresses: "192.168.0.1"},
+		httptest.NewRequest(http.MethodGet, "/postman/file/test.txt", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "remote ip blocked")
+		})
+
+	// [GET] secure mode fail
+	HttpFileTester(t,
+		Options{UseFileApi: true, SecureMode: true},
+		httptest.NewRequest(http.MethodGet, "/postman/file/test.txt?token=TOKEN", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "security error")
+		})
+
+	// [GET] disable file api
+	HttpFileTester(t,
+		Options{},
+		httptest.NewRequest(http.MethodGet, "/postman/file/test.txt", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "file server api is disable")
+		})
+
+	// [GET] not found file serve directory
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/file/test.txt", nil),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			os.Rename(SERVE_FILES_DIR, "_"+SERVE_FILES_DIR)
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), fmt.Sprintf("directory not found \"%s\"", SERVE_FILES_DIR)) // fail
+			os.Rename("_"+SERVE_FILES_DIR, SERVE_FILES_DIR)
+		})
+
+	// [GET] not found file serve file
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/file/notfound.txt", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "file not found \"notfound.txt\"")
+		})
+
+	// [GET] index.html access
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		httptest.NewRequest(http.MethodGet, "/postman/file", nil),
 		nil,
 		func(w *httptest.ResponseRecorder) {
 			require.Contains(t, w.Body.String(), "<!DOCTYPE html>") // index.html
@@ -615,12 +1701,210 @@ func TestHttpFileApi(t *testing.T) {
 		})
 }
 
+func TestHttpFileManage(t *testing.T) {
+	t.Cleanup(func() {
+		os.RemoveAll(filepath.Join(SERVE_FILES_DIR, "test_dir"))
+		os.RemoveAll(filepath.Join(SERVE_FILES_DIR, "test_moved"))
+	})
+
+	request := func(cmd string, path string, to string) *http.Request {
+		q := url.Values{"cmd": {cmd}, "path": {path}, "to": {to}}
+		if FileNeedsPost(cmd) {
+			return httptest.NewRequest(http.MethodPost, "/postman/file?"+q.Encode(), nil)
+		}
+		return httptest.NewRequest(http.MethodGet, "/postman/file?"+q.Encode(), nil)
+	}
+
+	// [GET] changes are not accepted by GET
+	for _, cmd := range []string{"MKDIR", "DEL", "MOVE"} {
+		HttpFileTester(t,
+			Options{UseFileApi: true},
+			httptest.NewRequest(http.MethodGet, "/postman/file?cmd="+cmd+"&path=test_dir&to=test_moved", nil),
+			nil,
+			func(w *httptest.ResponseRecorder) {
+				RequireResponseIsFail(t, w.Body.Bytes(), "file command needs POST")
+				require.NoDirExists(t, filepath.Join(SERVE_FILES_DIR, "test_dir"))
+			})
+	}
+
+	// [POST] mkdir
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		request("MKDIR", "test_dir/sub", ""),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+			require.DirExists(t, filepath.Join(SERVE_FILES_DIR, "test_dir", "sub"))
+		})
+
+	// [POST] post file into the sub directory
+	HttpFilePostTester(t,
+		Options{UseFileApi: true},
+		"/postman/file?path=test_dir",
+		"test.txt",
+		"test_dir/test.txt",
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+			require.FileExists(t, filepath.Join(SERVE_FILES_DIR, "test_dir", "test.txt"))
+		})
+
+	// [GET] list directory
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		request("LIST", "test_dir", ""),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			r.URL.RawQuery += "&hash=1"
+		},
+		func(w *httptest.ResponseRecorder) {
+			var msg FileListMessage
+			err := json.Unmarshal(w.Body.Bytes(), &msg)
+
+			require.NoError(t, err)
+			require.Equal(t, msg.Result, "success")
+			require.Equal(t, len(msg.Files), 2)
+			require.Equal(t, msg.Files[0].Name, "sub")
+			require.True(t, msg.Files[0].Dir)
+			require.Equal(t, msg.Files[1].Path, "test_dir/test.txt")
+			require.Equal(t, msg.Files[1].Size, int64(4))
+			require.Equal(t, msg.Files[1].Hash, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08") // sha256 of "test"
+			require.Contains(t, msg.Files[1].Type, "text/plain")
+			require.False(t, msg.Files[1].Mtime.IsZero())
+		})
+
+	// [GET] stat
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		request("STAT", "/test_dir/test.txt", ""),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			var msg FileStatMessage
+			err := json.Unmarshal(w.Body.Bytes(), &msg)
+
+			require.NoError(t, err)
+			require.Equal(t, msg.Result, "success")
+			require.Equal(t, msg.File.Name, "test.txt")
+			require.Equal(t, msg.File.Size, int64(4))
+			require.Empty(t, msg.File.Hash) // only with hash=1
+		})
+
+	// [HEAD] metadata in headers
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		httptest.NewRequest(http.MethodHead, "/postman/file/test_dir/test.txt?hash=1", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			require.Empty(t, w.Body.String())
+			require.Equal(t, w.Header().Get("Content-Length"), "4")
+			require.Equal(t, w.Header().Get("ETag"), `"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"`)
+			require.Equal(t, w.Header().Get("X-Content-Sha256"), "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08")
+			require.NotEmpty(t, w.Header().Get("Last-Modified"))
+		})
+
+	// [HEAD] no hash without hash=1
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		httptest.NewRequest(http.MethodHead, "/postman/file/test_dir/test.txt", nil),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			require.Empty(t, w.Body.String())
+			require.Equal(t, w.Header().Get("Content-Length"), "4")
+			require.Empty(t, w.Header().Get("ETag"))
+			require.Empty(t, w.Header().Get("X-Content-Sha256"))
+		})
+
+	// [POST] move
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		request("MOVE", "test_dir/test.txt", "test_dir/sub/moved.txt"),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+			require.NoFileExists(t, filepath.Join(SERVE_FILES_DIR, "test_dir", "test.txt"))
+			require.FileExists(t, filepath.Join(SERVE_FILES_DIR, "test_dir", "sub", "moved.txt"))
+		})
+
+	// [POST] delete file and directory, and not empty directory is not deleted
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		request("DEL", "test_dir/sub", ""),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "could not delete \"test_dir/sub\"")
+		})
+
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		request("DEL", "test_dir/sub/moved.txt", ""),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsSuccess(t, w.Body.Bytes())
+
+			msg := FileCommand(&FileMessage{RawCmd: "DEL", Path: "test_dir/sub"}, "")
+			require.Equal(t, msg.(*ResultMessage).Result, "success")
+			require.NoDirExists(t, filepath.Join(SERVE_FILES_DIR, "test_dir", "sub"))
+		})
+
+	// [GET] confined to the directory
+	var tests = []struct {
+		cmd  string
+		path string
+		to   string
+	}{
+		{"LIST", "..", ""},
+		{"STAT", "../postman.db", ""},
+		{"MKDIR", "test_dir/../../test_escape", ""},
+		{"DEL", "", ""},
+		{"MOVE", "test_dir", "../test_moved"},
+		{"MOVE", "", "test_moved"},
+	}
+
+	for _, tt := range tests {
+		HttpFileTester(t,
+			Options{UseFileApi: true},
+			request(tt.cmd, tt.path, tt.to),
+			nil,
+			func(w *httptest.ResponseRecorder) {
+				RequireResponseIsFail(t, w.Body.Bytes(), "file path is invalid")
+			})
+	}
+	require.NoDirExists(t, "test_escape")
+
+	// [GET] symbolic link out of the directory
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		request("LIST", "test_dir/link", ""),
+		func(w *httptest.ResponseRecorder, r *http.Request) {
+			os.Symlink(t.TempDir(), filepath.Join(SERVE_FILES_DIR, "test_dir", "link"))
+		},
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "file path is invalid")
+		})
+
+	// [GET] errors
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		request("MOVE", "test_dir/none.txt", "test_moved"),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "file not found \"test_dir/none.txt\"")
+		})
+
+	HttpFileTester(t,
+		Options{UseFileApi: true},
+		request("NONE", "", ""),
+		nil,
+		func(w *httptest.ResponseRecorder) {
+			RequireResponseIsFail(t, w.Body.Bytes(), "file command not found")
+		})
+}
+
 //
 // Plugin
 //
 
 func HttpPluginTester(t *testing.T, o Options, r *http.Request, preFn func(w *httptest.ResponseRecorder, r *http.Request), postFn func(*httptest.ResponseRecorder)) {
-	opts = o
+	SetOptions(o)
 	Prepare()
 
 	w := httptest.NewRecorder()
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+const (
+	KVS_LEVELDB = "leveldb"
+	KVS_BOLT    = "bolt"
+	KVS_MEMORY  = "memory"
+)
+
+var ErrKvsNotFound = errors.New("kvs: not found")
+
+// Kvs is the sorted key-value backend of the store.
+type Kvs interface {
+	KvsReader
+
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	// Write applies all operations of the batch atomically.
+	Write(batch *KvsBatch) error
+
+	// Snapshot is a consistent read-only view of the db at the time.
+	Snapshot() (KvsSnapshot, error)
+	Close() error
+}
+
+type KvsReader interface {
+	// Get returns ErrKvsNotFound when the key does not exist.
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	// NewIterator iterates keys in the range in ascending order, and nil range is all keys.
+	NewIterator(rng *KvsRange) KvsIterator
+}
+
+type KvsSnapshot interface {
+	KvsReader
+	Release()
+}
+
+// KvsIterator must be released after use.
+// Key and Value are valid until the next call of Next.
+type KvsIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+// KvsRange is the keys from start (inclusive) to limit (exclusive), and nil is unbounded.
+type KvsRange struct {
+	Start []byte
+	Limit []byte
+}
+
+// KvsPrefix is the range of keys which have the prefix.
+func KvsPrefix(prefix []byte) *KvsRange {
+	var limit []byte
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if c := prefix[i]; c < 0xff {
+			limit = make([]byte, i+1)
+			copy(limit, prefix)
+			limit[i] = c + 1
+			break
+		}
+	}
+	return &KvsRange{Start: append([]byte{}, prefix...), Limit: limit}
+}
+
+func (rng *KvsRange) Contains(key []byte) bool {
+	if rng == nil {
+		return true
+	}
+	return bytes.Compare(key, rng.Start) >= 0 && (rng.Limit == nil || bytes.Compare(key, rng.Limit) < 0)
+}
+
+// KvsBatch is the set and delete operations written by Kvs.Write.
+type KvsBatch struct {
+	ops []kvsOp
+}
+
+type kvsOp struct {
+	key   []byte
+	value []byte // nil is delete
+}
+
+func (b *KvsBatch) Put(key []byte, value []byte) {
+	b.ops = append(b.ops, kvsOp{key: append([]byte{}, key...), value: append([]byte{}, value...)})
+}
+
+func (b *KvsBatch) Delete(key []byte) {
+	b.ops = append(b.ops, kvsOp{key: append([]byte{}, key...)})
+}
+
+func (b *KvsBatch) Len() int {
+	return len(b.ops)
+}
+
+// OpenKvs opens the backend (leveldb, bolt or memory) at the path.
+func OpenKvs(backend string, path string) (Kvs, error) {
+	var db Kvs
+	var err error
+	switch strings.ToLower(backend) {
+	case "", KVS_LEVELDB:
+		db, err = OpenLevelKvs(path)
+	case KVS_BOLT:
+		db, err = OpenBoltKvs(path)
+	case KVS_MEMORY:
+		db = NewMemoryKvs()
+	default:
+		err = errors.New("kvs backend not found [" + backend + "]")
+	}
+
+	// not a typed nil in the interface
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	BOLT_BUCKET      = "postman"
+	BOLT_TIMEOUT_SEC = 1
+	BOLT_MMAP_SIZE   = 64 * 1024 * 1024 // read transactions do not block writes until the db grows over it
+)
+
+// BoltKvs is the bbolt backend, a single file db.
+type BoltKvs struct {
+	db *bolt.DB
+}
+
+func OpenBoltKvs(path string) (*BoltKvs, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: BOLT_TIMEOUT_SEC * time.Second, InitialMmapSize: BOLT_MMAP_SIZE})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BOLT_BUCKET))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltKvs{db: db}, nil
+}
+
+func (b *BoltKvs) Get(key []byte) ([]byte, error) {
+	var v []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v = boltGet(tx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrKvsNotFound
+	}
+	return v, nil
+}
+
+func (b *BoltKvs) Has(key []byte) (bool, error) {
+	_, err := b.Get(key)
+	if err == ErrKvsNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NewIterator keeps a read transaction until released.
+func (b *BoltKvs) NewIterator(rng *KvsRange) KvsIterator {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return &boltIterator{err: err}
+	}
+	return newBoltIterator(tx, rng, true)
+}
+
+func (b *BoltKvs) Put(key []byte, value []byte) error {
+	batch := new(KvsBatch)
+	batch.Put(key, value)
+	return b.Write(batch)
+}
+
+func (b *BoltKvs) Delete(key []byte) error {
+	batch := new(KvsBatch)
+	batch.Delete(key)
+	return b.Write(batch)
+}
+
+func (b *BoltKvs) Write(batch *KvsBatch) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(BOLT_BUCKET))
+		for _, op := range batch.ops {
+			var err error
+			if op.value == nil {
+				err = bkt.Delete(op.key)
+			} else {
+				err = bkt.Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Snapshot is a read transaction, and writes may wait for the release when the db is larger than BOLT_MMAP_SIZE.
+func (b *BoltKvs) Snapshot() (KvsSnapshot, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &boltSnapshot{tx: tx}, nil
+}
+
+func (b *BoltKvs) Close() error {
+	return b.db.Close()
+}
+
+type boltSnapshot struct {
+	tx *bolt.Tx
+}
+
+func (s *boltSnapshot) Get(key []byte) ([]byte, error) {
+	v := boltGet(s.tx, key)
+	if v == nil {
+		return nil, ErrKvsNotFound
+	}
+	return v, nil
+}
+
+func (s *boltSnapshot) Has(key []byte) (bool, error) {
+	return boltGet(s.tx, key) != nil, nil
+}
+
+func (s *boltSnapshot) NewIterator(rng *KvsRange) KvsIterator {
+	return newBoltIterator(s.tx, rng, false)
+}
+
+func (s *boltSnapshot) Release() {
+	s.tx.Rollback()
+}
+
+type boltIterator struct {
+	tx      *bolt.Tx
+	cursor  *bolt.Cursor
+	rng     *KvsRange
+	ownTx   bool // the transaction is closed when released
+	started bool
+	key     []byte
+	value   []byte
+	err     error
+}
+
+func newBoltIterator(tx *bolt.Tx, rng *KvsRange, ownTx bool) *boltIterator {
+	return &boltIterator{
+		tx:     tx,
+		cursor: tx.Bucket([]byte(BOLT_BUCKET)).Cursor(),
+		rng:    rng,
+		ownTx:  ownTx,
+	}
+}
+
+func (it *boltIterator) Next() bool {
+	if it.err != nil || it.cursor == nil {
+		return false
+	}
+
+	var k, v []byte
+	if !it.started {
+		it.started = true
+		if it.rng != nil && len(it.rng.Start) > 0 {
+			k, v = it.cursor.Seek(it.rng.Start)
+		} else {
+			k, v = it.cursor.First()
+		}
+	} else {
+		k, v = it.cursor.Next()
+	}
+
+	if k == nil || (it.rng != nil && it.rng.Limit != nil && bytes.Compare(k, it.rng.Limit) >= 0) {
+		it.key, it.value = nil, nil
+		it.cursor = nil
+		return false
+	}
+	it.key, it.value = k, v
+	return true
+}
+
+func (it *boltIterator) Key() []byte {
+	return it.key
+}
+
+func (it *boltIterator) Value() []byte {
+	return it.value
+}
+
+func (it *boltIterator) Release() {
+	it.cursor = nil
+	it.key, it.value = nil, nil
+	if it.ownTx && it.tx != nil {
+		it.tx.Rollback()
+		it.tx = nil
+	}
+}
+
+func (it *boltIterator) Error() error {
+	return it.err
+}
+
+// boltGet copies the value, because it is valid only in the transaction.
+func boltGet(tx *bolt.Tx, key []byte) []byte {
+	bkt := tx.Bucket([]byte(BOLT_BUCKET))
+	if bkt == nil {
+		return nil
+	}
+	v := bkt.Get(key)
+	if v == nil {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelKvs is the leveldb backend.
+type LevelKvs struct {
+	db *leveldb.DB
+}
+
+// OpenLevelKvs tries to recover the corrupted db, and moves it aside when the recover failed.
+func OpenLevelKvs(path string) (*LevelKvs, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if lerrors.IsCorrupted(err) {
+		log.Printf("> [Warning] could not open \"%s\": %s\n", path, err)
+
+		// try to recover the corrupted db before recreating
+		db, err = leveldb.RecoverFile(path, nil)
+		if err != nil {
+			log.Printf("> [Warning] could not recover \"%s\": %s\n", path, err)
+
+			// move .db directory aside, and it is not removed
+			broken := path + ".broken-" + time.Now().Format(STORE_BACKUP_TIMEFMT)
+			err = os.Rename(path, broken)
+			if err != nil {
+				return nil, err
+			}
+
+			// one more try
+			db, err = leveldb.OpenFile(path, nil)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("> [Warning] recreated \"%s\", and the old one is kept as \"%s\"\n", path, broken)
+		} else {
+			log.Printf("> [Warning] recovered \"%s\"\n", path)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &LevelKvs{db: db}, nil
+}
+
+func (l *LevelKvs) Get(key []byte) ([]byte, error) {
+	return levelGet(l.db.Get(key, nil))
+}
+
+func (l *LevelKvs) Has(key []byte) (bool, error) {
+	return l.db.Has(key, nil)
+}
+
+func (l *LevelKvs) NewIterator(rng *KvsRange) KvsIterator {
+	return l.db.NewIterator(levelRange(rng), nil)
+}
+
+func (l *LevelKvs) Put(key []byte, value []byte) error {
+	return l.db.Put(key, value, nil)
+}
+
+func (l *LevelKvs) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+func (l *LevelKvs) Write(batch *KvsBatch) error {
+	b := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.value == nil {
+			b.Delete(op.key)
+		} else {
+			b.Put(op.key, op.value)
+		}
+	}
+	return l.db.Write(b, nil)
+}
+
+func (l *LevelKvs) Snapshot() (KvsSnapshot, error) {
+	snap, err := l.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &levelSnapshot{snap}, nil
+}
+
+func (l *LevelKvs) Close() error {
+	return l.db.Close()
+}
+
+type levelSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+func (s *levelSnapshot) Get(key []byte) ([]byte, error) {
+	return levelGet(s.snap.Get(key, nil))
+}
+
+func (s *levelSnapshot) Has(key []byte) (bool, error) {
+	return s.snap.Has(key, nil)
+}
+
+func (s *levelSnapshot) NewIterator(rng *KvsRange) KvsIterator {
+	return s.snap.NewIterator(levelRange(rng), nil)
+}
+
+func (s *levelSnapshot) Release() {
+	s.snap.Release()
+}
+
+func levelGet(v []byte, err error) ([]byte, error) {
+	if err == leveldb.ErrNotFound {
+		return nil, ErrKvsNotFound
+	}
+	return v, err
+}
+
+func levelRange(rng *KvsRange) *util.Range {
+	if rng == nil {
+		return nil
+	}
+	return &util.Range{Start: rng.Start, Limit: rng.Limit}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sync"
+)
+
+var errMemoryKvsClosed = errors.New("kvs: closed")
+
+// MemoryKvs is the backend in memory, and all keys are lost when closed.
+// It is for tests and ephemeral kiosks.
+type MemoryKvs struct {
+	mu     sync.RWMutex
+	data   map[string][]byte
+	closed bool
+}
+
+func NewMemoryKvs() *MemoryKvs {
+	return &MemoryKvs{data: make(map[string][]byte)}
+}
+
+func (m *MemoryKvs) Get(key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return nil, errMemoryKvsClosed
+	}
+	v, ok := m.data[string(key)]
+	if !ok {
+		return nil, ErrKvsNotFound
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (m *MemoryKvs) Has(key []byte) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return false, errMemoryKvsClosed
+	}
+	_, ok := m.data[string(key)]
+	return ok, nil
+}
+
+// NewIterator iterates the keys at the time of the call.
+func (m *MemoryKvs) NewIterator(rng *KvsRange) KvsIterator {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return &memoryIterator{err: errMemoryKvsClosed}
+	}
+	return newMemoryIterator(m.data, rng)
+}
+
+func (m *MemoryKvs) Put(key []byte, value []byte) error {
+	b := new(KvsBatch)
+	b.Put(key, value)
+	return m.Write(b)
+}
+
+func (m *MemoryKvs) Delete(key []byte) error {
+	b := new(KvsBatch)
+	b.Delete(key)
+	return m.Write(b)
+}
+
+func (m *MemoryKvs) Write(batch *KvsBatch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return errMemoryKvsClosed
+	}
+	for _, op := range batch.ops {
+		if op.value == nil {
+			delete(m.data, string(op.key))
+		} else {
+			m.data[string(op.key)] = op.value
+		}
+	}
+	return nil
+}
+
+// Snapshot copies all keys, and values are shared because they are never modified.
+func (m *MemoryKvs) Snapshot() (KvsSnapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return nil, errMemoryKvsClosed
+	}
+
+	snap := &memorySnapshot{data: make(map[string][]byte, len(m.data))}
+	for k, v := range m.data {
+		snap.data[k] = v
+	}
+	return snap, nil
+}
+
+func (m *MemoryKvs) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.data = make(map[string][]byte)
+	return nil
+}
+
+type memorySnapshot struct {
+	data map[string][]byte
+}
+
+func (s *memorySnapshot) Get(key []byte) ([]byte, error) {
+	v, ok := s.data[string(key)]
+	if !ok {
+		return nil, ErrKvsNotFound
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (s *memorySnapshot) Has(key []byte) (bool, error) {
+	_, ok := s.data[string(key)]
+	return ok, nil
+}
+
+func (s *memorySnapshot) NewIterator(rng *KvsRange) KvsIterator {
+	return newMemoryIterator(s.data, rng)
+}
+
+func (s *memorySnapshot) Release() {}
+
+type memoryIterator struct {
+	keys   []string
+	values [][]byte
+	pos    int
+	err    error
+}
+
+func newMemoryIterator(data map[string][]byte, rng *KvsRange) *memoryIterator {
+	it := &memoryIterator{pos: -1}
+	for k := range data {
+		if rng.Contains([]byte(k)) {
+			it.keys = append(it.keys, k)
+		}
+	}
+	slices.Sort(it.keys)
+	for _, k := range it.keys {
+		it.values = append(it.values, data[k])
+	}
+	return it
+}
+
+func (it *memoryIterator) Next() bool {
+	if it.err != nil || it.pos >= len(it.keys) {
+		return false
+	}
+	it.pos++
+	return it.pos < len(it.keys)
+}
+
+func (it *memoryIterator) Key() []byte {
+	if it.pos < 0 || it.pos >= len(it.keys) {
+		return nil
+	}
+	return []byte(it.keys[it.pos])
+}
+
+func (it *memoryIterator) Value() []byte {
+	if it.pos < 0 || it.pos >= len(it.keys) {
+		return nil
+	}
+	return it.values[it.pos]
+}
+
+func (it *memoryIterator) Release() {
+	it.keys = nil
+	it.values = nil
+}
+
+func (it *memoryIterator) Error() error {
+	return it.err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func RequireKvsKeys(t *testing.T, r KvsReader, rng *KvsRange, expect ...string) {
+	t.Helper()
+
+	keys := []string{}
+	iter := r.NewIterator(rng)
+	for iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Release()
+
+	require.NoError(t, iter.Error())
+	require.Equal(t, keys, append([]string{}, expect...))
+}
+
+func TestKvs(t *testing.T) {
+	for _, backend := range []string{KVS_LEVELDB, KVS_BOLT, KVS_MEMORY} {
+		t.Run(backend, func(t *testing.T) {
+			db, err := OpenKvs(backend, filepath.Join(t.TempDir(), "test.db"))
+
+			require.NoError(t, err)
+			defer db.Close()
+
+			// put, get, has, delete
+			require.NoError(t, db.Put([]byte("a/1"), []byte("A1")))
+			require.NoError(t, db.Put([]byte("b"), []byte("")))
+
+			v, err := db.Get([]byte("a/1"))
+
+			require.NoError(t, err)
+			require.Equal(t, string(v), "A1")
+
+			v, err = db.Get([]byte("b"))
+
+			require.NoError(t, err)
+			require.Equal(t, string(v), "")
+
+			_, err = db.Get([]byte("none"))
+
+			require.Equal(t, err, ErrKvsNotFound)
+
+			has, _ := db.Has([]byte("b"))
+
+			require.True(t, has)
+
+			require.NoError(t, db.Delete([]byte("b")))
+			has, _ = db.Has([]byte("b"))
+
+			require.False(t, has)
+
+			// batch
+			batch := new(KvsBatch)
+			batch.Put([]byte("a/2"), []byte("A2"))
+			batch.Put([]byte("a/3"), []byte("A3"))
+			batch.Put([]byte("c"), []byte("C"))
+			batch.Delete([]byte("a/3"))
+
+			require.NoError(t, db.Write(batch))
+
+			// range
+			RequireKvsKeys(t, db, nil, "a/1", "a/2", "c")
+			RequireKvsKeys(t, db, KvsPrefix([]byte("a/")), "a/1", "a/2")
+			RequireKvsKeys(t, db, &KvsRange{Start: []byte("a/2"), Limit: []byte("c")}, "a/2")
+			RequireKvsKeys(t, db, KvsPrefix([]byte("z")))
+
+			// snapshot is not changed by later writes
+			snap, err := db.Snapshot()
+
+			require.NoError(t, err)
+
+			db.Put([]byte("d"), []byte("D"))
+			db.Delete([]byte("a/1"))
+
+			_, err = snap.Get([]byte("d"))
+
+			require.Equal(t, err, ErrKvsNotFound)
+			RequireKvsKeys(t, snap, nil, "a/1", "a/2", "c")
+			snap.Release()
+
+			RequireKvsKeys(t, db, nil, "a/2", "c", "d")
+		})
+	}
+
+	// unknown backend
+	_, err := OpenKvs("none", "")
+
+	require.Error(t, err)
+}
+
+func TestKvsPrefix(t *testing.T) {
+	require.Equal(t, KvsPrefix([]byte("ab")), &KvsRange{Start: []byte("ab"), Limit: []byte("ac")})
+	require.Equal(t, KvsPrefix([]byte{'a', 0xff}), &KvsRange{Start: []byte{'a', 0xff}, Limit: []byte("b")})
+	require.Nil(t, KvsPrefix([]byte{0xff}).Limit)
+}
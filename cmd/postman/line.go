@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	LINE_MAX_BYTES   = 64 * 1024
+	LINE_SEND_BUFFER = 512
+	LINE_WRITE_SEC   = 10
+)
+
+// lineEscaper keeps a message in one line, and backslash is escaped to be reversible.
+var lineEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+
+//
+// Server
+//
+
+// LineServer accepts text lines "publish CH MSG" and "subscribe CH" over TCP, and "publish CH MSG" over UDP.
+type LineServer struct {
+	tcpAddr string
+	udpAddr string
+
+	listener net.Listener
+	packet   net.PacketConn
+
+	mu      sync.Mutex
+	conns   map[net.Conn]bool
+	stopped bool
+
+	wg       sync.WaitGroup // accept loops and connections
+	stopOnce sync.Once
+}
+
+func NewLineServer(tcpAddr string, udpAddr string) *LineServer {
+	s := &LineServer{
+		tcpAddr: tcpAddr,
+		udpAddr: udpAddr,
+		conns:   make(map[net.Conn]bool),
+	}
+	return s
+}
+
+func (s *LineServer) Start() error {
+	if s.tcpAddr != "" {
+		l, err := net.Listen("tcp", s.tcpAddr)
+		if err != nil {
+			return err
+		}
+		s.listener = l
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				s.wg.Add(1)
+				go func() {
+					defer s.wg.Done()
+					s.serve(conn)
+				}()
+			}
+		}()
+	}
+
+	if s.udpAddr != "" {
+		pc, err := net.ListenPacket("udp", s.udpAddr)
+		if err != nil {
+			s.Stop()
+			return err
+		}
+		s.packet = pc
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.servePacket(pc)
+		}()
+	}
+
+	return nil
+}
+
+// Stop closes the listeners and connections, and waits for them to finish.
+func (s *LineServer) Stop() {
+	s.stopOnce.Do(func() {
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		if s.packet != nil {
+			s.packet.Close()
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.stopped = true
+		for conn := range s.conns {
+			conn.Close()
+		}
+	})
+	s.wg.Wait()
+}
+
+// track registers the connection to be closed by Stop, and fails after Stop.
+func (s *LineServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *LineServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+func (s *LineServer) serve(conn net.Conn) {
+	defer conn.Close()
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+
+	remoteAddr := conn.RemoteAddr().String()
+	if !LineValidation(remoteAddr) {
+		conn.Write([]byte("error remote ip blocked\n"))
+		return
+	}
+
+	if draining.Load() {
+		conn.Write([]byte("error server is draining\n"))
+		return
+	}
+
+	c := &LineClient{
+		conn:   conn,
+		authed: !opts.SecureMode,
+		out:    make(chan string, LINE_SEND_BUFFER),
+		done:   make(chan struct{}),
+	}
+	go c.writePump()
+	metrics.Connected()
+
+	log.Printf("> [Connected] tcp from %s\n", remoteAddr)
+	if logger != nil {
+		logger.Log(INFO, "new connection", logrus.Fields{"method": "tcp", "from": remoteAddr})
+	}
+
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 4096), LINE_MAX_BYTES)
+	for sc.Scan() {
+		c.handle(strings.TrimRight(sc.Text(), "\r"))
+	}
+
+	c.Close()
+	broker.DetachAll(c)
+	metrics.Closed(c)
+
+	log.Printf("> [Closed] tcp from %s\n", c.label())
+	if logger != nil {
+		logger.Log(INFO, "connection close", logrus.Fields{"method": "tcp", "from": c.label()})
+	}
+}
+
+func (s *LineServer) servePacket(pc net.PacketConn) {
+	buf := make([]byte, LINE_MAX_BYTES)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		remoteAddr := addr.String()
+		if !LineValidation(remoteAddr) {
+			continue
+		}
+
+		// fire-and-forget publish only
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			cmd, ch, msg := ParseLine(strings.TrimRight(line, "\r"))
+			if cmd == "publish" && ch != "" {
+				LinePublish("udp", ch, msg, remoteAddr)
+			}
+		}
+	}
+}
+
+//
+// Client
+//
+
+type LineClient struct {
+	conn      net.Conn
+	mu        sync.RWMutex
+	info      string // written by the reader, and read by brokers and metrics
+	authed    bool
+	token     string
+	out       chan string
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *LineClient) Info() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.info
+}
+
+func (c *LineClient) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *LineClient) Send(ch string, pmsg *PublishSendMessage) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.out <- "message " + lineEscaper.Replace(ch) + " " + lineEscaper.Replace(pmsg.Message) + "\n":
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *LineClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *LineClient) label() string {
+	if info := c.Info(); info != "" {
+		return info + "@" + c.RemoteAddr()
+	}
+	return c.RemoteAddr()
+}
+
+func (c *LineClient) writePump() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case line := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(LINE_WRITE_SEC * time.Second))
+			if _, err := c.conn.Write([]byte(line)); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *LineClient) reply(line string) {
+	select {
+	case c.out <- line + "\n":
+	case <-c.done:
+	}
+}
+
+func (c *LineClient) handle(line string) {
+	cmd, ch, msg := ParseLine(line)
+	if cmd == "" {
+		return
+	}
+
+	if !c.authed {
+		if cmd == "auth" {
+			res, err := Authenticate(secret, ch, host)
+			if res && err == nil {
+				c.authed = true
+				c.token = ch
+				c.reply("ok")
+				return
+			}
+
+			log.Printf("> [Warning] authentication failed from %s\n", c.RemoteAddr())
+			metrics.AuthFailed()
+			if logger != nil {
+				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "tcp", "token": ch, "from": c.RemoteAddr()})
+			}
+		}
+
+		c.reply("error security error")
+		return
+	}
+
+	infoAtRemote := c.label()
+	switch cmd {
+	case "ping":
+		c.reply("pong")
+
+	case "publish":
+		if ch == "" {
+			c.reply("error publish channel is empty")
+			return
+		}
+		if err := LinePublish("tcp", ch, msg, infoAtRemote); err != nil {
+			c.reply("error " + err.Error())
+		}
+
+	case "subscribe":
+		if ch == "" {
+			c.reply("error subscribe channel is empty")
+			return
+		}
+		if !SafeChannel(ch) {
+			log.Printf("> [Warning] whitelist does not contain subscribe channel from %s\n", infoAtRemote)
+			if logger != nil {
+				logger.Log(WARN, "whitelist does not contain subscribe channel", logrus.Fields{"method": "tcp", "channel": ch, "from": infoAtRemote})
+			}
+
+			c.reply("error whitelist does not contain subscribe channel")
+			return
+		}
+		if !StoreChannelAllowed(ch, c.token) {
+			log.Printf("> [Warning] store channel is not allowed from %s\n", infoAtRemote)
+			if logger != nil {
+				logger.Log(WARN, "store channel is not allowed", logrus.Fields{"method": "tcp", "channel": ch, "from": infoAtRemote})
+			}
+
+			c.reply("error store channel is not allowed")
+			return
+		}
+
+		// "subscribe CH CLIENT_INFO"
+		if msg != "" {
+			c.mu.Lock()
+			c.info = msg
+			c.mu.Unlock()
+			infoAtRemote = c.label()
+		}
+
+		log.Printf("> [Subscribe] tcp ch:%s from %s\n", ch, infoAtRemote)
+		if logger != nil {
+			logger.Log(INFO, "new subscribe", logrus.Fields{"method": "tcp", "channel": ch, "from": infoAtRemote})
+		}
+
+		broker.Attach(ch, c)
+		metrics.Subscribed(c, ch)
+
+	case "unsubscribe":
+		log.Printf("> [Unsubscribe] tcp ch:%s from %s\n", ch, infoAtRemote)
+		if logger != nil {
+			logger.Log(INFO, "unsubscribe", logrus.Fields{"method": "tcp", "channel": ch, "from": infoAtRemote})
+		}
+
+		broker.Detach(ch, c)
+		metrics.Unsubscribed(c, ch)
+
+	case "auth":
+		c.reply("ok")
+
+	default:
+		c.reply("error unknown command")
+	}
+}
+
+// ParseLine splits "COMMAND CHANNEL REST OF LINE".
+func ParseLine(line string) (string, string, string) {
+	f := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	cmd := strings.ToLower(f[0])
+	switch len(f) {
+	case 1:
+		return cmd, "", ""
+	case 2:
+		return cmd, f[1], ""
+	default:
+		return cmd, f[1], f[2]
+	}
+}
+
+func LinePublish(proto string, ch string, msg string, infoAtRemote string) error {
+	log.Printf("> [Publish] %s ch:%s msg:%s from %s\n", proto, ch, msg, infoAtRemote)
+	if logger != nil {
+		logger.Log(INFO, "new publish", logrus.Fields{"method": proto, "channel": ch, "message": msg, "from": infoAtRemote})
+	}
+
+	return EmitMessage(NewPublishSendMessage(ch, msg, "", ""))
+}
+
+func LineValidation(remoteAddr string) bool {
+	if IpValidation(remoteAddr) {
+		return true
+	}
+
+	log.Printf("> [Warning] remote ip blocked from %s\n", remoteAddr)
+	metrics.IpBlocked()
+	if logger != nil {
+		logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "line", "from": remoteAddr})
+	}
+	return false
+}
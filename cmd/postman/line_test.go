@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func StartMockLineServer(t *testing.T) (string, string) {
+	t.Helper()
+
+	opts.Tcp = "127.0.0.1:0"
+	opts.Udp = "127.0.0.1:0"
+	StartLine()
+	t.Cleanup(func() {
+		if lineSrv != nil {
+			lineSrv.Stop()
+			lineSrv = nil
+		}
+	})
+
+	udpAddr := ""
+	if lineSrv.packet != nil {
+		udpAddr = lineSrv.packet.LocalAddr().String()
+	}
+	return lineSrv.listener.Addr().String(), udpAddr
+}
+
+func RequireLineConnect(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	t.Cleanup(func() { c.Close() })
+
+	require.NoError(t, err)
+
+	return c, bufio.NewReader(c)
+}
+
+func RequireLine(t *testing.T, c net.Conn, r *bufio.Reader, expect string) {
+	t.Helper()
+
+	c.SetReadDeadline(time.Now().Add(1 * time.Second))
+	line, err := r.ReadString('\n')
+
+	require.NoError(t, err)
+	require.Equal(t, line, expect+"\n")
+}
+
+func TestLinePubSub(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	// start server
+	s := StartMockServer(t)
+	tcpAddr, udpAddr := StartMockLineServer(t)
+
+	// tcp client: subscribe
+	lc, lr := RequireLineConnect(t, tcpAddr)
+	lc.Write([]byte("ping\r\nsubscribe TEST_CH TEST_TCP\n"))
+	RequireLine(t, lc, lr, "pong")
+
+	// websocket client: subscribe
+	c1 := RequireConnectAndSubscribe(t, s.URL, "TEST_CH", "TEST_CLI_1")
+	time.Sleep(100 * time.Millisecond) // wait
+
+	require.Contains(t, NewStatusMessage(broker).Channels["TEST_CH"], "TEST_TCP@"+lc.LocalAddr().String())
+
+	// websocket -> tcp
+	RequirePublish(t, c1, "TEST_CH", "TEST@MESSAGE WITH SPACE", "", "", "TEST_CLI_1")
+	RequireLine(t, lc, lr, "message TEST_CH TEST@MESSAGE WITH SPACE")
+
+	c1.ReadMessage()
+
+	// tcp -> websocket
+	lc.Write([]byte("publish TEST_CH TEST@TCP\n"))
+
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err := c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@TCP")
+	RequireLine(t, lc, lr, "message TEST_CH TEST@TCP")
+
+	// udp -> websocket
+	u, err := net.Dial("udp", udpAddr)
+	t.Cleanup(func() { u.Close() })
+
+	require.NoError(t, err)
+	u.Write([]byte("publish TEST_CH TEST@UDP\n"))
+
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err = c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@UDP")
+
+	// unknown command
+	lc.Write([]byte("hello\n"))
+	RequireLine(t, lc, lr, "message TEST_CH TEST@UDP")
+	RequireLine(t, lc, lr, "error unknown command")
+}
+
+func TestLineEscape(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	tcpAddr, _ := StartMockLineServer(t)
+
+	lc, lr := RequireLineConnect(t, tcpAddr)
+	lc.Write([]byte("subscribe TEST_CH\nping\n"))
+	RequireLine(t, lc, lr, "pong")
+
+	// a message can not forge protocol lines
+	EmitMessage(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE\r\nmessage TEST_CH FORGED\\n", "", ""))
+	RequireLine(t, lc, lr, "message TEST_CH TEST@MESSAGE\\r\\nmessage TEST_CH FORGED\\\\n")
+
+	lc.Write([]byte("ping\n"))
+	RequireLine(t, lc, lr, "pong")
+}
+
+func TestLineIpValidation(t *testing.T) {
+	SetOptions(Options{IpAddresses: "192.168.0.1"})
+	Prepare()
+
+	tcpAddr, _ := StartMockLineServer(t)
+
+	lc, lr := RequireLineConnect(t, tcpAddr)
+	RequireLine(t, lc, lr, "error remote ip blocked")
+}
+
+func TestLineSecureMode(t *testing.T) {
+	os.Setenv(ENV_SECRET, "SECRET")
+	t.Cleanup(func() { os.Unsetenv(ENV_SECRET) })
+
+	SetOptions(Options{SecureMode: true})
+	Prepare()
+
+	tcpAddr, udpAddr := StartMockLineServer(t)
+	tkn, _ := GenerateToken(secret, host)
+
+	// no udp in secure mode
+	require.Equal(t, udpAddr, "")
+
+	lc, lr := RequireLineConnect(t, tcpAddr)
+	lc.Write([]byte("ping\n"))
+	RequireLine(t, lc, lr, "error security error")
+
+	lc.Write([]byte("auth @@@\n"))
+	RequireLine(t, lc, lr, "error security error")
+
+	lc.Write([]byte("auth " + tkn + "\nping\n"))
+	RequireLine(t, lc, lr, "ok")
+	RequireLine(t, lc, lr, "pong")
+}
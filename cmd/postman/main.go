@@ -7,18 +7,20 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/gorilla/websocket"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/sharkattack51/golem"
 	"github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 const (
@@ -28,12 +30,17 @@ const (
 	SERVE_FILES_DIR = "serve_files"
 	PLUGIN_DIR      = "plugin"
 	PLUGIN_JSON     = "plugin.json"
-	TARGET_PAAS     = false
 
-	ENV_SECRET = "SECRET"
-	ENV_PORT   = "PORT"
-	ENV_CHLIST = "CHLIST"
-	ENV_IPLIST = "IPLIST"
+	DRAIN_TIMEOUT_SEC = 5
+	DRAIN_FLUSH_MSEC  = 1000
+
+	ENV_SECRET  = "SECRET"
+	ENV_PORT    = "PORT"
+	ENV_CHLIST  = "CHLIST"
+	ENV_IPLIST  = "IPLIST"
+	ENV_PROFILE = "POSTMAN_PROFILE"
+
+	ENV_CLUSTER_SECRET = "CLUSTER_SECRET"
 )
 
 type Options struct {
@@ -42,24 +49,72 @@ type Options struct {
 	Channels     string `short:"c" long:"chlist" description:"safelist for channels"`
 	IpAddresses  string `short:"i" long:"iplist" description:"connectable ip_address list"`
 	UseStoreApi  bool   `short:"k" long:"store" description:"enable key-value store api"`
+	StoreBackend string `long:"store-backend" description:"key-value store backend (leveldb|bolt|memory) (default: leveldb)"`
+	StoreDB      string `long:"store-db" description:"path of key-value store db (default: postman.db)"`
+	StoreNotify  bool   `long:"store-notify" description:"publish key-value store changes to \"$store/KEY\" channels"`
+	StoreNsKeys  int    `long:"store-ns-keys" description:"max number of keys in a key-value store namespace (0: unlimited)"`
+	StoreNsBytes int    `long:"store-ns-bytes" description:"max total bytes of keys and values in a key-value store namespace (0: unlimited)"`
+	StoreBackup  int    `long:"store-backup" description:"minutes between automatic backups of key-value store (0: disabled)"`
+	StoreBkKeep  int    `long:"store-backup-keep" description:"number of backups to keep (default: 7)"`
+	StoreBkDir   string `long:"store-backup-dir" description:"directory of key-value store backups (default: postman.db.backup)"`
+	StoreImBytes int    `long:"store-import-bytes" description:"max bytes of a key-value store import request (default: 67108864)"`
+	StoreImRecs  int    `long:"store-import-records" description:"max number of records in a key-value store import (default: 100000)"`
 	UseFileApi   bool   `short:"f" long:"file" description:"enable file server api"`
 	UsePluginApi bool   `short:"u" long:"plugin" description:"enable plugin api"`
 	SecureMode   bool   `short:"s" long:"secure" description:"secure mode"`
 	GenToken     bool   `short:"g" long:"generate" description:"genarate token from environment variable [SECRET]"`
+	TokenNs      string `long:"token-ns" description:"key-value store namespace forced by the generated token"`
+	Profile      string `short:"P" long:"profile" description:"runtime profile (standalone|paas) or environment variable [POSTMAN_PROFILE]"`
+	OpenProbe    bool   `long:"open-probe" description:"health check api skips ip and token checks"`
+	DrainTimeout int    `long:"drain-timeout" default:"5" description:"seconds to drain websocket connections on shutdown"`
+	DrainGrace   int    `long:"drain-grace" default:"5" description:"seconds to report draining by readiness check before closing the listener"`
+	ClusterName  string `long:"cluster-name" description:"node name in cluster (default: HOST:PORT)"`
+	ClusterAddr  string `long:"cluster-listen" description:"listen address for cluster nodes (e.g. :7946)"`
+	ClusterPeers string `long:"cluster-peers" description:"static list of cluster node addresses"`
+	ClusterSeeds string `long:"cluster-seeds" description:"seed node addresses to discover other cluster nodes"`
+	ClusterKey   string `long:"cluster-secret" description:"shared secret of cluster nodes or environment variable [CLUSTER_SECRET]"`
+	Mqtt         string `long:"mqtt" description:"listen address for MQTT 3.1.1 clients (e.g. :1883)"`
+	Tcp          string `long:"tcp" description:"listen address for text line clients over TCP (e.g. :8810)"`
+	Udp          string `long:"udp" description:"listen address for text line publish over UDP (e.g. :8810)"`
+	Osc          string `long:"osc" description:"listen address for OSC messages over UDP (e.g. :9000)"`
+	OscTargets   string `long:"osc-targets" description:"OSC destination addresses for published messages (e.g. 127.0.0.1:9001)"`
+	OscChannels  string `long:"osc-channels" description:"channel patterns sent to OSC destinations (default: all)"`
+	Route        string `long:"route" description:"routing rules config json file"`
+	Webhook      string `long:"webhook" description:"webhook config json file"`
+	Broker       string `long:"broker" description:"message broker url shared by postman instances (redis://HOST:PORT, nats://HOST:PORT)"`
 }
 
 var (
-	srv      *http.Server
-	host     string
-	roomMg   *golem.RoomManager
-	conns    sync.Map // map[string]*golem.Connection
-	cliInfos sync.Map // map[string]string
-	safeList []string
-	ipList   []string
-	logger   *Logger
-	kvsDB    *leveldb.DB
-	opts     Options
-	secret   string
+	srv        *http.Server
+	host       string
+	wsConns    sync.WaitGroup // websocket connections until Closed
+	rejected   sync.Map       // websocket connections closing after Reject
+	broker     Broker
+	conns      sync.Map // map[string]*golem.Connection
+	cliInfos   sync.Map // map[string]string
+	cliTokens  sync.Map // map[string]string
+	filtered   sync.Map // map[*golem.Connection]*FilteredConnection
+	scheds     *Scheduler
+	sweeper    *StoreSweeper
+	autoBackup *StoreAutoBackup
+	safeList   []string
+	ipList     []string
+	logger     *Logger
+	kvsDB      Kvs
+	opts       Options
+	secret     string
+	profile    *Profile
+	metrics    *Metrics
+	draining   atomic.Bool
+	cluster    *ClusterNode
+	mqttSrv    *MqttServer
+	lineSrv    *LineServer
+	oscGw      *OscGateway
+	events     *EventLog
+	sseClients sync.Map // map[*SseClient]bool
+	polls      *PollManager
+	webhooks   *WebhookDispatcher
+	routes     *Router
 )
 
 //
@@ -67,11 +122,6 @@ var (
 //
 
 func main() {
-	// graceful shutdown for windows
-	if !TARGET_PAAS && runtime.GOOS == "windows" {
-		RegisterOSHandler(GracefulShutdown)
-	}
-
 	// option flags
 	_, err := flags.Parse(&opts)
 	if err != nil { // [help] also passes
@@ -83,6 +133,11 @@ func main() {
 		defer kvsDB.Close()
 	}
 
+	// graceful shutdown for windows
+	if profile.UseOSHandler && runtime.GOOS == "windows" {
+		RegisterOSHandler(GracefulShutdown)
+	}
+
 	PrintInfo()
 	StartServer()
 
@@ -95,17 +150,111 @@ func main() {
 	GracefulShutdown()
 }
 
+// StopServices stops everything of the previous run, before the globals are replaced.
+func StopServices() {
+	CloseConnections()
+	if polls != nil {
+		polls.Stop()
+	}
+	if scheds != nil {
+		scheds.Stop()
+	}
+	if sweeper != nil {
+		sweeper.Stop()
+		sweeper = nil
+	}
+	if autoBackup != nil {
+		autoBackup.Stop()
+		autoBackup = nil
+	}
+	if cluster != nil {
+		cluster.Stop()
+		cluster = nil
+	}
+	if mqttSrv != nil {
+		mqttSrv.Stop()
+		mqttSrv = nil
+	}
+	if lineSrv != nil {
+		lineSrv.Stop()
+		lineSrv = nil
+	}
+	if oscGw != nil {
+		oscGw.Stop()
+		oscGw = nil
+	}
+	if webhooks != nil {
+		webhooks.Stop()
+		webhooks = nil
+	}
+	if broker != nil {
+		broker.Close()
+	}
+	if kvsDB != nil {
+		kvsDB.Close()
+		kvsDB = nil
+	}
+}
+
 func Prepare() {
+	StopServices()
+
 	host = GetHostIP()
-	roomMg = golem.NewRoomManager()
 	conns = sync.Map{}    // make(map[string]*golem.Connection)
 	cliInfos = sync.Map{} // make(map[string]string)
+	cliTokens = sync.Map{}
+	filtered = sync.Map{}
+	rejected = sync.Map{}
+	metrics = NewMetrics()
+	events = NewEventLog()
+	sseClients = sync.Map{}
+	polls = NewPollManager()
+	storeUsages = make(map[string]*storeUsage)
+	draining.Store(false)
+
+	// runtime profile
+	var err error
+	profile, err = NewProfile(opts.Profile)
+	if err != nil {
+		LogFatalln(err)
+	}
+
+	// webhooks
+	if opts.Webhook != "" {
+		data, err := LoadWebhooks(opts.Webhook)
+		if err != nil {
+			LogFatalln(err)
+		} else {
+			webhooks = NewWebhookDispatcher(data)
+		}
+	}
+
+	// routing rules
+	routes = nil
+	if opts.Route != "" {
+		data, err := LoadRoutes(opts.Route)
+		if err != nil {
+			LogFatalln(err)
+		} else {
+			routes = NewRouter(data)
+		}
+	}
+
+	// message broker
+	broker, err = NewBroker(opts.Broker)
+	if err != nil {
+		LogFatalln(err)
+	}
 
-	// for PaaS build
-	if TARGET_PAAS {
+	// configuration from environment variables
+	if profile.UseEnvConfig {
 		opts.Port = os.Getenv(ENV_PORT)
 		opts.Channels = os.Getenv(ENV_CHLIST)
 		opts.IpAddresses = os.Getenv(ENV_IPLIST)
+	}
+
+	// apis using local disk are not available
+	if !profile.UseLocalStorage {
 		opts.UseStoreApi = false
 		opts.UseFileApi = false
 		opts.UsePluginApi = false
@@ -129,6 +278,9 @@ func Prepare() {
 		}
 
 		token, err := GenerateToken(secret, host)
+		if opts.TokenNs != "" {
+			token, err = GenerateNamespaceToken(secret, host, opts.TokenNs)
+		}
 		if err != nil {
 			LogFatalln(err)
 		}
@@ -154,33 +306,19 @@ func Prepare() {
 		}
 	}
 
-	if !TARGET_PAAS {
+	if profile.UseLocalStorage {
 		// log
 		if opts.LogDir != "" {
 			logger = NewLogger(opts.LogDir, LOG_FILE)
 		}
 
-		var err error
-
 		// store db
 		if opts.UseStoreApi {
-			kvsDB, err = leveldb.OpenFile(DB_FILE, nil)
+			db, err := OpenKvs(opts.StoreBackend, StoreDBPath())
 			if err != nil {
-				log.Printf("> [Warning] could not open \"%s\": %s\n", DB_FILE, err)
-
-				// remove .db directory
-				err = os.RemoveAll(DB_FILE)
-				if err != nil {
-					log.Printf("> [Warning] could not remove \"%s\": %s\n", DB_FILE, err)
-				} else {
-					// one more try
-					kvsDB, err = leveldb.OpenFile(DB_FILE, nil)
-					if err != nil {
-						log.Printf("> [Warning] could not open \"%s\": %s\n", DB_FILE, err)
-					} else {
-						log.Printf("> [Warning] recreated \"%s\"\n", DB_FILE)
-					}
-				}
+				log.Printf("> [Warning] could not open \"%s\": %s\n", StoreDBPath(), err)
+			} else {
+				kvsDB = db
 			}
 		}
 
@@ -194,6 +332,17 @@ func Prepare() {
 			}
 		}
 	}
+
+	// schedules are kept in store db when it is enabled
+	if opts.UseStoreApi && kvsDB != nil {
+		scheds = NewScheduler(kvsDB)
+		sweeper = NewStoreSweeper(kvsDB)
+		if opts.StoreBackup > 0 {
+			autoBackup = NewStoreAutoBackup(kvsDB, StoreBackupDir(), time.Duration(opts.StoreBackup)*time.Minute, opts.StoreBkKeep)
+		}
+	} else {
+		scheds = NewScheduler(nil)
+	}
 }
 
 func PrintInfo() {
@@ -212,30 +361,118 @@ func PrintInfo() {
 	fmt.Println("<- \"unsubscribe {\"ch\":\"CHANNEL\"}\"")
 	fmt.Println("[Publish]")
 	fmt.Println("<- \"publish {\"ch\":\"CHANNEL\",\"msg\":\"MESSAGE\",[\"tag\":\"TAG\",\"ext\":\"OTHER\"]}\"")
+	fmt.Println("[Schedule]")
+	fmt.Println("<- \"schedule {\"cmd\":\"(ADD|LIST|CANCEL)\",[\"ch\":\"CHANNEL\",\"msg\":\"MESSAGE\",\"delay\":\"SEC\"|\"at\":\"RFC3339\"|\"cron\":\"CRON\",\"id\":\"ID\"]}\"")
+	if opts.UseStoreApi && kvsDB != nil {
+		fmt.Println("[Store]")
+		fmt.Println("<- \"store {\"id\":\"ID\",\"cmd\":\"(GET|SET|HAS|DEL|...)\",\"key\":\"KEY\",[\"val\":\"VALUE\"]}\" -> \"store {\"id\":\"ID\",\"result\":\"RESULT\"}\"")
+	}
 	fmt.Println("")
 	fmt.Println("=== Http API ===")
 	fmt.Printf("http://%s:%s/postman\n", host, opts.Port)
 	fmt.Println("[Status]")
 	fmt.Println(SecureSprintf("(GET) /status%s", "?tkn=TOKEN"))
 	fmt.Println(SecureSprintf("(GET) /status_pp%s", "?tkn=TOKEN"))
+	fmt.Println("[Metrics]")
+	fmt.Println(SecureSprintf("(GET) /metrics%s", "?tkn=TOKEN"))
+	fmt.Println("[Health]")
+	fmt.Println(ProbeSprintf("(GET) /healthz%s", "?tkn=TOKEN"))
+	fmt.Println(ProbeSprintf("(GET) /readyz%s", "?tkn=TOKEN"))
 	fmt.Println("[Publish]")
 	fmt.Println(SecureSprintf("(GET) /publish?ch=CHANNEL&msg=MESSAGE[&tag=TAG&ext=OTHER&ci=CLIENT_INFO]%s", "&tkn=TOKEN"))
 	fmt.Println(SecureSprintf("(POST) /publish <- json={\"ch\":\"CHANNEL\",\"msg\":\"MESSAGE\",[\"tag\":\"TAG\",\"ext\":\"OTHER\",\"ci\":\"CLIENT_INFO\"]%s}", ",\"tkn\":\"TOKEN\""))
+	fmt.Println("[Subscribe]")
+	fmt.Println(SecureSprintf("(GET) /sse?ch=CHANNEL[,CHANNEL][&ci=CLIENT_INFO]%s", "&tkn=TOKEN"))
+	fmt.Println(SecureSprintf("(GET) /poll/subscribe?ch=CHANNEL[,CHANNEL][&ci=CLIENT_INFO]%s", "&tkn=TOKEN"))
+	fmt.Println(SecureSprintf("(GET) /poll?id=ID[&timeout=SEC]%s", "&tkn=TOKEN"))
+	fmt.Println(SecureSprintf("(GET) /poll/unsubscribe?id=ID%s", "&tkn=TOKEN"))
+	fmt.Println("[Schedule]")
+	fmt.Println(SecureSprintf("(GET) /schedule?cmd=ADD&ch=CHANNEL&msg=MESSAGE[&tag=TAG&ext=OTHER](&delay=SEC|&at=RFC3339|&cron=CRON)%s", "&tkn=TOKEN"))
+	fmt.Println(SecureSprintf("(GET) /schedule?cmd=(LIST|CANCEL)[&id=ID]%s", "&tkn=TOKEN"))
 	if opts.UseStoreApi && kvsDB != nil {
 		fmt.Println("[Store]")
-		fmt.Println(SecureSprintf("(GET) /store?cmd=(GET|SET|HAS|DEL)&key=KEY[&val=VALUE]%s", "&tkn=TOKEN"))
-		fmt.Println(SecureSprintf("(POST) /store <- json={\"cmd\":\"(GET|SET|HAS|DEL)\",\"key\":\"KEY\",[\"val\":\"VALUE\"]%s}", ",\"tkn\":\"TOKEN\""))
+		fmt.Println(SecureSprintf("(GET) /store?cmd=(GET|SET|HAS|DEL)&key=KEY[&val=VALUE&ttl=SEC]%s", "&tkn=TOKEN"))
+		fmt.Println(SecureSprintf("(POST) /store <- json={\"cmd\":\"(GET|SET|HAS|DEL)\",\"key\":\"KEY\",[\"val\":\"VALUE\",\"ttl\":SEC]%s}", ",\"tkn\":\"TOKEN\""))
+		fmt.Println(SecureSprintf("(GET) /store?cmd=(KEYS|SCAN)[&prefix=PREFIX&start=KEY&end=KEY&limit=N&cursor=CURSOR]%s", "&tkn=TOKEN"))
+		fmt.Println(SecureSprintf("(GET) /store?cmd=(TTL|EXPIRE)&key=KEY[&ttl=SEC]%s", "&tkn=TOKEN"))
+		fmt.Println(SecureSprintf("(GET) /store?cmd=(CAS|INCR|DECR)&key=KEY[&old=VALUE&val=VALUE]%s", "&tkn=TOKEN"))
+		fmt.Println(SecureSprintf("(POST) /store <- json={\"cmd\":\"BATCH\",\"ops\":[{\"cmd\":\"(SET|DEL)\",\"key\":\"KEY\",[\"val\":\"VALUE\"]}]%s}", ",\"tkn\":\"TOKEN\""))
+		fmt.Println(SecureSprintf("(GET) /store?cmd=(JGET|JSET|JMERGE|JAPPEND)&key=KEY[&path=JSON_POINTER&val=JSON]%s", "&tkn=TOKEN"))
+		fmt.Println(SecureSprintf("(GET) /store?cmd=DROP&ns=NAMESPACE%s", "&tkn=TOKEN"))
+		fmt.Println(SecureSprintf("(GET) /store?cmd=(SNAPSHOT|EXPORT|BACKUP|BACKUPS|RESTORE)[&ns=NAMESPACE&name=BACKUP]%s", "&tkn=TOKEN"))
+		fmt.Println(SecureSprintf("(POST) /store?cmd=IMPORT[&ns=NAMESPACE]%s <- JSON_LINES", "&tkn=TOKEN"))
+		if opts.StoreNotify {
+			fmt.Println("(WS) subscribe $store/KEY | $store/PREFIX/** | $store/** -> {\"message\":\"VALUE\",\"tag\":\"(set|del|expired)\",\"extention\":\"KEY\"}")
+		}
 	}
 	if opts.UseFileApi {
 		fmt.Println("[File]")
-		fmt.Println(SecureSprintf("(GET) /file/FILE_NAME%s", "?tkn=TOKEN"))
-		fmt.Println(SecureSprintf("(POST) /file <- file=FILE_BINARY %s", "json={\"tkn\":\"TOKEN\"}"))
+		fmt.Println(SecureSprintf("(GET|HEAD) /file/FILE_NAME%s", "?tkn=TOKEN"))
+		fmt.Println(SecureSprintf("(HEAD) /file/FILE_NAME?hash=1%s", "&tkn=TOKEN"))
+		fmt.Println(SecureSprintf("(POST) /file <- file=FILE_BINARY [path=DIR] %s", "json={\"tkn\":\"TOKEN\"}"))
+		fmt.Println(SecureSprintf("(GET) /file?cmd=(LIST|STAT)[&path=PATH&hash=1]%s", "&tkn=TOKEN"))
+		fmt.Println(SecureSprintf("(POST) /file?cmd=(MKDIR|DEL|MOVE)&path=PATH[&to=PATH]%s", "&tkn=TOKEN"))
 	}
 	if opts.UsePluginApi {
 		fmt.Println("[Plugin]")
 		fmt.Println(SecureSprintf("(GET) /plugin?cmd=COMMAND%s", "&tkn=TOKEN"))
 		fmt.Println(SecureSprintf("(POST) /plugin <- json={\"cmd\":COMMAND%s}", ",\"tkn\":\"TOKEN\""))
 	}
+	if opts.ClusterAddr != "" {
+		fmt.Println("")
+		fmt.Println("=== Cluster ===")
+		fmt.Printf("node %s listen %s\n", ClusterNodeName(), opts.ClusterAddr)
+	}
+	if opts.Mqtt != "" {
+		fmt.Println("")
+		fmt.Println("=== MQTT ===")
+		addr := opts.Mqtt
+		if strings.HasPrefix(addr, ":") {
+			addr = host + addr
+		}
+		fmt.Printf("mqtt://%s\n", addr)
+	}
+	if opts.Tcp != "" || opts.Udp != "" {
+		fmt.Println("")
+		fmt.Println("=== Line ===")
+		if opts.Tcp != "" {
+			fmt.Printf("tcp %s <- \"publish CHANNEL MESSAGE\", \"subscribe CHANNEL [CLIENT_INFO]\", \"unsubscribe CHANNEL\"\n", opts.Tcp)
+		}
+		if opts.Udp != "" && !opts.SecureMode {
+			fmt.Printf("udp %s <- \"publish CHANNEL MESSAGE\"\n", opts.Udp)
+		}
+	}
+	if opts.Osc != "" || opts.OscTargets != "" {
+		fmt.Println("")
+		fmt.Println("=== OSC ===")
+		if opts.Osc != "" && !opts.SecureMode {
+			fmt.Printf("udp %s <- /CHANNEL [MESSAGE TAG EXT]\n", opts.Osc)
+		}
+		for _, t := range SplitList(opts.OscTargets) {
+			fmt.Printf("udp %s -> /CHANNEL MESSAGE [TAG EXT]\n", t)
+		}
+	}
+	if routes != nil {
+		fmt.Println("")
+		fmt.Println("=== Route ===")
+		for _, rt := range routes.routes {
+			fmt.Printf("%s -> %s\n", rt.Channel, strings.Join(rt.Targets, ","))
+		}
+	}
+	if webhooks != nil {
+		fmt.Println("")
+		fmt.Println("=== Webhook ===")
+		for _, w := range webhooks.hooks {
+			fmt.Printf("%s -> %s\n", w.Channel, w.Url)
+		}
+	}
+	if opts.Broker != "" {
+		fmt.Println("")
+		fmt.Println("=== Broker ===")
+		if u, err := url.Parse(opts.Broker); err == nil {
+			fmt.Println(u.Redacted())
+		}
+	}
 	fmt.Println("===================================================")
 	fmt.Println("")
 }
@@ -250,7 +487,16 @@ func StartServer() {
 	http.HandleFunc("/postman/publish", PublishHandler)
 	http.HandleFunc("/postman/status", StatusHandler)
 	http.HandleFunc("/postman/status_pp", StatusPpHandler)
+	http.HandleFunc("/postman/sse", SseHandler)
+	http.HandleFunc("/postman/poll", PollHandler)
+	http.HandleFunc("/postman/poll/subscribe", PollSubscribeHandler)
+	http.HandleFunc("/postman/poll/unsubscribe", PollUnsubscribeHandler)
+	http.HandleFunc("/postman/metrics", MetricsHandler)
+	http.HandleFunc("/postman/healthz", HealthzHandler)
+	http.HandleFunc("/postman/readyz", ReadyzHandler)
+	http.HandleFunc("/postman/schedule", ScheduleHandler)
 	http.HandleFunc("/postman/store", StoreHandler)
+	http.HandleFunc("/postman/file", FileHandler)
 	http.HandleFunc("/postman/file/", FileHandler)
 	http.HandleFunc("/postman/plugin", PluginHandler)
 
@@ -260,19 +506,270 @@ func StartServer() {
 		}
 	}()
 
+	if opts.ClusterAddr != "" {
+		StartCluster()
+	}
+
+	if opts.Mqtt != "" {
+		StartMqtt()
+	}
+
+	if opts.Tcp != "" || opts.Udp != "" {
+		StartLine()
+	}
+
+	if opts.Osc != "" || opts.OscTargets != "" {
+		StartOsc()
+	}
+
 	if logger != nil {
 		logger.Log(INFO, "postman start", logrus.Fields{"host": host, "port": opts.Port})
 	}
 }
 
 func GracefulShutdown() {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	timeout := time.Duration(opts.DrainTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = DRAIN_TIMEOUT_SEC * time.Second
+	}
+
+	// stop accepting new connections, and wait for load balancers to see the readiness check
+	draining.Store(true)
+	if opts.DrainGrace > 0 {
+		log.Printf("> [Shutdown] draining for %d sec\n", opts.DrainGrace)
+		time.Sleep(time.Duration(opts.DrainGrace) * time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
+
+	// tell clients to reconnect later
+	NotifyShutdown(int(timeout.Seconds()))
+	if scheds != nil {
+		scheds.Stop()
+	}
+
+	if srv != nil {
+		if err := srv.Shutdown(ctx); err != nil {
+			LogFatalln(err)
+		}
+	}
+
+	// hijacked websocket connections are not closed by srv.Shutdown()
+	DrainConnections(ctx)
+
+	if cluster != nil {
+		cluster.Stop()
+	}
+
+	if mqttSrv != nil {
+		mqttSrv.Stop()
+	}
+
+	if lineSrv != nil {
+		lineSrv.Stop()
+	}
+
+	if oscGw != nil {
+		oscGw.Stop()
+	}
+
+	if sweeper != nil {
+		sweeper.Stop()
+	}
+
+	if autoBackup != nil {
+		autoBackup.Stop()
+	}
+
+	if webhooks != nil {
+		webhooks.Stop()
+	}
+}
+
+func StartLine() {
+	udpAddr := opts.Udp
+	if opts.SecureMode && udpAddr != "" {
+		// no token for fire-and-forget datagram
+		log.Printf("> [Warning] udp listener is disabled in secure mode\n")
+		udpAddr = ""
+	}
+
+	s := NewLineServer(opts.Tcp, udpAddr)
+	if err := s.Start(); err != nil {
 		LogFatalln(err)
+		return
+	}
+	lineSrv = s
+
+	log.Printf("> [Line] listen tcp:%s udp:%s\n", opts.Tcp, udpAddr)
+	if logger != nil {
+		logger.Log(INFO, "line start", logrus.Fields{"tcp": opts.Tcp, "udp": udpAddr})
 	}
 }
 
+func StartOsc() {
+	listen := opts.Osc
+	if opts.SecureMode && listen != "" {
+		// no token for OSC input
+		log.Printf("> [Warning] osc input is disabled in secure mode\n")
+		listen = ""
+	}
+
+	g, err := NewOscGateway(listen, SplitList(opts.OscTargets), SplitList(opts.OscChannels))
+	if err == nil {
+		err = g.Start()
+	}
+	if err != nil {
+		LogFatalln(err)
+		return
+	}
+	oscGw = g
+
+	log.Printf("> [OSC] listen %s targets %s\n", listen, opts.OscTargets)
+	if logger != nil {
+		logger.Log(INFO, "osc start", logrus.Fields{"listen": listen, "targets": opts.OscTargets, "channels": opts.OscChannels})
+	}
+}
+
+func StartMqtt() {
+	s := NewMqttServer(opts.Mqtt)
+	if err := s.Start(); err != nil {
+		LogFatalln(err)
+		return
+	}
+	mqttSrv = s
+
+	log.Printf("> [MQTT] listen %s\n", opts.Mqtt)
+	if logger != nil {
+		logger.Log(INFO, "mqtt start", logrus.Fields{"listen": opts.Mqtt})
+	}
+}
+
+func StartCluster() {
+	key := opts.ClusterKey
+	if key == "" {
+		key = os.Getenv(ENV_CLUSTER_SECRET)
+	}
+	if opts.SecureMode && key == "" {
+		// publishes from other nodes bypass tokens
+		log.Printf("> [Warning] cluster is disabled in secure mode without cluster secret\n")
+		return
+	}
+
+	peers := []string{}
+	for _, p := range strings.Split(opts.ClusterPeers+","+opts.ClusterSeeds, ",") {
+		if p != "" {
+			peers = append(peers, p)
+		}
+	}
+
+	// discover other nodes only via seeds
+	n := NewClusterNode(ClusterNodeName(), opts.ClusterAddr, opts.ClusterSeeds != "")
+	n.Deliver = broker.Deliver
+	n.Presence = func() map[string][]string { return LocalChannels(broker) }
+	n.Secret = key
+	if err := n.Start(peers); err != nil {
+		LogFatalln(err)
+		return
+	}
+	cluster = n
+
+	log.Printf("> [Cluster] node %s listen %s\n", n.Name, opts.ClusterAddr)
+	if logger != nil {
+		logger.Log(INFO, "cluster start", logrus.Fields{"node": n.Name, "listen": opts.ClusterAddr, "peers": peers})
+	}
+}
+
+func ClusterNodeName() string {
+	if opts.ClusterName != "" {
+		return opts.ClusterName
+	}
+	return host + ":" + opts.Port
+}
+
+func NotifyShutdown(retryAfter int) {
+	msg := NewShutdownMessage("shutdown", retryAfter)
+
+	n := 0
+	conns.Range(func(k interface{}, c interface{}) bool {
+		if SafeEmit(c.(*golem.Connection), "shutdown", &msg) {
+			n++
+		}
+		return true
+	})
+	sseClients.Range(func(c interface{}, v interface{}) bool {
+		c.(*SseClient).Shutdown(retryAfter)
+		n++
+		return true
+	})
+	if polls != nil {
+		polls.Stop()
+	}
+
+	log.Printf("> [Shutdown] notified %d connections\n", n)
+	if logger != nil {
+		logger.Log(INFO, "shutdown notified", logrus.Fields{"method": "shutdown", "connections": n, "retry_after": retryAfter})
+	}
+}
+
+func DrainConnections(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	flush := time.After(DRAIN_FLUSH_MSEC * time.Millisecond)
+
+	// wait for in-flight messages to be written or clients to leave
+wait:
+	for CountConnections() > 0 {
+		select {
+		case <-ctx.Done():
+			break wait
+		case <-flush:
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	n := 0
+	conns.Range(func(k interface{}, c interface{}) bool {
+		CloseConnection(c.(*golem.Connection), websocket.CloseGoingAway, "server shutdown")
+		conns.Delete(k)
+		n++
+		return true
+	})
+
+	log.Printf("> [Shutdown] closed %d connections\n", n)
+	if logger != nil {
+		logger.Log(INFO, "connections closed", logrus.Fields{"method": "shutdown", "connections": n})
+	}
+}
+
+func CheckReadiness() (map[string]bool, []string) {
+	checks := make(map[string]bool)
+	reasons := []string{}
+
+	if opts.UseStoreApi {
+		checks["store"] = kvsDB != nil
+		if !checks["store"] {
+			reasons = append(reasons, fmt.Sprintf("could not open \"%s\"", StoreDBPath()))
+		}
+	}
+
+	if opts.UseFileApi {
+		checks["file"] = IsExist(SERVE_FILES_DIR)
+		if !checks["file"] {
+			reasons = append(reasons, fmt.Sprintf("directory not found \"%s\"", SERVE_FILES_DIR))
+		}
+	}
+
+	checks["serving"] = !draining.Load()
+	if !checks["serving"] {
+		reasons = append(reasons, "server is draining")
+	}
+
+	return checks, reasons
+}
+
 func SecureSprintf(s string, ss string) string {
 	if opts.SecureMode {
 		return fmt.Sprintf(s, ss)
@@ -280,3 +777,39 @@ func SecureSprintf(s string, ss string) string {
 		return fmt.Sprintf(s, "")
 	}
 }
+
+func ProbeSprintf(s string, ss string) string {
+	if opts.SecureMode && !opts.OpenProbe {
+		return fmt.Sprintf(s, ss)
+	} else {
+		return fmt.Sprintf(s, "")
+	}
+}
+
+func StoreBackupDir() string {
+	if opts.StoreBkDir != "" {
+		return opts.StoreBkDir
+	}
+	return StoreDBPath() + ".backup"
+}
+
+func StoreImportBytes() int64 {
+	if opts.StoreImBytes > 0 {
+		return int64(opts.StoreImBytes)
+	}
+	return STORE_IMPORT_BYTES
+}
+
+func StoreImportRecords() int {
+	if opts.StoreImRecs > 0 {
+		return opts.StoreImRecs
+	}
+	return STORE_IMPORT_RECORDS
+}
+
+func StoreDBPath() string {
+	if opts.StoreDB != "" {
+		return opts.StoreDB
+	}
+	return DB_FILE
+}
@@ -21,7 +21,7 @@ func TestGenerateToken(t *testing.T) {
 	os.Setenv(ENV_SECRET, "SECRET")
 	t.Cleanup(func() { os.Unsetenv(ENV_SECRET) })
 
-	opts = Options{GenToken: true}
+	SetOptions(Options{GenToken: true})
 	s := ReadFmtPrintOut(t, Prepare)
 
 	require.Contains(t, s, "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.")
@@ -37,9 +37,9 @@ func TestGenerateTokenEmpty(t *testing.T) {
 	// log.Fatalln() mock for test
 	fatal := LogFatalln
 	t.Cleanup(func() { LogFatalln = fatal })
-	LogFatalln = func(v ...any) { log.Println(v) }
+	LogFatalln = func(v ...any) { log.Println(v...) }
 
-	opts = Options{GenToken: true}
+	SetOptions(Options{GenToken: true})
 	os.Setenv(ENV_SECRET, "")
 	t.Cleanup(func() { os.Unsetenv(ENV_SECRET) })
 
@@ -47,7 +47,7 @@ func TestGenerateTokenEmpty(t *testing.T) {
 }
 
 func TestPrintInfo(t *testing.T) {
-	opts = Options{}
+	SetOptions(Options{})
 	Prepare()
 
 	s := ReadFmtPrintOut(t, func() {
@@ -69,22 +69,37 @@ websocket server start... ws://%s:/postman
 <- "unsubscribe {"ch":"CHANNEL"}"
 [Publish]
 <- "publish {"ch":"CHANNEL","msg":"MESSAGE",["tag":"TAG","ext":"OTHER"]}"
+[Schedule]
+<- "schedule {"cmd":"(ADD|LIST|CANCEL)",["ch":"CHANNEL","msg":"MESSAGE","delay":"SEC"|"at":"RFC3339"|"cron":"CRON","id":"ID"]}"
 
 === Http API ===
 http://%s:/postman
 [Status]
 (GET) /status
 (GET) /status_pp
+[Metrics]
+(GET) /metrics
+[Health]
+(GET) /healthz
+(GET) /readyz
 [Publish]
 (GET) /publish?ch=CHANNEL&msg=MESSAGE[&tag=TAG&ext=OTHER&ci=CLIENT_INFO]
 (POST) /publish <- json={"ch":"CHANNEL","msg":"MESSAGE",["tag":"TAG","ext":"OTHER","ci":"CLIENT_INFO"]}
+[Subscribe]
+(GET) /sse?ch=CHANNEL[,CHANNEL][&ci=CLIENT_INFO]
+(GET) /poll/subscribe?ch=CHANNEL[,CHANNEL][&ci=CLIENT_INFO]
+(GET) /poll?id=ID[&timeout=SEC]
+(GET) /poll/unsubscribe?id=ID
+[Schedule]
+(GET) /schedule?cmd=ADD&ch=CHANNEL&msg=MESSAGE[&tag=TAG&ext=OTHER](&delay=SEC|&at=RFC3339|&cron=CRON)
+(GET) /schedule?cmd=(LIST|CANCEL)[&id=ID]
 ===================================================`, VERSION, GetHostIP(), GetHostIP())
 
 	require.Equal(t, s, out)
 }
 
 func TestSecurePrintInfo(t *testing.T) {
-	opts = Options{SecureMode: true, UseStoreApi: true, UseFileApi: true, UsePluginApi: true}
+	SetOptions(Options{SecureMode: true, UseStoreApi: true, UseFileApi: true, UsePluginApi: true})
 	Prepare()
 
 	s := ReadFmtPrintOut(t, func() {
@@ -106,21 +121,49 @@ websocket server start... ws://%s:/postman?tkn=TOKEN
 <- "unsubscribe {"ch":"CHANNEL"}"
 [Publish]
 <- "publish {"ch":"CHANNEL","msg":"MESSAGE",["tag":"TAG","ext":"OTHER"]}"
+[Schedule]
+<- "schedule {"cmd":"(ADD|LIST|CANCEL)",["ch":"CHANNEL","msg":"MESSAGE","delay":"SEC"|"at":"RFC3339"|"cron":"CRON","id":"ID"]}"
+[Store]
+<- "store {"id":"ID","cmd":"(GET|SET|HAS|DEL|...)","key":"KEY",["val":"VALUE"]}" -> "store {"id":"ID","result":"RESULT"}"
 
 === Http API ===
 http://%s:/postman
 [Status]
 (GET) /status?tkn=TOKEN
 (GET) /status_pp?tkn=TOKEN
+[Metrics]
+(GET) /metrics?tkn=TOKEN
+[Health]
+(GET) /healthz?tkn=TOKEN
+(GET) /readyz?tkn=TOKEN
 [Publish]
 (GET) /publish?ch=CHANNEL&msg=MESSAGE[&tag=TAG&ext=OTHER&ci=CLIENT_INFO]&tkn=TOKEN
 (POST) /publish <- json={"ch":"CHANNEL","msg":"MESSAGE",["tag":"TAG","ext":"OTHER","ci":"CLIENT_INFO"],"tkn":"TOKEN"}
+[Subscribe]
+(GET) /sse?ch=CHANNEL[,CHANNEL][&ci=CLIENT_INFO]&tkn=TOKEN
+(GET) /poll/subscribe?ch=CHANNEL[,CHANNEL][&ci=CLIENT_INFO]&tkn=TOKEN
+(GET) /poll?id=ID[&timeout=SEC]&tkn=TOKEN
+(GET) /poll/unsubscribe?id=ID&tkn=TOKEN
+[Schedule]
+(GET) /schedule?cmd=ADD&ch=CHANNEL&msg=MESSAGE[&tag=TAG&ext=OTHER](&delay=SEC|&at=RFC3339|&cron=CRON)&tkn=TOKEN
+(GET) /schedule?cmd=(LIST|CANCEL)[&id=ID]&tkn=TOKEN
 [Store]
-(GET) /store?cmd=(GET|SET|HAS|DEL)&key=KEY[&val=VALUE]&tkn=TOKEN
-(POST) /store <- json={"cmd":"(GET|SET|HAS|DEL)","key":"KEY",["val":"VALUE"],"tkn":"TOKEN"}
+(GET) /store?cmd=(GET|SET|HAS|DEL)&key=KEY[&val=VALUE&ttl=SEC]&tkn=TOKEN
+(POST) /store <- json={"cmd":"(GET|SET|HAS|DEL)","key":"KEY",["val":"VALUE","ttl":SEC],"tkn":"TOKEN"}
+(GET) /store?cmd=(KEYS|SCAN)[&prefix=PREFIX&start=KEY&end=KEY&limit=N&cursor=CURSOR]&tkn=TOKEN
+(GET) /store?cmd=(TTL|EXPIRE)&key=KEY[&ttl=SEC]&tkn=TOKEN
+(GET) /store?cmd=(CAS|INCR|DECR)&key=KEY[&old=VALUE&val=VALUE]&tkn=TOKEN
+(POST) /store <- json={"cmd":"BATCH","ops":[{"cmd":"(SET|DEL)","key":"KEY",["val":"VALUE"]}],"tkn":"TOKEN"}
+(GET) /store?cmd=(JGET|JSET|JMERGE|JAPPEND)&key=KEY[&path=JSON_POINTER&val=JSON]&tkn=TOKEN
+(GET) /store?cmd=DROP&ns=NAMESPACE&tkn=TOKEN
+(GET) /store?cmd=(SNAPSHOT|EXPORT|BACKUP|BACKUPS|RESTORE)[&ns=NAMESPACE&name=BACKUP]&tkn=TOKEN
+(POST) /store?cmd=IMPORT[&ns=NAMESPACE]&tkn=TOKEN <- JSON_LINES
 [File]
-(GET) /file/FILE_NAME?tkn=TOKEN
-(POST) /file <- file=FILE_BINARY json={"tkn":"TOKEN"}
+(GET|HEAD) /file/FILE_NAME?tkn=TOKEN
+(HEAD) /file/FILE_NAME?hash=1&tkn=TOKEN
+(POST) /file <- file=FILE_BINARY [path=DIR] json={"tkn":"TOKEN"}
+(GET) /file?cmd=(LIST|STAT)[&path=PATH&hash=1]&tkn=TOKEN
+(POST) /file?cmd=(MKDIR|DEL|MOVE)&path=PATH[&to=PATH]&tkn=TOKEN
 [Plugin]
 (GET) /plugin?cmd=COMMAND&tkn=TOKEN
 (POST) /plugin <- json={"cmd":COMMAND,"tkn":"TOKEN"}
@@ -135,7 +178,7 @@ func TestDontStartMultipleInstance(t *testing.T) {
 	t.Cleanup(func() { OsExit = exit })
 	OsExit = func(code int) {}
 
-	opts = Options{Port: "8800"}
+	SetOptions(Options{Port: "8800"})
 	l, _ := net.Listen("tcp", ":"+opts.Port)
 	t.Cleanup(func() { l.Close() })
 
@@ -151,9 +194,9 @@ func TestStartAndShutdownServer(t *testing.T) {
 	// log.Fatalln() mock for test
 	fatal := LogFatalln
 	t.Cleanup(func() { LogFatalln = fatal })
-	LogFatalln = func(v ...any) { fmt.Println(v) }
+	LogFatalln = func(v ...any) { fmt.Println(v...) }
 
-	opts = Options{}
+	SetOptions(Options{})
 	Prepare()
 
 	require.Nil(t, srv)
@@ -166,6 +209,40 @@ func TestStartAndShutdownServer(t *testing.T) {
 	require.Contains(t, s, "Server closed")
 }
 
+func TestGracefulShutdownGrace(t *testing.T) {
+	SetOptions(Options{DrainGrace: 1, DrainTimeout: 1})
+	Prepare()
+	t.Cleanup(func() { draining.Store(false) })
+
+	listening := srv
+	srv = nil
+	t.Cleanup(func() { srv = listening })
+
+	done := make(chan bool)
+	go func() {
+		GracefulShutdown()
+		close(done)
+	}()
+
+	time.Sleep(300 * time.Millisecond) // wait
+
+	// readiness reports draining before the listener is closed
+	_, reasons := CheckReadiness()
+
+	require.Contains(t, reasons, "server is draining")
+	select {
+	case <-done:
+		require.Fail(t, "shutdown without the grace period")
+	default:
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		require.Fail(t, "shutdown timeout")
+	}
+}
+
 func TestBrokenDB(t *testing.T) {
 	os.Rename(DB_FILE, DB_FILE+"_")
 	t.Cleanup(func() {
@@ -173,7 +250,7 @@ func TestBrokenDB(t *testing.T) {
 		os.Rename(DB_FILE+"_", DB_FILE)
 	})
 
-	opts = Options{UseStoreApi: true}
+	SetOptions(Options{UseStoreApi: true})
 	Prepare()
 
 	// break postman.db
@@ -182,7 +259,7 @@ func TestBrokenDB(t *testing.T) {
 	s := ReadLogPrintOut(t, Prepare)
 
 	require.Contains(t, s, `could not open "postman.db"`)
-	require.Contains(t, s, `recreated "postman.db"`)
+	require.Contains(t, s, `recovered "postman.db"`)
 	require.NotNil(t, kvsDB)
 }
 
@@ -193,8 +270,57 @@ func TestServeFiles(t *testing.T) {
 		os.Rename(SERVE_FILES_DIR+"_", SERVE_FILES_DIR)
 	})
 
-	opts = Options{UseFileApi: true}
+	SetOptions(Options{UseFileApi: true})
 	Prepare()
 
 	require.True(t, IsExist(SERVE_FILES_DIR))
 }
+
+func TestPaasProfile(t *testing.T) {
+	os.Setenv(ENV_CHLIST, "TEST_CH1,TEST_CH2")
+	os.Setenv(ENV_IPLIST, "192.168.0.1")
+	t.Cleanup(func() {
+		os.Unsetenv(ENV_CHLIST)
+		os.Unsetenv(ENV_IPLIST)
+	})
+
+	SetOptions(Options{Profile: PROFILE_PAAS, UseStoreApi: true, UseFileApi: true, UsePluginApi: true, LogDir: "./log"})
+	Prepare()
+
+	require.Equal(t, profile.Name, PROFILE_PAAS)
+	require.Equal(t, safeList, []string{"TEST_CH1", "TEST_CH2"})
+	require.Equal(t, ipList, []string{"192.168.0.1"})
+	require.False(t, opts.UseStoreApi)
+	require.False(t, opts.UseFileApi)
+	require.False(t, opts.UsePluginApi)
+}
+
+func TestProfileFromEnv(t *testing.T) {
+	os.Setenv(ENV_PROFILE, "PaaS")
+	t.Cleanup(func() { os.Unsetenv(ENV_PROFILE) })
+
+	p, err := NewProfile("")
+
+	require.NoError(t, err)
+	require.Equal(t, p.Name, PROFILE_PAAS)
+	require.True(t, p.MaskIPAddress)
+
+	// option flag is prior to environment variable
+	p, err = NewProfile(PROFILE_STANDALONE)
+
+	require.NoError(t, err)
+	require.Equal(t, p.Name, PROFILE_STANDALONE)
+	require.False(t, p.MaskIPAddress)
+}
+
+func TestUnknownProfile(t *testing.T) {
+	// log.Fatalln() mock for test
+	fatal := LogFatalln
+	t.Cleanup(func() { LogFatalln = fatal })
+	LogFatalln = func(v ...any) { log.Println(v...) }
+
+	SetOptions(Options{Profile: "unknown"})
+	RequireContainsStdLog(t, Prepare, "unknown profile [unknown]", 0)
+
+	require.Equal(t, profile.Name, PROFILE_STANDALONE)
+}
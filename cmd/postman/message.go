@@ -1,9 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-
-	"github.com/sharkattack51/golem"
+	"time"
 )
 
 //
@@ -36,10 +36,11 @@ func NewSecureMessage(token string, tkn string) *SecureMessage {
 //
 
 type SubscribeMessage struct {
-	RawChannel    string `json:"channel"`
-	RawCh         string `json:"ch"`
-	RawClientInfo string `json:"client_info"`
-	RawCi         string `json:"ci"`
+	RawChannel    string           `json:"channel"`
+	RawCh         string           `json:"ch"`
+	RawClientInfo string           `json:"client_info"`
+	RawCi         string           `json:"ci"`
+	Filter        *SubscribeFilter `json:"filter"`
 }
 
 func (m *SubscribeMessage) Channel() string {
@@ -130,6 +131,10 @@ type PublishSendMessage struct {
 	Message   string `json:"message"`
 	Tag       string `json:"tag"`
 	Extention string `json:"extention"`
+
+	id     uint64   // sequence number in this postman
+	origin string   // gateway which the message came from
+	route  []string // channels passed by routing rules
 }
 
 func NewPublishSendMessage(channel string, message string, tag string, extention string) *PublishSendMessage {
@@ -166,43 +171,131 @@ func (msg *PublishMessage) BuildLogString() string {
 //
 
 type StatusMessage struct {
-	Version  string              `json:"version"`
-	Channels map[string][]string `json:"channels"`
+	Version  string                         `json:"version"`
+	Channels map[string][]string            `json:"channels"`
+	Node     string                         `json:"node,omitempty"`
+	Nodes    map[string]map[string][]string `json:"nodes,omitempty"`
+}
+
+func NewStatusMessage(b Broker) *StatusMessage {
+	msg := &StatusMessage{
+		Version:  VERSION,
+		Channels: LocalChannels(b),
+	}
+
+	if cluster != nil {
+		msg.Node = cluster.Name
+		msg.Nodes = cluster.Nodes()
+	}
+	return msg
 }
 
-func NewStatusMessage(rm *golem.RoomManager) *StatusMessage {
+func LocalChannels(b Broker) map[string][]string {
 	channels := make(map[string][]string)
 
-	if rm != nil {
-		for i, ri := range rm.GetRoomInfos() {
+	if b != nil {
+		i := 0
+		for ch, members := range b.Rooms() {
 			remoteAddrs := []string{}
-			for _, c := range ri.Room.GetMembers() {
+			for _, c := range members {
 				remoteAddr := c.GetSocket().RemoteAddr().String()
-				infoAtRemote := ""
-				if info, exist := cliInfos.Load(remoteAddr); exist {
-					if TARGET_PAAS {
-						infoAtRemote = info.(string)
-					} else {
-						infoAtRemote = info.(string) + "@" + remoteAddr
-					}
-				} else {
-					if TARGET_PAAS {
-						// mask ip address
-						infoAtRemote = fmt.Sprintf("conn_%d", i)
-					} else {
-						infoAtRemote = remoteAddr
-					}
+				info := ""
+				if v, exist := cliInfos.Load(remoteAddr); exist {
+					info = v.(string)
 				}
 
-				remoteAddrs = append(remoteAddrs, infoAtRemote)
+				remoteAddrs = append(remoteAddrs, ClientLabel(info, remoteAddr, i))
+			}
+			channels[ch] = remoteAddrs
+			i++
+		}
+
+		// other protocols than websocket
+		for ch, subs := range b.Subscribers() {
+			for _, s := range subs {
+				channels[ch] = append(channels[ch], ClientLabel(s.Info(), s.RemoteAddr(), i))
+				i++
 			}
-			channels[ri.Topic] = remoteAddrs
 		}
 	}
 
-	msg := &StatusMessage{
-		Version:  VERSION,
-		Channels: channels,
+	return channels
+}
+
+func ClientLabel(info string, remoteAddr string, i int) string {
+	if info != "" {
+		if profile != nil && profile.MaskIPAddress {
+			return info
+		}
+		return info + "@" + remoteAddr
+	}
+
+	if profile != nil && profile.MaskIPAddress {
+		// mask ip address
+		return fmt.Sprintf("conn_%d", i)
+	}
+	return remoteAddr
+}
+
+//
+// Health
+//
+
+type ReadinessMessage struct {
+	Result string          `json:"result"`
+	Error  string          `json:"error"`
+	Checks map[string]bool `json:"checks"`
+}
+
+func NewReadinessMessage(result string, err string, checks map[string]bool) *ReadinessMessage {
+	msg := &ReadinessMessage{
+		Result: result,
+		Error:  err,
+		Checks: checks,
+	}
+	return msg
+}
+
+//
+// Shutdown
+//
+
+type ShutdownMessage struct {
+	Reason     string `json:"reason"`
+	Reconnect  bool   `json:"reconnect"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+func NewShutdownMessage(reason string, retryAfter int) *ShutdownMessage {
+	msg := &ShutdownMessage{
+		Reason:     reason,
+		Reconnect:  true,
+		RetryAfter: retryAfter,
+	}
+	return msg
+}
+
+//
+// Poll
+//
+
+type PollMessage struct {
+	Result   string                `json:"result"`
+	Error    string                `json:"error"`
+	Id       string                `json:"id,omitempty"`
+	Messages []*PublishSendMessage `json:"messages"`
+}
+
+func NewPollMessage(result string, err string, id string, messages []*PublishSendMessage) *PollMessage {
+	if messages == nil {
+		messages = []*PublishSendMessage{}
+	}
+
+	msg := &PollMessage{
+		Result:   result,
+		Error:    err,
+		Id:       id,
+		Messages: messages,
 	}
 	return msg
 }
@@ -212,11 +305,31 @@ func NewStatusMessage(rm *golem.RoomManager) *StatusMessage {
 //
 
 type StoreMessage struct {
+	Id         string `json:"id"` // request id for websocket
 	RawCommand string `json:"command"`
 	RawCmd     string `json:"cmd"`
 	RawKey     string `json:"key"`
 	RawValue   string `json:"value"`
 	RawVal     string `json:"val"`
+	Ttl        int    `json:"ttl"` // seconds
+	Ns         string `json:"ns"`  // namespace, empty is the default
+
+	// KEYS and SCAN
+	Prefix string `json:"prefix"`
+	Start  string `json:"start"`
+	End    string `json:"end"`
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor"`
+
+	// BATCH and CAS
+	Ops []*StoreMessage `json:"ops"`
+	Old *string         `json:"old"`
+
+	// RESTORE
+	Name string `json:"name"` // file name of the backup
+
+	// JGET, JSET, JMERGE and JAPPEND
+	Path string `json:"path"` // JSON pointer, empty is the whole document
 }
 
 func (m *StoreMessage) Command() string {
@@ -231,6 +344,11 @@ func (m *StoreMessage) Key() string {
 	return m.RawKey
 }
 
+// DbKey is the key in the db with the namespace.
+func (m *StoreMessage) DbKey() string {
+	return storeNsKey(m.Ns, m.Key())
+}
+
 func (m *StoreMessage) Value() string {
 	if m.RawValue != "" {
 		return m.RawValue
@@ -250,6 +368,168 @@ func NewStoreMessage(command string, cmd string, key string, value string, val s
 	return msg
 }
 
+type StoreItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type StoreKeysMessage struct {
+	Result string   `json:"result"`
+	Error  string   `json:"error"`
+	Keys   []string `json:"keys"`
+	Cursor string   `json:"cursor"` // empty at the end
+}
+
+func NewStoreKeysMessage(result string, err string, keys []string, cursor string) *StoreKeysMessage {
+	msg := &StoreKeysMessage{
+		Result: result,
+		Error:  err,
+		Keys:   keys,
+		Cursor: cursor,
+	}
+	return msg
+}
+
+type StoreScanMessage struct {
+	Result string       `json:"result"`
+	Error  string       `json:"error"`
+	Items  []*StoreItem `json:"items"`
+	Cursor string       `json:"cursor"` // empty at the end
+}
+
+func NewStoreScanMessage(result string, err string, items []*StoreItem, cursor string) *StoreScanMessage {
+	msg := &StoreScanMessage{
+		Result: result,
+		Error:  err,
+		Items:  items,
+		Cursor: cursor,
+	}
+	return msg
+}
+
+// StoreJsonMessage has the JSON value as it is, not a string.
+type StoreJsonMessage struct {
+	Result string          `json:"result"`
+	Error  string          `json:"error"`
+	Value  json.RawMessage `json:"value"`
+}
+
+func NewStoreJsonMessage(result string, err string, value json.RawMessage) *StoreJsonMessage {
+	msg := &StoreJsonMessage{
+		Result: result,
+		Error:  err,
+		Value:  value,
+	}
+	return msg
+}
+
+// StoreRecord is a line of export and backup in JSON lines.
+type StoreRecord struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Ttl      int    `json:"ttl,omitempty"`      // remaining seconds
+	Encoding string `json:"encoding,omitempty"` // "base64" for binary key or value
+}
+
+// StoreResultMessage is the store event for websocket, and it has the request id.
+type StoreResultMessage struct {
+	Id     string          `json:"id"`
+	Result string          `json:"result"`
+	Error  string          `json:"error"`
+	Keys   []string        `json:"keys,omitempty"`
+	Items  []*StoreItem    `json:"items,omitempty"`
+	Cursor string          `json:"cursor,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+func NewStoreResultMessage(id string, res interface{}) *StoreResultMessage {
+	msg := &StoreResultMessage{Id: id}
+	switch r := res.(type) {
+	case *ResultMessage:
+		msg.Result, msg.Error = r.Result, r.Error
+	case *StoreKeysMessage:
+		msg.Result, msg.Error, msg.Keys, msg.Cursor = r.Result, r.Error, r.Keys, r.Cursor
+	case *StoreScanMessage:
+		msg.Result, msg.Error, msg.Items, msg.Cursor = r.Result, r.Error, r.Items, r.Cursor
+	case *StoreJsonMessage:
+		msg.Result, msg.Error, msg.Value = r.Result, r.Error, r.Value
+	}
+	return msg
+}
+
+//
+// Schedule
+//
+
+type ScheduleMessage struct {
+	RawCommand   string `json:"command"`
+	RawCmd       string `json:"cmd"`
+	Id           string `json:"id"`
+	RawChannel   string `json:"channel"`
+	RawCh        string `json:"ch"`
+	RawMessage   string `json:"message"`
+	RawMsg       string `json:"msg"`
+	RawTag       string `json:"tag"`
+	RawExtention string `json:"extention"`
+	RawExt       string `json:"ext"`
+	Delay        string `json:"delay"` // seconds
+	At           string `json:"at"`    // RFC3339
+	Cron         string `json:"cron"`
+}
+
+func (m *ScheduleMessage) Command() string {
+	if m.RawCommand != "" {
+		return m.RawCommand
+	} else {
+		return m.RawCmd
+	}
+}
+
+func (m *ScheduleMessage) Channel() string {
+	if m.RawChannel != "" {
+		return m.RawChannel
+	} else {
+		return m.RawCh
+	}
+}
+
+func (m *ScheduleMessage) Message() string {
+	if m.RawMessage != "" {
+		return m.RawMessage
+	} else {
+		return m.RawMsg
+	}
+}
+
+func (m *ScheduleMessage) Tag() string {
+	return m.RawTag
+}
+
+func (m *ScheduleMessage) Extention() string {
+	if m.RawExtention != "" {
+		return m.RawExtention
+	} else {
+		return m.RawExt
+	}
+}
+
+type ScheduleResultMessage struct {
+	Result    string              `json:"result"`
+	Error     string              `json:"error"`
+	Id        string              `json:"id,omitempty"`
+	Schedules []*ScheduledMessage `json:"schedules,omitempty"`
+}
+
+func NewScheduleResultMessage(result string, err string, id string, schedules []*ScheduledMessage) *ScheduleResultMessage {
+	msg := &ScheduleResultMessage{
+		Result:    result,
+		Error:     err,
+		Id:        id,
+		Schedules: schedules,
+	}
+	return msg
+}
+
 //
 // Result
 //
@@ -267,6 +547,77 @@ func NewResultMessage(result string, err string) *ResultMessage {
 	return msg
 }
 
+//
+// File
+//
+
+type FileMessage struct {
+	RawCommand string `json:"command"`
+	RawCmd     string `json:"cmd"`
+	Path       string `json:"path"` // slash separated in serve_files, empty is the top
+	To         string `json:"to"`   // MOVE
+	Hash       bool   `json:"hash"` // LIST and STAT with sha256 of files
+}
+
+func (m *FileMessage) Command() string {
+	if m.RawCommand != "" {
+		return m.RawCommand
+	} else {
+		return m.RawCmd
+	}
+}
+
+func NewFileMessage(command string, cmd string, path string, to string, hash bool) *FileMessage {
+	msg := &FileMessage{
+		RawCommand: command,
+		RawCmd:     cmd,
+		Path:       path,
+		To:         to,
+		Hash:       hash,
+	}
+	return msg
+}
+
+type FileInfo struct {
+	Name  string    `json:"name"`
+	Path  string    `json:"path"`
+	Dir   bool      `json:"dir"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	Type  string    `json:"type,omitempty"` // content type
+	Hash  string    `json:"hash,omitempty"` // sha256 in hex
+}
+
+type FileListMessage struct {
+	Result string      `json:"result"`
+	Error  string      `json:"error"`
+	Files  []*FileInfo `json:"files"`
+}
+
+func NewFileListMessage(result string, err string, files []*FileInfo) *FileListMessage {
+	msg := &FileListMessage{
+		Result: result,
+		Error:  err,
+		Files:  files,
+	}
+	return msg
+}
+
+type FileStatMessage struct {
+	Result string    `json:"result"`
+	Error  string    `json:"error"`
+	File   *FileInfo `json:"file"`
+}
+
+func NewFileStatMessage(result string, err string, file *FileInfo) *FileStatMessage {
+	msg := &FileStatMessage{
+		Result: result,
+		Error:  err,
+		File:   file,
+	}
+	return msg
+}
+
 //
 // Plugin
 //
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	METRICS_CHANNEL_LABELS = 256     // distinct channel labels, and the rest are counted in "other"
+	METRICS_OTHER_LABEL    = "other" // channel label over METRICS_CHANNEL_LABELS
+	METRICS_UNKNOWN_LABEL  = "unknown"
+)
+
+var pluginDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// storeCommands are the command labels of store operations, and the others are "unknown".
+var storeCommands = []string{
+	"get", "set", "has", "del", "ttl", "expire", "batch", "cas", "incr", "decr", "keys", "scan",
+	"jget", "jset", "jmerge", "jappend", "drop", "snapshot", "export", "import", "backup", "backups", "restore",
+}
+
+//
+// Counter
+//
+
+type CounterVec struct {
+	values sync.Map // map[string]*int64
+}
+
+func (c *CounterVec) Add(label string, n int64) {
+	if v, ok := c.values.Load(label); ok {
+		atomic.AddInt64(v.(*int64), n)
+		return
+	}
+
+	v, _ := c.values.LoadOrStore(label, new(int64))
+	atomic.AddInt64(v.(*int64), n)
+}
+
+func (c *CounterVec) Snapshot() map[string]int64 {
+	snap := make(map[string]int64)
+	c.values.Range(func(k interface{}, v interface{}) bool {
+		snap[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	return snap
+}
+
+//
+// Histogram
+//
+
+type Histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram() *Histogram {
+	h := &Histogram{
+		counts: make([]uint64, len(pluginDurationBuckets)),
+	}
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range pluginDurationBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+//
+// Metrics
+//
+
+type Metrics struct {
+	connectionsTotal int64
+	receivedBytes    int64
+	sentBytes        int64
+	authFailures     int64
+	ipBlocks         int64
+
+	publishes  CounterVec
+	deliveries CounterVec
+	storeOps   CounterVec
+	dropped    CounterVec
+
+	pluginMu        sync.Mutex
+	pluginDurations map[string]*Histogram
+
+	labelMu  sync.Mutex
+	channels map[string]bool // channel labels up to METRICS_CHANNEL_LABELS
+
+	subMu       sync.RWMutex
+	subscribed  map[interface{}]map[string]bool // websocket connection or Subscriber
+	subscribers map[string]int
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		pluginDurations: make(map[string]*Histogram),
+		channels:        make(map[string]bool),
+		subscribed:      make(map[interface{}]map[string]bool),
+		subscribers:     make(map[string]int),
+	}
+	return m
+}
+
+func (m *Metrics) Connected() {
+	atomic.AddInt64(&m.connectionsTotal, 1)
+}
+
+func (m *Metrics) AuthFailed() {
+	atomic.AddInt64(&m.authFailures, 1)
+}
+
+func (m *Metrics) IpBlocked() {
+	atomic.AddInt64(&m.ipBlocks, 1)
+}
+
+func (m *Metrics) Received(pmsg *PublishSendMessage) {
+	m.publishes.Add(m.channelLabel(pmsg.Channel), 1)
+	atomic.AddInt64(&m.receivedBytes, int64(PayloadSize(pmsg)))
+}
+
+// Delivered counts the messages sent to n subscribers of the channel.
+func (m *Metrics) Delivered(ch string, pmsg *PublishSendMessage, n int) {
+	if n == 0 {
+		return
+	}
+
+	m.deliveries.Add(m.channelLabel(ch), int64(n))
+	atomic.AddInt64(&m.sentBytes, int64(n*PayloadSize(pmsg)))
+}
+
+func (m *Metrics) Dropped(reason string) {
+	m.dropped.Add(reason, 1)
+}
+
+func (m *Metrics) StoreOp(cmd string) {
+	label := strings.ToLower(cmd)
+	if !slices.Contains(storeCommands, label) {
+		label = METRICS_UNKNOWN_LABEL
+	}
+	m.storeOps.Add(label, 1)
+}
+
+func (m *Metrics) PluginExecuted(cmd string, d time.Duration) {
+	m.pluginMu.Lock()
+	h, ok := m.pluginDurations[cmd]
+	if !ok {
+		h = NewHistogram()
+		m.pluginDurations[cmd] = h
+	}
+	m.pluginMu.Unlock()
+
+	h.Observe(d.Seconds())
+}
+
+func (m *Metrics) Subscribed(conn interface{}, ch string) {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	chs, ok := m.subscribed[conn]
+	if !ok {
+		chs = make(map[string]bool)
+		m.subscribed[conn] = chs
+	}
+	if !chs[ch] {
+		chs[ch] = true
+		m.subscribers[ch]++
+	}
+}
+
+func (m *Metrics) Unsubscribed(conn interface{}, ch string) {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	if chs, ok := m.subscribed[conn]; ok && chs[ch] {
+		delete(chs, ch)
+		m.leave(ch)
+	}
+}
+
+func (m *Metrics) Closed(conn interface{}) {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	if chs, ok := m.subscribed[conn]; ok {
+		for ch := range chs {
+			m.leave(ch)
+		}
+		delete(m.subscribed, conn)
+	}
+}
+
+// channelLabel keeps the number of channel labels, as channels are named by clients.
+func (m *Metrics) channelLabel(ch string) string {
+	m.labelMu.Lock()
+	defer m.labelMu.Unlock()
+
+	if m.channels[ch] {
+		return ch
+	}
+	if len(m.channels) >= METRICS_CHANNEL_LABELS {
+		return METRICS_OTHER_LABEL
+	}
+	m.channels[ch] = true
+	return ch
+}
+
+func (m *Metrics) leave(ch string) {
+	m.subscribers[ch]--
+	if m.subscribers[ch] <= 0 {
+		delete(m.subscribers, ch)
+	}
+}
+
+// Expose writes all metrics as prometheus text exposition format.
+func (m *Metrics) Expose(w io.Writer) {
+	connections := CountConnections()
+	writeMetricHeader(w, "postman_connections", "gauge", "Current websocket connections.")
+	fmt.Fprintf(w, "postman_connections %d\n", connections)
+
+	writeMetricHeader(w, "postman_connections_total", "counter", "Accepted websocket connections.")
+	fmt.Fprintf(w, "postman_connections_total %d\n", atomic.LoadInt64(&m.connectionsTotal))
+
+	m.subMu.RLock()
+	subs := make(map[string]int64)
+	for ch, n := range m.subscribers {
+		subs[m.channelLabel(ch)] += int64(n)
+	}
+	m.subMu.RUnlock()
+	writeMetricHeader(w, "postman_subscriptions", "gauge", "Current subscribers per channel.")
+	writeLabeledValues(w, "postman_subscriptions", "channel", subs)
+
+	writeMetricHeader(w, "postman_publish_total", "counter", "Published messages per channel.")
+	writeLabeledValues(w, "postman_publish_total", "channel", m.publishes.Snapshot())
+
+	writeMetricHeader(w, "postman_deliveries_total", "counter", "Messages delivered to subscribers per channel.")
+	writeLabeledValues(w, "postman_deliveries_total", "channel", m.deliveries.Snapshot())
+
+	writeMetricHeader(w, "postman_received_bytes_total", "counter", "Payload bytes of published messages.")
+	fmt.Fprintf(w, "postman_received_bytes_total %d\n", atomic.LoadInt64(&m.receivedBytes))
+
+	writeMetricHeader(w, "postman_sent_bytes_total", "counter", "Payload bytes of delivered messages.")
+	fmt.Fprintf(w, "postman_sent_bytes_total %d\n", atomic.LoadInt64(&m.sentBytes))
+
+	writeMetricHeader(w, "postman_auth_failures_total", "counter", "Failed token authentications.")
+	fmt.Fprintf(w, "postman_auth_failures_total %d\n", atomic.LoadInt64(&m.authFailures))
+
+	writeMetricHeader(w, "postman_ip_blocked_total", "counter", "Requests blocked by ip list.")
+	fmt.Fprintf(w, "postman_ip_blocked_total %d\n", atomic.LoadInt64(&m.ipBlocks))
+
+	writeMetricHeader(w, "postman_store_operations_total", "counter", "Key-value store operations per command.")
+	writeLabeledValues(w, "postman_store_operations_total", "command", m.storeOps.Snapshot())
+
+	writeMetricHeader(w, "postman_messages_dropped_total", "counter", "Messages not delivered per reason.")
+	writeLabeledValues(w, "postman_messages_dropped_total", "reason", m.dropped.Snapshot())
+
+	writeMetricHeader(w, "postman_plugin_duration_seconds", "histogram", "Plugin execution time per command.")
+	m.pluginMu.Lock()
+	cmds := []string{}
+	for cmd := range m.pluginDurations {
+		cmds = append(cmds, cmd)
+	}
+	m.pluginMu.Unlock()
+	sort.Strings(cmds)
+	for _, cmd := range cmds {
+		m.pluginMu.Lock()
+		h := m.pluginDurations[cmd]
+		m.pluginMu.Unlock()
+
+		h.mu.Lock()
+		l := escapeLabel(cmd)
+		for i, b := range pluginDurationBuckets {
+			fmt.Fprintf(w, "postman_plugin_duration_seconds_bucket{plugin=\"%s\",le=\"%s\"} %d\n", l, formatFloat(b), h.counts[i])
+		}
+		fmt.Fprintf(w, "postman_plugin_duration_seconds_bucket{plugin=\"%s\",le=\"+Inf\"} %d\n", l, h.count)
+		fmt.Fprintf(w, "postman_plugin_duration_seconds_sum{plugin=\"%s\"} %s\n", l, formatFloat(h.sum))
+		fmt.Fprintf(w, "postman_plugin_duration_seconds_count{plugin=\"%s\"} %d\n", l, h.count)
+		h.mu.Unlock()
+	}
+}
+
+func PayloadSize(pmsg *PublishSendMessage) int {
+	return len(pmsg.Channel) + len(pmsg.Message) + len(pmsg.Tag) + len(pmsg.Extention)
+}
+
+func writeMetricHeader(w io.Writer, name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func writeLabeledValues(w io.Writer, name string, label string, values map[string]int64) {
+	keys := []string{}
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(k), values[k])
+	}
+}
+
+func escapeLabel(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return s
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	MQTT_CONNECT     = 1
+	MQTT_CONNACK     = 2
+	MQTT_PUBLISH     = 3
+	MQTT_PUBACK      = 4
+	MQTT_SUBSCRIBE   = 8
+	MQTT_SUBACK      = 9
+	MQTT_UNSUBSCRIBE = 10
+	MQTT_UNSUBACK    = 11
+	MQTT_PINGREQ     = 12
+	MQTT_PINGRESP    = 13
+	MQTT_DISCONNECT  = 14
+
+	// connack return codes
+	MQTT_ACCEPTED           = 0x00
+	MQTT_BAD_PROTOCOL       = 0x01
+	MQTT_UNAVAILABLE        = 0x03
+	MQTT_BAD_AUTHENTICATION = 0x04
+	MQTT_NOT_AUTHORIZED     = 0x05
+
+	MQTT_SUBACK_FAILURE = 0x80
+
+	MQTT_CONNECT_SEC = 10
+	MQTT_MAX_PACKET  = 1 << 20
+	MQTT_SEND_BUFFER = 512
+)
+
+//
+// Server
+//
+
+type MqttServer struct {
+	addr     string
+	listener net.Listener
+
+	mu      sync.Mutex
+	conns   map[net.Conn]bool
+	stopped bool
+
+	wg       sync.WaitGroup // accept loop and connections
+	stopOnce sync.Once
+}
+
+func NewMqttServer(addr string) *MqttServer {
+	s := &MqttServer{
+		addr:  addr,
+		conns: make(map[net.Conn]bool),
+	}
+	return s
+}
+
+func (s *MqttServer) Start() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// Stop closes the listener and connections, and waits for them to finish.
+func (s *MqttServer) Stop() {
+	s.stopOnce.Do(func() {
+		if s.listener != nil {
+			s.listener.Close()
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.stopped = true
+		for conn := range s.conns {
+			conn.Close()
+		}
+	})
+	s.wg.Wait()
+}
+
+// track registers the connection to be closed by Stop, and fails after Stop.
+func (s *MqttServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *MqttServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+func (s *MqttServer) serve(conn net.Conn) {
+	defer conn.Close()
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+
+	remoteAddr := conn.RemoteAddr().String()
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(MQTT_CONNECT_SEC * time.Second))
+	typ, _, body, err := mqttReadPacket(r)
+	if err != nil || typ != MQTT_CONNECT {
+		return
+	}
+
+	cp, err := mqttParseConnect(body)
+	if err != nil {
+		log.Printf("> [Warning] mqtt invalid connect from %s\n", remoteAddr)
+		if logger != nil {
+			logger.Log(WARN, "mqtt invalid connect", logrus.Fields{"method": "mqtt", "error": err.Error(), "from": remoteAddr})
+		}
+
+		conn.Write(mqttConnack(MQTT_BAD_PROTOCOL))
+		return
+	}
+
+	if draining.Load() {
+		conn.Write(mqttConnack(MQTT_UNAVAILABLE))
+		return
+	}
+
+	if !IpValidation(remoteAddr) {
+		log.Printf("> [Warning] remote ip blocked from %s\n", remoteAddr)
+		metrics.IpBlocked()
+		if logger != nil {
+			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "mqtt", "from": remoteAddr})
+		}
+
+		conn.Write(mqttConnack(MQTT_NOT_AUTHORIZED))
+		return
+	}
+
+	if opts.SecureMode {
+		// token as mqtt password
+		res, err := Authenticate(secret, cp.password, host)
+		if !res || err != nil {
+			log.Printf("> [Warning] authentication failed from %s\n", remoteAddr)
+			metrics.AuthFailed()
+			if logger != nil {
+				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "mqtt", "token": cp.password, "from": remoteAddr})
+			}
+
+			conn.Write(mqttConnack(MQTT_BAD_AUTHENTICATION))
+			return
+		}
+	}
+
+	c := &MqttClient{
+		conn:  conn,
+		id:    cp.clientId,
+		token: cp.password,
+		out:   make(chan []byte, MQTT_SEND_BUFFER),
+		done:  make(chan struct{}),
+	}
+	c.out <- mqttConnack(MQTT_ACCEPTED)
+	go c.writePump()
+	metrics.Connected()
+
+	infoAtRemote := c.label()
+	log.Printf("> [Connected] mqtt from %s\n", infoAtRemote)
+	if logger != nil {
+		logger.Log(INFO, "new connection", logrus.Fields{"method": "mqtt", "from": infoAtRemote})
+	}
+
+	c.readPump(r, cp.keepAlive)
+
+	c.Close()
+	broker.DetachAll(c)
+	metrics.Closed(c)
+
+	log.Printf("> [Closed] mqtt from %s\n", infoAtRemote)
+	if logger != nil {
+		logger.Log(INFO, "connection close", logrus.Fields{"method": "mqtt", "from": infoAtRemote})
+	}
+}
+
+//
+// Client
+//
+
+type MqttClient struct {
+	conn      net.Conn
+	id        string
+	token     string
+	out       chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *MqttClient) Info() string {
+	return c.id
+}
+
+func (c *MqttClient) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *MqttClient) Send(ch string, pmsg *PublishSendMessage) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.out <- mqttPublish(ch, []byte(pmsg.Message)):
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *MqttClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *MqttClient) label() string {
+	if c.id != "" {
+		return c.id + "@" + c.RemoteAddr()
+	}
+	return c.RemoteAddr()
+}
+
+func (c *MqttClient) writePump() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case p := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(MQTT_CONNECT_SEC * time.Second))
+			if _, err := c.conn.Write(p); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *MqttClient) readPump(r *bufio.Reader, keepAlive int) {
+	for {
+		if keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(time.Duration(keepAlive) * 1500 * time.Millisecond))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+
+		typ, flags, body, err := mqttReadPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch typ {
+		case MQTT_PUBLISH:
+			if !c.publish(flags, body) {
+				return
+			}
+		case MQTT_SUBSCRIBE:
+			if !c.subscribe(body) {
+				return
+			}
+		case MQTT_UNSUBSCRIBE:
+			if !c.unsubscribe(body) {
+				return
+			}
+		case MQTT_PINGREQ:
+			c.write([]byte{MQTT_PINGRESP << 4, 0})
+		case MQTT_DISCONNECT:
+			return
+		default:
+			return
+		}
+	}
+}
+
+func (c *MqttClient) publish(flags byte, body []byte) bool {
+	qos := (flags >> 1) & 0x03
+	topic, rest, err := mqttReadString(body)
+	if err != nil || qos > 1 {
+		return false
+	}
+
+	if qos == 1 {
+		if len(rest) < 2 {
+			return false
+		}
+		c.write([]byte{MQTT_PUBACK << 4, 2, rest[0], rest[1]})
+		rest = rest[2:]
+	}
+
+	// wildcards are not allowed in topic name
+	if strings.ContainsAny(topic, "+#") {
+		return false
+	}
+
+	infoAtRemote := c.label()
+	if topic == "" {
+		log.Printf("> [Warning] publish channel is empty from %s\n", infoAtRemote)
+		if logger != nil {
+			logger.Log(WARN, "publish channel is empty", logrus.Fields{"method": "mqtt", "channel": topic, "from": infoAtRemote})
+		}
+		return true
+	}
+
+	log.Printf("> [Publish] ch:%s msg:%s from %s\n", topic, string(rest), infoAtRemote)
+	if logger != nil {
+		logger.Log(INFO, "new publish", logrus.Fields{"method": "mqtt", "channel": topic, "message": string(rest), "from": infoAtRemote})
+	}
+
+	EmitMessage(NewPublishSendMessage(topic, string(rest), "", ""))
+	return true
+}
+
+func (c *MqttClient) subscribe(body []byte) bool {
+	if len(body) < 2 {
+		return false
+	}
+	ack := []byte{body[0], body[1]}
+	rest := body[2:]
+
+	infoAtRemote := c.label()
+	for len(rest) > 0 {
+		var ch string
+		var err error
+		ch, rest, err = mqttReadString(rest)
+		if err != nil || len(rest) < 1 {
+			return false
+		}
+		rest = rest[1:] // requested qos
+
+		// topic filters with wildcards are not supported
+		if ch == "" || strings.ContainsAny(ch, "+#") {
+			log.Printf("> [Warning] mqtt subscribe channel is invalid from %s\n", infoAtRemote)
+			if logger != nil {
+				logger.Log(WARN, "mqtt subscribe channel is invalid", logrus.Fields{"method": "mqtt", "channel": ch, "from": infoAtRemote})
+			}
+
+			ack = append(ack, MQTT_SUBACK_FAILURE)
+			continue
+		}
+
+		if !SafeChannel(ch) {
+			log.Printf("> [Warning] whitelist does not contain subscribe channel from %s\n", infoAtRemote)
+			if logger != nil {
+				logger.Log(WARN, "whitelist does not contain subscribe channel", logrus.Fields{"method": "mqtt", "channel": ch, "from": infoAtRemote})
+			}
+
+			ack = append(ack, MQTT_SUBACK_FAILURE)
+			continue
+		}
+
+		if !StoreChannelAllowed(ch, c.token) {
+			log.Printf("> [Warning] store channel is not allowed from %s\n", infoAtRemote)
+			if logger != nil {
+				logger.Log(WARN, "store channel is not allowed", logrus.Fields{"method": "mqtt", "channel": ch, "from": infoAtRemote})
+			}
+
+			ack = append(ack, MQTT_SUBACK_FAILURE)
+			continue
+		}
+
+		log.Printf("> [Subscribe] ch:%s from %s\n", ch, infoAtRemote)
+		if logger != nil {
+			logger.Log(INFO, "new subscribe", logrus.Fields{"method": "mqtt", "channel": ch, "from": infoAtRemote})
+		}
+
+		broker.Attach(ch, c)
+		metrics.Subscribed(c, ch)
+		ack = append(ack, 0x00) // granted qos 0
+	}
+
+	c.write(mqttPacket(MQTT_SUBACK<<4, ack))
+	return true
+}
+
+func (c *MqttClient) unsubscribe(body []byte) bool {
+	if len(body) < 2 {
+		return false
+	}
+	ack := []byte{body[0], body[1]}
+	rest := body[2:]
+
+	infoAtRemote := c.label()
+	for len(rest) > 0 {
+		var ch string
+		var err error
+		ch, rest, err = mqttReadString(rest)
+		if err != nil {
+			return false
+		}
+
+		log.Printf("> [Unsubscribe] ch:%s from %s\n", ch, infoAtRemote)
+		if logger != nil {
+			logger.Log(INFO, "unsubscribe", logrus.Fields{"method": "mqtt", "channel": ch, "from": infoAtRemote})
+		}
+
+		broker.Detach(ch, c)
+		metrics.Unsubscribed(c, ch)
+	}
+
+	c.write(mqttPacket(MQTT_UNSUBACK<<4, ack))
+	return true
+}
+
+func (c *MqttClient) write(p []byte) {
+	select {
+	case c.out <- p:
+	case <-c.done:
+	}
+}
+
+//
+// Packet
+//
+
+type mqttConnectPacket struct {
+	clientId  string
+	username  string
+	password  string
+	keepAlive int
+}
+
+func mqttReadPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	// remaining length
+	n := 0
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		n |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+		if i >= 3 {
+			return 0, 0, nil, errors.New("mqtt: malformed length")
+		}
+	}
+	if n > MQTT_MAX_PACKET {
+		return 0, 0, nil, errors.New("mqtt: packet too large")
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return h >> 4, h & 0x0f, body, nil
+}
+
+func mqttParseConnect(body []byte) (*mqttConnectPacket, error) {
+	proto, rest, err := mqttReadString(body)
+	if err != nil {
+		return nil, err
+	}
+	if proto != "MQTT" || len(rest) < 4 || rest[0] != 4 {
+		return nil, errors.New("mqtt: unsupported protocol")
+	}
+
+	flags := rest[1]
+	cp := &mqttConnectPacket{keepAlive: int(binary.BigEndian.Uint16(rest[2:4]))}
+	rest = rest[4:]
+
+	if cp.clientId, rest, err = mqttReadString(rest); err != nil {
+		return nil, err
+	}
+	if flags&0x04 != 0 { // will topic and message
+		if _, rest, err = mqttReadString(rest); err != nil {
+			return nil, err
+		}
+		if _, rest, err = mqttReadString(rest); err != nil {
+			return nil, err
+		}
+	}
+	if flags&0x80 != 0 {
+		if cp.username, rest, err = mqttReadString(rest); err != nil {
+			return nil, err
+		}
+	}
+	if flags&0x40 != 0 {
+		if cp.password, _, err = mqttReadString(rest); err != nil {
+			return nil, err
+		}
+	}
+
+	return cp, nil
+}
+
+func mqttReadString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("mqtt: malformed string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("mqtt: malformed string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func mqttPacket(h byte, body []byte) []byte {
+	p := []byte{h}
+	n := len(body)
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			b |= 0x80
+		}
+		p = append(p, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+func mqttConnack(rc byte) []byte {
+	return []byte{MQTT_CONNACK << 4, 2, 0, rc}
+}
+
+func mqttPublish(topic string, payload []byte) []byte {
+	return mqttPacket(MQTT_PUBLISH<<4, append(mqttString(topic), payload...))
+}
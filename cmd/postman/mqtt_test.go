@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func StartMockMqttServer(t *testing.T) string {
+	t.Helper()
+
+	opts.Mqtt = "127.0.0.1:0"
+	StartMqtt()
+	t.Cleanup(func() {
+		if mqttSrv != nil {
+			mqttSrv.Stop()
+			mqttSrv = nil
+		}
+	})
+
+	return mqttSrv.listener.Addr().String()
+}
+
+func RequireMqttConnect(t *testing.T, addr string, id string, password string) (net.Conn, *bufio.Reader, byte) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	t.Cleanup(func() { c.Close() })
+
+	require.NoError(t, err)
+
+	body := append(mqttString("MQTT"), 4, 0x02, 0, 60)
+	if password != "" {
+		body[len(body)-3] |= 0xc0 // username and password
+	}
+	body = append(body, mqttString(id)...)
+	if password != "" {
+		body = append(body, mqttString("token")...)
+		body = append(body, mqttString(password)...)
+	}
+	_, err = c.Write(mqttPacket(MQTT_CONNECT<<4, body))
+
+	require.NoError(t, err)
+
+	r := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(1 * time.Second))
+	typ, _, ack, err := mqttReadPacket(r)
+
+	require.NoError(t, err)
+	require.Equal(t, typ, byte(MQTT_CONNACK))
+
+	return c, r, ack[1]
+}
+
+func RequireMqttSubscribe(t *testing.T, c net.Conn, r *bufio.Reader, ch string) byte {
+	t.Helper()
+
+	body := append([]byte{0, 1}, mqttString(ch)...)
+	body = append(body, 0)
+	_, err := c.Write(mqttPacket(MQTT_SUBSCRIBE<<4|0x02, body))
+
+	require.NoError(t, err)
+
+	c.SetReadDeadline(time.Now().Add(1 * time.Second))
+	typ, _, ack, err := mqttReadPacket(r)
+
+	require.NoError(t, err)
+	require.Equal(t, typ, byte(MQTT_SUBACK))
+
+	return ack[2]
+}
+
+func TestMqttPubSub(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	// start server
+	s := StartMockServer(t)
+	addr := StartMockMqttServer(t)
+
+	// mqtt client: connect and subscribe
+	mc, mr, rc := RequireMqttConnect(t, addr, "TEST_MQTT", "")
+
+	require.Equal(t, rc, byte(MQTT_ACCEPTED))
+	require.Equal(t, RequireMqttSubscribe(t, mc, mr, "TEST_CH/1"), byte(0))
+	require.Equal(t, RequireMqttSubscribe(t, mc, mr, "TEST_CH/#"), byte(MQTT_SUBACK_FAILURE))
+
+	// websocket client: connect and subscribe
+	c1 := RequireConnectAndSubscribe(t, s.URL, "TEST_CH/1", "TEST_CLI_1")
+	time.Sleep(100 * time.Millisecond) // wait
+
+	// status contains mqtt client
+	msg := NewStatusMessage(broker)
+
+	require.Contains(t, msg.Channels["TEST_CH/1"][0]+msg.Channels["TEST_CH/1"][1], "TEST_MQTT@")
+
+	// websocket -> mqtt (group publish)
+	RequirePublish(t, c1, "TEST_CH/*", "TEST@MESSAGE", "", "", "TEST_CLI_1")
+
+	mc.SetReadDeadline(time.Now().Add(1 * time.Second))
+	typ, _, body, err := mqttReadPacket(mr)
+
+	require.NoError(t, err)
+	require.Equal(t, typ, byte(MQTT_PUBLISH))
+	topic, payload, _ := mqttReadString(body)
+	require.Equal(t, topic, "TEST_CH/1")
+	require.Equal(t, string(payload), "TEST@MESSAGE")
+
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err := c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@MESSAGE")
+
+	// mqtt -> websocket (qos 1)
+	_, err = mc.Write(mqttPacket(MQTT_PUBLISH<<4|0x02, append(append(mqttString("TEST_CH/1"), 0, 7), "TEST@MQTT"...)))
+
+	require.NoError(t, err)
+
+	mc.SetReadDeadline(time.Now().Add(1 * time.Second))
+	typ, _, body, err = mqttReadPacket(mr)
+
+	require.NoError(t, err)
+	require.Equal(t, typ, byte(MQTT_PUBACK))
+	require.Equal(t, body, []byte{0, 7})
+
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err = c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@MQTT")
+}
+
+func TestMqttSecureMode(t *testing.T) {
+	os.Setenv(ENV_SECRET, "SECRET")
+	t.Cleanup(func() { os.Unsetenv(ENV_SECRET) })
+
+	SetOptions(Options{SecureMode: true})
+	Prepare()
+
+	addr := StartMockMqttServer(t)
+	tkn, _ := GenerateToken(secret, host)
+
+	// connect fail
+	_, _, rc := RequireMqttConnect(t, addr, "TEST_MQTT", "@@@")
+
+	require.Equal(t, rc, byte(MQTT_BAD_AUTHENTICATION))
+
+	// connect success
+	_, _, rc = RequireMqttConnect(t, addr, "TEST_MQTT", tkn)
+
+	require.Equal(t, rc, byte(MQTT_ACCEPTED))
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	OSC_MAX_BYTES = 64 * 1024
+	OSC_ORIGIN    = "osc"
+)
+
+//
+// Gateway
+//
+
+// OscGateway maps OSC address "/a/b" to channel "a/b", and arguments to message, tag and ext.
+type OscGateway struct {
+	listen   string
+	targets  []*net.UDPAddr
+	channels []string // channel patterns emitted to targets
+
+	conn     *net.UDPConn
+	wg       sync.WaitGroup // serve goroutine
+	stopOnce sync.Once
+}
+
+func NewOscGateway(listen string, targets []string, channels []string) (*OscGateway, error) {
+	g := &OscGateway{
+		listen:   listen,
+		channels: channels,
+	}
+
+	for _, t := range targets {
+		addr, err := net.ResolveUDPAddr("udp", t)
+		if err != nil {
+			return nil, err
+		}
+		g.targets = append(g.targets, addr)
+	}
+
+	return g, nil
+}
+
+func (g *OscGateway) Start() error {
+	laddr := &net.UDPAddr{}
+	if g.listen != "" {
+		addr, err := net.ResolveUDPAddr("udp", g.listen)
+		if err != nil {
+			return err
+		}
+		laddr = addr
+	}
+
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	g.conn = conn
+
+	if g.listen != "" {
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.serve()
+		}()
+	}
+
+	return nil
+}
+
+// Stop closes the socket, and waits for the serve goroutine.
+func (g *OscGateway) Stop() {
+	g.stopOnce.Do(func() {
+		if g.conn != nil {
+			g.conn.Close()
+		}
+	})
+	g.wg.Wait()
+}
+
+func (g *OscGateway) serve() {
+	buf := make([]byte, OSC_MAX_BYTES)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		remoteAddr := addr.String()
+		if !IpValidation(remoteAddr) {
+			log.Printf("> [Warning] remote ip blocked from %s\n", remoteAddr)
+			metrics.IpBlocked()
+			if logger != nil {
+				logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "osc", "from": remoteAddr})
+			}
+			continue
+		}
+
+		msgs, err := OscDecode(buf[:n])
+		if err != nil {
+			log.Printf("> [Warning] osc invalid packet from %s\n", remoteAddr)
+			if logger != nil {
+				logger.Log(WARN, "osc invalid packet", logrus.Fields{"method": "osc", "error": err.Error(), "from": remoteAddr})
+			}
+			continue
+		}
+
+		for _, m := range msgs {
+			ch := strings.TrimPrefix(m.Address, "/")
+			if ch == "" {
+				continue
+			}
+
+			args := append(m.Args, "", "", "")
+			pmsg := NewPublishSendMessage(ch, args[0], args[1], args[2])
+			pmsg.origin = OSC_ORIGIN
+
+			log.Printf("> [Publish] osc ch:%s msg:%s from %s\n", ch, pmsg.Message, remoteAddr)
+			if logger != nil {
+				logger.Log(INFO, "new publish", logrus.Fields{"method": "osc", "channel": ch, "message": pmsg.Message, "tag": pmsg.Tag, "extention": pmsg.Extention, "from": remoteAddr})
+			}
+
+			EmitMessage(pmsg)
+		}
+	}
+}
+
+// Forward sends the message to the targets as OSC when the channel is bridged.
+func (g *OscGateway) Forward(pmsg *PublishSendMessage) {
+	if len(g.targets) == 0 || g.conn == nil || pmsg.origin == OSC_ORIGIN {
+		return
+	}
+
+	bridged := len(g.channels) == 0
+	for _, p := range g.channels {
+		if ChannelPattern(p, pmsg.Channel) {
+			bridged = true
+			break
+		}
+	}
+	if !bridged {
+		return
+	}
+
+	args := []string{pmsg.Message}
+	if pmsg.Tag != "" || pmsg.Extention != "" {
+		args = append(args, pmsg.Tag)
+	}
+	if pmsg.Extention != "" {
+		args = append(args, pmsg.Extention)
+	}
+	b := OscEncode("/"+pmsg.Channel, args)
+
+	for _, t := range g.targets {
+		if _, err := g.conn.WriteToUDP(b, t); err != nil {
+			log.Printf("> [Warning] osc send failed to %s: %s\n", t.String(), err)
+		}
+	}
+}
+
+//
+// Packet
+//
+
+type OscMessage struct {
+	Address string
+	Args    []string
+}
+
+func OscEncode(address string, args []string) []byte {
+	var b bytes.Buffer
+	oscWriteString(&b, address)
+	oscWriteString(&b, ","+strings.Repeat("s", len(args)))
+	for _, a := range args {
+		oscWriteString(&b, a)
+	}
+	return b.Bytes()
+}
+
+// OscDecode reads a message or a bundle, and converts the arguments to string.
+func OscDecode(b []byte) ([]*OscMessage, error) {
+	if bytes.HasPrefix(b, []byte("#bundle\x00")) {
+		if len(b) < 16 {
+			return nil, errors.New("osc: malformed bundle")
+		}
+
+		// time tag is ignored and dispatched immediately
+		msgs := []*OscMessage{}
+		rest := b[16:]
+		for len(rest) >= 4 {
+			n := int(binary.BigEndian.Uint32(rest))
+			if n < 0 || len(rest) < 4+n {
+				return nil, errors.New("osc: malformed bundle")
+			}
+			m, err := OscDecode(rest[4 : 4+n])
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, m...)
+			rest = rest[4+n:]
+		}
+		return msgs, nil
+	}
+
+	address, rest, err := oscReadString(b)
+	if err != nil || !strings.HasPrefix(address, "/") {
+		return nil, errors.New("osc: invalid address")
+	}
+
+	m := &OscMessage{Address: address, Args: []string{}}
+	if len(rest) == 0 {
+		return []*OscMessage{m}, nil
+	}
+
+	tags, rest, err := oscReadString(rest)
+	if err != nil || !strings.HasPrefix(tags, ",") {
+		return nil, errors.New("osc: invalid type tag")
+	}
+
+	for _, t := range tags[1:] {
+		switch t {
+		case 'i':
+			if len(rest) < 4 {
+				return nil, errors.New("osc: malformed int32")
+			}
+			m.Args = append(m.Args, strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(rest))), 10))
+			rest = rest[4:]
+		case 'f':
+			if len(rest) < 4 {
+				return nil, errors.New("osc: malformed float32")
+			}
+			f := math.Float32frombits(binary.BigEndian.Uint32(rest))
+			m.Args = append(m.Args, strconv.FormatFloat(float64(f), 'g', -1, 32))
+			rest = rest[4:]
+		case 'h':
+			if len(rest) < 8 {
+				return nil, errors.New("osc: malformed int64")
+			}
+			m.Args = append(m.Args, strconv.FormatInt(int64(binary.BigEndian.Uint64(rest)), 10))
+			rest = rest[8:]
+		case 'd':
+			if len(rest) < 8 {
+				return nil, errors.New("osc: malformed float64")
+			}
+			f := math.Float64frombits(binary.BigEndian.Uint64(rest))
+			m.Args = append(m.Args, strconv.FormatFloat(f, 'g', -1, 64))
+			rest = rest[8:]
+		case 's', 'S':
+			var s string
+			if s, rest, err = oscReadString(rest); err != nil {
+				return nil, err
+			}
+			m.Args = append(m.Args, s)
+		case 'b':
+			if len(rest) < 4 {
+				return nil, errors.New("osc: malformed blob")
+			}
+			n := int(binary.BigEndian.Uint32(rest))
+			size := 4 + (n+3)/4*4
+			if n < 0 || len(rest) < size {
+				return nil, errors.New("osc: malformed blob")
+			}
+			m.Args = append(m.Args, string(rest[4:4+n]))
+			rest = rest[size:]
+		case 'T':
+			m.Args = append(m.Args, "true")
+		case 'F':
+			m.Args = append(m.Args, "false")
+		case 'N', 'I':
+			m.Args = append(m.Args, "")
+		default:
+			return nil, errors.New("osc: unsupported type tag [" + string(t) + "]")
+		}
+	}
+
+	return []*OscMessage{m}, nil
+}
+
+func oscReadString(b []byte) (string, []byte, error) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", nil, errors.New("osc: malformed string")
+	}
+	size := (i + 4) / 4 * 4
+	if len(b) < size {
+		return "", nil, errors.New("osc: malformed string")
+	}
+	return string(b[:i]), b[size:], nil
+}
+
+func oscWriteString(b *bytes.Buffer, s string) {
+	b.WriteString(s)
+	b.Write(make([]byte, 4-len(s)%4))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func StartMockOscGateway(t *testing.T, channels string) (string, *net.UDPConn) {
+	t.Helper()
+
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	t.Cleanup(func() { target.Close() })
+
+	require.NoError(t, err)
+
+	opts.Osc = "127.0.0.1:0"
+	opts.OscTargets = target.LocalAddr().String()
+	opts.OscChannels = channels
+	StartOsc()
+	t.Cleanup(func() {
+		if oscGw != nil {
+			oscGw.Stop()
+			oscGw = nil
+		}
+	})
+
+	return oscGw.conn.LocalAddr().String(), target
+}
+
+func RequireOscMessage(t *testing.T, target *net.UDPConn, address string, args []string) {
+	t.Helper()
+
+	buf := make([]byte, OSC_MAX_BYTES)
+	target.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, _, err := target.ReadFromUDP(buf)
+
+	require.NoError(t, err)
+
+	msgs, err := OscDecode(buf[:n])
+
+	require.NoError(t, err)
+	require.Equal(t, len(msgs), 1)
+	require.Equal(t, msgs[0].Address, address)
+	require.Equal(t, msgs[0].Args, args)
+}
+
+func TestOscGateway(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	// start server
+	s := StartMockServer(t)
+	addr, target := StartMockOscGateway(t, "")
+
+	// websocket client: subscribe
+	c1 := RequireConnectAndSubscribe(t, s.URL, "TEST_CH/1", "TEST_CLI_1")
+	time.Sleep(100 * time.Millisecond) // wait
+
+	// osc -> websocket
+	var b bytes.Buffer
+	oscWriteString(&b, "/TEST_CH/1")
+	oscWriteString(&b, ",sif")
+	oscWriteString(&b, "TEST@OSC")
+	binary.Write(&b, binary.BigEndian, int32(42))
+	binary.Write(&b, binary.BigEndian, math.Float32bits(0.5))
+
+	u, err := net.Dial("udp", addr)
+	t.Cleanup(func() { u.Close() })
+
+	require.NoError(t, err)
+	u.Write(b.Bytes())
+
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err := c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@OSC")
+	require.Contains(t, string(rcv), `"tag":"42"`)
+	require.Contains(t, string(rcv), `"extention":"0.5"`)
+
+	// websocket -> osc (the message from osc is not sent back)
+	RequirePublish(t, c1, "TEST_CH/1", "TEST@MESSAGE", "TEST_TAG", "", "TEST_CLI_1")
+	RequireOscMessage(t, target, "/TEST_CH/1", []string{"TEST@MESSAGE", "TEST_TAG"})
+}
+
+func TestOscChannels(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	_, target := StartMockOscGateway(t, "TEST_CH/*")
+
+	EmitMessage(NewPublishSendMessage("OTHER_CH", "TEST@MESSAGE_1", "", ""))
+	EmitMessage(NewPublishSendMessage("TEST_CH/1", "TEST@MESSAGE_2", "", "TEST_EXT"))
+
+	RequireOscMessage(t, target, "/TEST_CH/1", []string{"TEST@MESSAGE_2", "", "TEST_EXT"})
+}
+
+func TestOscDecode(t *testing.T) {
+	// bundle
+	m1 := OscEncode("/TEST_CH/1", []string{"A"})
+	m2 := OscEncode("/TEST_CH/2", []string{})
+
+	var b bytes.Buffer
+	oscWriteString(&b, "#bundle")
+	binary.Write(&b, binary.BigEndian, uint64(1))
+	binary.Write(&b, binary.BigEndian, uint32(len(m1)))
+	b.Write(m1)
+	binary.Write(&b, binary.BigEndian, uint32(len(m2)))
+	b.Write(m2)
+
+	msgs, err := OscDecode(b.Bytes())
+
+	require.NoError(t, err)
+	require.Equal(t, len(msgs), 2)
+	require.Equal(t, msgs[0].Address, "/TEST_CH/1")
+	require.Equal(t, msgs[0].Args, []string{"A"})
+	require.Equal(t, msgs[1].Address, "/TEST_CH/2")
+	require.Equal(t, msgs[1].Args, []string{})
+
+	// invalid
+	_, err = OscDecode([]byte("TEST"))
+
+	require.Error(t, err)
+
+	_, err = OscDecode(m1[:len(m1)-2])
+
+	require.Error(t, err)
+}
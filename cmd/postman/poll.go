@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	POLL_QUEUE       = 256
+	POLL_IDLE_SEC    = 60
+	POLL_SWEEP_SEC   = 10
+	POLL_TIMEOUT_SEC = 30
+	POLL_MAX_SEC     = 60
+)
+
+//
+// Subscription
+//
+
+type PollSubscription struct {
+	Id string
+
+	info       string
+	remoteAddr string
+
+	mu       sync.Mutex
+	queue    []*PublishSendMessage
+	lastSeen time.Time
+	polling  bool
+	notify   chan struct{}
+}
+
+func NewPollSubscription(info string, remoteAddr string) *PollSubscription {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	s := &PollSubscription{
+		Id:         hex.EncodeToString(b),
+		info:       info,
+		remoteAddr: remoteAddr,
+		lastSeen:   time.Now(),
+		notify:     make(chan struct{}, 1),
+	}
+	return s
+}
+
+func (s *PollSubscription) Info() string {
+	return s.info
+}
+
+func (s *PollSubscription) RemoteAddr() string {
+	return s.remoteAddr
+}
+
+func (s *PollSubscription) Send(ch string, pmsg *PublishSendMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) >= POLL_QUEUE {
+		return false
+	}
+	s.queue = append(s.queue, pmsg)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Take returns the queued messages, and waits for a new message until the timeout when empty.
+func (s *PollSubscription) Take(timeout time.Duration, stop <-chan struct{}) []*PublishSendMessage {
+	s.mu.Lock()
+	s.polling = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.polling = false
+		s.lastSeen = time.Now()
+		s.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			msgs := s.queue
+			s.queue = nil
+			s.mu.Unlock()
+			return msgs
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.notify:
+		case <-timer.C:
+			return nil
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func (s *PollSubscription) Idle(d time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !s.polling && time.Since(s.lastSeen) > d
+}
+
+//
+// Manager
+//
+
+type PollManager struct {
+	subs     sync.Map // map[string]*PollSubscription
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewPollManager() *PollManager {
+	m := &PollManager{
+		stop: make(chan struct{}),
+	}
+
+	// garbage collection of idle subscriptions
+	go func() {
+		ticker := time.NewTicker(POLL_SWEEP_SEC * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.Sweep(POLL_IDLE_SEC * time.Second)
+			}
+		}
+	}()
+
+	return m
+}
+
+func (m *PollManager) Add(s *PollSubscription) {
+	m.subs.Store(s.Id, s)
+}
+
+func (m *PollManager) Get(id string) (*PollSubscription, bool) {
+	if s, ok := m.subs.Load(id); ok {
+		return s.(*PollSubscription), true
+	}
+	return nil, false
+}
+
+func (m *PollManager) Remove(s *PollSubscription) {
+	if _, loaded := m.subs.LoadAndDelete(s.Id); loaded {
+		broker.DetachAll(s)
+		metrics.Closed(s)
+	}
+}
+
+func (m *PollManager) Sweep(idle time.Duration) {
+	m.subs.Range(func(k interface{}, v interface{}) bool {
+		s := v.(*PollSubscription)
+		if s.Idle(idle) {
+			m.Remove(s)
+
+			infoAtRemote := s.RemoteAddr()
+			if s.Info() != "" {
+				infoAtRemote = s.Info() + "@" + s.RemoteAddr()
+			}
+			log.Printf("> [Closed] poll idle %s from %s\n", s.Id, infoAtRemote)
+			if logger != nil {
+				logger.Log(INFO, "connection close", logrus.Fields{"method": "poll", "id": s.Id, "from": infoAtRemote})
+			}
+		}
+		return true
+	})
+}
+
+// Stop returns all waiting polls.
+func (m *PollManager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+//
+// Handlers
+//
+
+func PollSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	AllowCORS(w)
+
+	if !PollValidation(w, r) {
+		return
+	}
+
+	if draining.Load() {
+		msg := NewResultMessage("fail", "server is draining")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	info := r.FormValue("ci")
+	if info == "" {
+		info = r.FormValue("client_info")
+	}
+
+	remote := r.RemoteAddr
+	infoAtRemote := remote
+	if info != "" {
+		infoAtRemote = info + "@" + remote
+	}
+
+	// ch=A&ch=B or ch=A,B
+	r.ParseForm()
+	chs := []string{}
+	for _, s := range append(r.Form["channel"], r.Form["ch"]...) {
+		for _, ch := range strings.Split(s, ",") {
+			if ch != "" {
+				chs = append(chs, ch)
+			}
+		}
+	}
+
+	if len(chs) == 0 {
+		log.Printf("> [Warning] subscribe channel is empty from %s\n", infoAtRemote)
+		if logger != nil {
+			logger.Log(WARN, "subscribe channel is empty", logrus.Fields{"method": "poll", "channel": "", "from": infoAtRemote})
+		}
+
+		msg := NewResultMessage("fail", "subscribe channel is empty")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	for _, ch := range chs {
+		if !SafeChannel(ch) {
+			log.Printf("> [Warning] whitelist does not contain subscribe channel from %s\n", infoAtRemote)
+			if logger != nil {
+				logger.Log(WARN, "whitelist does not contain subscribe channel", logrus.Fields{"method": "poll", "channel": ch, "from": infoAtRemote})
+			}
+
+			msg := NewResultMessage("fail", "whitelist does not contain subscribe channel")
+			j, _ := json.Marshal(msg)
+			fmt.Fprint(w, string(j))
+			return
+		}
+
+		if !StoreChannelAllowed(ch, SecureHandler(r).Token()) {
+			log.Printf("> [Warning] store channel is not allowed from %s\n", infoAtRemote)
+			if logger != nil {
+				logger.Log(WARN, "store channel is not allowed", logrus.Fields{"method": "poll", "channel": ch, "from": infoAtRemote})
+			}
+
+			msg := NewResultMessage("fail", "store channel is not allowed")
+			j, _ := json.Marshal(msg)
+			fmt.Fprint(w, string(j))
+			return
+		}
+	}
+
+	s := NewPollSubscription(info, remote)
+	polls.Add(s)
+	metrics.Connected()
+	for _, ch := range chs {
+		broker.Attach(ch, s)
+		metrics.Subscribed(s, ch)
+	}
+
+	log.Printf("> [Subscribe] poll %s ch:%s from %s\n", s.Id, strings.Join(chs, ","), infoAtRemote)
+	if logger != nil {
+		logger.Log(INFO, "new subscribe", logrus.Fields{"method": "poll", "id": s.Id, "channel": strings.Join(chs, ","), "from": infoAtRemote})
+	}
+
+	msg := NewPollMessage("success", "", s.Id, nil)
+	j, _ := json.Marshal(msg)
+	fmt.Fprint(w, string(j))
+}
+
+func PollHandler(w http.ResponseWriter, r *http.Request) {
+	AllowCORS(w)
+
+	if !PollValidation(w, r) {
+		return
+	}
+
+	s, ok := polls.Get(r.FormValue("id"))
+	if !ok {
+		msg := NewResultMessage("fail", "subscription not found")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	if draining.Load() {
+		msg := NewResultMessage("fail", "server is draining")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	timeout := POLL_TIMEOUT_SEC
+	if sec, err := strconv.Atoi(r.FormValue("timeout")); err == nil && sec >= 0 {
+		timeout = min(sec, POLL_MAX_SEC)
+	}
+
+	msgs := s.Take(time.Duration(timeout)*time.Second, polls.stop)
+
+	msg := NewPollMessage("success", "", s.Id, msgs)
+	j, _ := json.Marshal(msg)
+	fmt.Fprint(w, string(j))
+}
+
+func PollUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	AllowCORS(w)
+
+	if !PollValidation(w, r) {
+		return
+	}
+
+	s, ok := polls.Get(r.FormValue("id"))
+	if !ok {
+		msg := NewResultMessage("fail", "subscription not found")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	polls.Remove(s)
+
+	log.Printf("> [Unsubscribe] poll %s from %s\n", s.Id, r.RemoteAddr)
+	if logger != nil {
+		logger.Log(INFO, "unsubscribe", logrus.Fields{"method": "poll", "id": s.Id, "from": r.RemoteAddr})
+	}
+
+	msg := NewResultMessage("success", "")
+	j, _ := json.Marshal(msg)
+	fmt.Fprint(w, string(j))
+}
+
+// PollValidation checks the ip list and token, and writes the fail response.
+func PollValidation(w http.ResponseWriter, r *http.Request) bool {
+	if !IpValidation(r.RemoteAddr) {
+		log.Printf("> [Warning] remote ip blocked from %s\n", r.RemoteAddr)
+		metrics.IpBlocked()
+		if logger != nil {
+			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
+		}
+
+		msg := NewResultMessage("fail", "remote ip blocked")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return false
+	}
+
+	if opts.SecureMode {
+		smsg := SecureHandler(r)
+		res, err := Authenticate(secret, smsg.Token(), host)
+		if !res || err != nil {
+			log.Printf("> [Warning] authentication failed from %s\n", r.RemoteAddr)
+			metrics.AuthFailed()
+			if logger != nil {
+				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "poll", "token": smsg.Token(), "from": r.RemoteAddr})
+			}
+
+			msg := NewResultMessage("fail", "security error")
+			j, _ := json.Marshal(msg)
+			fmt.Fprint(w, string(j))
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func RequirePollRequest(t *testing.T, handler http.HandlerFunc, tgt string) *PollMessage {
+	t.Helper()
+
+	r := httptest.NewRequest("GET", tgt, nil)
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	var msg PollMessage
+	err := json.Unmarshal(w.Body.Bytes(), &msg)
+
+	require.NoError(t, err)
+
+	return &msg
+}
+
+func TestPollSubscribe(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	// subscribe
+	msg := RequirePollRequest(t, PollSubscribeHandler, "/postman/poll/subscribe?ch=TEST_CH/1,OTHER_CH&ci=TEST_POLL")
+
+	require.Equal(t, msg.Result, "success")
+	require.NotEmpty(t, msg.Id)
+	id := msg.Id
+
+	// status contains poll subscription
+	status := NewStatusMessage(broker)
+
+	require.Contains(t, status.Channels["TEST_CH/1"][0], "TEST_POLL@")
+
+	// queued messages
+	EmitMessage(NewPublishSendMessage("TEST_CH/*", "TEST@MESSAGE_1", "", ""))
+	EmitMessage(NewPublishSendMessage("OTHER_CH", "TEST@MESSAGE_2", "", ""))
+
+	msg = RequirePollRequest(t, PollHandler, "/postman/poll?id="+id)
+
+	require.Equal(t, msg.Result, "success")
+	require.Equal(t, len(msg.Messages), 2)
+	require.Equal(t, msg.Messages[0].Message, "TEST@MESSAGE_1")
+	require.Equal(t, msg.Messages[1].Message, "TEST@MESSAGE_2")
+
+	// empty after timeout
+	msg = RequirePollRequest(t, PollHandler, "/postman/poll?timeout=0&id="+id)
+
+	require.Equal(t, msg.Result, "success")
+	require.Equal(t, len(msg.Messages), 0)
+
+	// wait for a message
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(100 * time.Millisecond)
+		EmitMessage(NewPublishSendMessage("OTHER_CH", "TEST@MESSAGE_3", "", ""))
+	}()
+	t.Cleanup(func() { <-done })
+
+	start := time.Now()
+	msg = RequirePollRequest(t, PollHandler, "/postman/poll?timeout=5&id="+id)
+
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, msg.Messages[0].Message, "TEST@MESSAGE_3")
+
+	// unsubscribe
+	msg = RequirePollRequest(t, PollUnsubscribeHandler, "/postman/poll/unsubscribe?id="+id)
+
+	require.Equal(t, msg.Result, "success")
+
+	msg = RequirePollRequest(t, PollHandler, "/postman/poll?id="+id)
+
+	require.Equal(t, msg.Result, "fail")
+	require.Equal(t, msg.Error, "subscription not found")
+	require.Empty(t, NewStatusMessage(broker).Channels)
+}
+
+func TestPollIdleSubscription(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	msg := RequirePollRequest(t, PollSubscribeHandler, "/postman/poll/subscribe?ch=TEST_CH")
+	id := msg.Id
+
+	// not collected while active
+	polls.Sweep(time.Minute)
+
+	_, ok := polls.Get(id)
+	require.True(t, ok)
+
+	// collected when idle
+	time.Sleep(10 * time.Millisecond)
+	polls.Sweep(time.Millisecond)
+
+	_, ok = polls.Get(id)
+	require.False(t, ok)
+	require.Empty(t, NewStatusMessage(broker).Channels)
+}
+
+func TestPollSafelist(t *testing.T) {
+	SetOptions(Options{Channels: "TEST_CH"})
+	Prepare()
+
+	msg := RequirePollRequest(t, PollSubscribeHandler, "/postman/poll/subscribe?ch=OTHER_CH")
+
+	require.Equal(t, msg.Result, "fail")
+	require.Equal(t, msg.Error, "whitelist does not contain subscribe channel")
+}
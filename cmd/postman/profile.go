@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+const (
+	PROFILE_STANDALONE = "standalone"
+	PROFILE_PAAS       = "paas"
+)
+
+type Profile struct {
+	Name            string
+	UseEnvConfig    bool // port, chlist and iplist are read from environment variables
+	MaskIPAddress   bool // client ip address is hidden in status
+	UseLocalStorage bool // log, store, file and plugin api can use local disk
+	UseOSHandler    bool // register os handler for graceful shutdown on windows
+}
+
+func NewProfile(name string) (*Profile, error) {
+	if name == "" {
+		name = os.Getenv(ENV_PROFILE)
+	}
+
+	switch strings.ToLower(name) {
+	case "", PROFILE_STANDALONE:
+		return NewStandaloneProfile(), nil
+	case PROFILE_PAAS:
+		return NewPaasProfile(), nil
+	default:
+		return NewStandaloneProfile(), errors.New("unknown profile [" + name + "]")
+	}
+}
+
+func NewStandaloneProfile() *Profile {
+	p := &Profile{
+		Name:            PROFILE_STANDALONE,
+		UseEnvConfig:    false,
+		MaskIPAddress:   false,
+		UseLocalStorage: true,
+		UseOSHandler:    true,
+	}
+	return p
+}
+
+func NewPaasProfile() *Profile {
+	p := &Profile{
+		Name:            PROFILE_PAAS,
+		UseEnvConfig:    true,
+		MaskIPAddress:   true,
+		UseLocalStorage: false,
+		UseOSHandler:    false,
+	}
+	return p
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ROUTE_MAX_HOPS = 8
+)
+
+//
+// Config
+//
+
+type RoutesData struct {
+	Routes []*Route `json:"routes"`
+}
+
+type Route struct {
+	Name     string        `json:"name"`
+	Channel  string        `json:"channel"`  // source channel pattern
+	Tag      string        `json:"tag"`      // optional, tag equals
+	Contains string        `json:"contains"` // optional, message contains
+	Targets  []string      `json:"targets"`
+	Rewrite  *RouteRewrite `json:"rewrite"`
+}
+
+// RouteRewrite replaces the fields when set. "{channel}", "{message}", "{tag}" and "{ext}" are expanded with the source message.
+type RouteRewrite struct {
+	Message   *string `json:"message"`
+	Tag       *string `json:"tag"`
+	Extention *string `json:"extention"`
+}
+
+func LoadRoutes(path string) (*RoutesData, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var data RoutesData
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rt := range data.Routes {
+		if rt.Channel == "" || len(rt.Targets) == 0 || slices.Contains(rt.Targets, "") {
+			return nil, errors.New("route needs channel and targets [" + strconv.Itoa(i) + "]")
+		}
+		if rt.Name == "" {
+			rt.Name = rt.Channel
+		}
+	}
+
+	return &data, nil
+}
+
+func (rt *Route) Match(pmsg *PublishSendMessage) bool {
+	if !ChannelPattern(rt.Channel, pmsg.Channel) {
+		return false
+	}
+	if rt.Tag != "" && rt.Tag != pmsg.Tag {
+		return false
+	}
+	if rt.Contains != "" && !strings.Contains(pmsg.Message, rt.Contains) {
+		return false
+	}
+	return true
+}
+
+//
+// Router
+//
+
+type Router struct {
+	routes []*Route
+}
+
+func NewRouter(data *RoutesData) *Router {
+	return &Router{routes: data.Routes}
+}
+
+// Apply returns the messages routed from the published message.
+// A target already passed by the message is skipped, so rules can't loop.
+func (r *Router) Apply(pmsg *PublishSendMessage) []*PublishSendMessage {
+	passed := pmsg.route
+	if len(passed) == 0 {
+		passed = []string{pmsg.Channel}
+	}
+
+	msgs := []*PublishSendMessage{}
+	for _, rt := range r.routes {
+		if !rt.Match(pmsg) {
+			continue
+		}
+
+		for _, tgt := range rt.Targets {
+			if slices.Contains(passed, tgt) || len(passed) > ROUTE_MAX_HOPS {
+				log.Printf("> [Warning] route %s loop detected ch:%s -> %s\n", rt.Name, strings.Join(passed, " -> "), tgt)
+				metrics.Dropped("route_loop")
+				if logger != nil {
+					logger.Log(WARN, "route loop detected", logrus.Fields{"method": "route", "route": rt.Name, "channel": pmsg.Channel, "target": tgt, "passed": strings.Join(passed, ",")})
+				}
+				continue
+			}
+
+			m := rt.rewrite(pmsg, tgt)
+			m.route = append(slices.Clone(passed), tgt)
+			msgs = append(msgs, m)
+		}
+	}
+
+	return msgs
+}
+
+func (rt *Route) rewrite(pmsg *PublishSendMessage, tgt string) *PublishSendMessage {
+	m := NewPublishSendMessage(tgt, pmsg.Message, pmsg.Tag, pmsg.Extention)
+	if rt.Rewrite == nil {
+		return m
+	}
+
+	rep := strings.NewReplacer(
+		"{channel}", pmsg.Channel,
+		"{message}", pmsg.Message,
+		"{tag}", pmsg.Tag,
+		"{ext}", pmsg.Extention,
+	)
+	if rt.Rewrite.Message != nil {
+		m.Message = rep.Replace(*rt.Rewrite.Message)
+	}
+	if rt.Rewrite.Tag != nil {
+		m.Tag = rep.Replace(*rt.Rewrite.Tag)
+	}
+	if rt.Rewrite.Extention != nil {
+		m.Extention = rep.Replace(*rt.Rewrite.Extention)
+	}
+	return m
+}
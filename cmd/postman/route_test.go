@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func WriteRouteConfig(t *testing.T, routes []*Route) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "route.json")
+	j, _ := json.Marshal(&RoutesData{Routes: routes})
+	err := os.WriteFile(path, j, 0644)
+
+	require.NoError(t, err)
+
+	return path
+}
+
+func TestRoute(t *testing.T) {
+	tag := "DOOR_{tag}"
+	path := WriteRouteConfig(t, []*Route{
+		{Channel: "sensor/*", Tag: "open", Targets: []string{"display/lobby", "display/hall"}, Rewrite: &RouteRewrite{Tag: &tag}},
+		{Channel: "sensor/*", Contains: "ALERT", Targets: []string{"alert"}},
+	})
+
+	SetOptions(Options{Route: path})
+	Prepare()
+
+	// start server
+	s := StartMockServer(t)
+	c1 := RequireConnectAndSubscribe(t, s.URL, "display/lobby", "TEST_CLI_1")
+	c2 := RequireConnectAndSubscribe(t, s.URL, "alert", "TEST_CLI_2")
+	c3 := RequireConnectAndPublish(t, s.URL, "sensor/door", "TEST@MESSAGE", "TEST_CLI_3")
+	time.Sleep(100 * time.Millisecond) // wait
+
+	// not matched with tag
+	RequirePublish(t, c3, "sensor/door", "TEST@ALERT", "close", "", "TEST_CLI_3")
+
+	c2.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err := c2.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@ALERT")
+
+	// matched with tag and rewritten
+	RequirePublish(t, c3, "sensor/door", "TEST@OPEN", "open", "", "TEST_CLI_3")
+
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err = c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@OPEN")
+	require.Contains(t, string(rcv), `"tag":"DOOR_open"`)
+}
+
+func TestRouteLoop(t *testing.T) {
+	path := WriteRouteConfig(t, []*Route{
+		{Channel: "A", Targets: []string{"B"}},
+		{Channel: "B", Targets: []string{"A", "C"}},
+	})
+
+	SetOptions(Options{Route: path})
+	Prepare()
+
+	// A -> B -> C, and B -> A is skipped
+	msgs := routes.Apply(NewPublishSendMessage("A", "TEST@MESSAGE", "", ""))
+
+	require.Equal(t, len(msgs), 1)
+	require.Equal(t, msgs[0].Channel, "B")
+
+	msgs = routes.Apply(msgs[0])
+
+	require.Equal(t, len(msgs), 1)
+	require.Equal(t, msgs[0].Channel, "C")
+	require.Equal(t, msgs[0].route, []string{"A", "B", "C"})
+
+	// terminates
+	EmitMessage(NewPublishSendMessage("A", "TEST@MESSAGE", "", ""))
+}
+
+func TestRouteInvalidConfig(t *testing.T) {
+	path := WriteRouteConfig(t, []*Route{
+		{Channel: "A"},
+	})
+
+	_, err := LoadRoutes(path)
+
+	require.Error(t, err)
+}
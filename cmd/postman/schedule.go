@@ -0,0 +1,546 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sharkattack51/golem"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SCHEDULE_PREFIX    = "\x00schedule/"
+	SCHEDULE_MAX_YEARS = 5
+)
+
+//
+// Scheduled Message
+//
+
+type ScheduledMessage struct {
+	Id        string    `json:"id"`
+	Channel   string    `json:"channel"`
+	Message   string    `json:"message"`
+	Tag       string    `json:"tag"`
+	Extention string    `json:"extention"`
+	Cron      string    `json:"cron,omitempty"`
+	Next      time.Time `json:"next"`
+
+	spec  *CronSpec
+	timer *time.Timer
+}
+
+// NewScheduledMessage accepts one of delay seconds, absolute time (RFC3339) or cron expression.
+func NewScheduledMessage(msg *ScheduleMessage, now time.Time) (*ScheduledMessage, error) {
+	if msg.Channel() == "" {
+		return nil, errors.New("schedule channel is empty")
+	}
+	if StoreChannelReserved(msg.Channel()) {
+		return nil, errors.New("store channel is reserved")
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	s := &ScheduledMessage{
+		Id:        hex.EncodeToString(b),
+		Channel:   msg.Channel(),
+		Message:   msg.Message(),
+		Tag:       msg.Tag(),
+		Extention: msg.Extention(),
+	}
+
+	n := 0
+	if msg.Delay != "" {
+		sec, err := strconv.ParseFloat(msg.Delay, 64)
+		if err != nil || sec < 0 {
+			return nil, errors.New("schedule delay is invalid")
+		}
+		s.Next = now.Add(time.Duration(sec * float64(time.Second)))
+		n++
+	}
+	if msg.At != "" {
+		at, err := time.Parse(time.RFC3339, msg.At)
+		if err != nil {
+			return nil, errors.New("schedule at is invalid")
+		}
+		s.Next = at
+		n++
+	}
+	if msg.Cron != "" {
+		spec, err := ParseCron(msg.Cron)
+		if err != nil {
+			return nil, err
+		}
+		s.Cron = msg.Cron
+		s.spec = spec
+		s.Next = spec.Next(now)
+		n++
+	}
+
+	if n != 1 {
+		return nil, errors.New("schedule needs one of delay, at or cron")
+	}
+	if s.Next.IsZero() {
+		return nil, errors.New("schedule cron never matches")
+	}
+	return s, nil
+}
+
+//
+// Scheduler
+//
+
+// Scheduler publishes the messages at the time. Schedules are kept in store db when it is enabled.
+type Scheduler struct {
+	mu        sync.Mutex
+	schedules map[string]*ScheduledMessage
+	db        Kvs
+	stopped   bool
+	firing    sync.WaitGroup // publishes after the lock
+}
+
+func NewScheduler(db Kvs) *Scheduler {
+	sc := &Scheduler{
+		schedules: make(map[string]*ScheduledMessage),
+		db:        db,
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.load()
+
+	return sc
+}
+
+// load restores the schedules from store db, and missed one-shot schedules are published soon.
+// Records which are not written by the scheduler itself are skipped.
+func (sc *Scheduler) load() {
+	if sc.db != nil {
+		iter := sc.db.NewIterator(KvsPrefix([]byte(SCHEDULE_PREFIX)))
+		for iter.Next() {
+			var s ScheduledMessage
+			if err := json.Unmarshal(iter.Value(), &s); err != nil || s.Id == "" || s.Channel == "" || SCHEDULE_PREFIX+s.Id != string(iter.Key()) {
+				log.Printf("> [Warning] schedule record is invalid \"%s\"\n", strings.TrimPrefix(string(iter.Key()), SCHEDULE_PREFIX))
+				continue
+			}
+			if s.Cron != "" {
+				spec, err := ParseCron(s.Cron)
+				if err != nil {
+					continue
+				}
+				s.spec = spec
+				if s.Next.Before(time.Now()) {
+					s.Next = spec.Next(time.Now())
+				}
+			}
+			sc.schedules[s.Id] = &s
+		}
+		iter.Release()
+
+		if err := iter.Error(); err != nil {
+			log.Printf("> [Warning] could not restore schedules: %s\n", err)
+		}
+	}
+
+	for _, s := range sc.schedules {
+		sc.arm(s)
+	}
+}
+
+func (sc *Scheduler) Add(s *ScheduledMessage) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.stopped {
+		return errors.New("scheduler is stopped")
+	}
+	if err := sc.save(s); err != nil {
+		return err
+	}
+
+	sc.schedules[s.Id] = s
+	sc.arm(s)
+	return nil
+}
+
+func (sc *Scheduler) Cancel(id string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	s, ok := sc.schedules[id]
+	if !ok {
+		return false
+	}
+
+	s.timer.Stop()
+	delete(sc.schedules, id)
+	if sc.db != nil {
+		sc.db.Delete([]byte(SCHEDULE_PREFIX + id))
+	}
+	return true
+}
+
+// List returns the schedules in order of next time.
+func (sc *Scheduler) List() []*ScheduledMessage {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	list := []*ScheduledMessage{}
+	for _, s := range sc.schedules {
+		list = append(list, s)
+	}
+	slices.SortFunc(list, func(a, b *ScheduledMessage) int {
+		return a.Next.Compare(b.Next)
+	})
+	return list
+}
+
+// Reload replaces the schedules with the records in store db, after the db is restored.
+func (sc *Scheduler) Reload() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.stopped {
+		return
+	}
+	for _, s := range sc.schedules {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+	}
+	sc.schedules = make(map[string]*ScheduledMessage)
+	sc.load()
+}
+
+// Stop stops the timers and waits for the firing publishes, and the schedules are kept in store db.
+func (sc *Scheduler) Stop() {
+	sc.mu.Lock()
+	sc.stopped = true
+	for _, s := range sc.schedules {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+	}
+	sc.mu.Unlock()
+
+	sc.firing.Wait()
+}
+
+func (sc *Scheduler) arm(s *ScheduledMessage) {
+	s.timer = time.AfterFunc(time.Until(s.Next), func() {
+		sc.fire(s)
+	})
+}
+
+// fire publishes the schedule, unless it is canceled or replaced by Reload while waiting for the lock.
+func (sc *Scheduler) fire(s *ScheduledMessage) {
+	id := s.Id
+
+	sc.mu.Lock()
+	if cur, ok := sc.schedules[id]; !ok || cur != s || sc.stopped {
+		sc.mu.Unlock()
+		return
+	}
+
+	pmsg := NewPublishSendMessage(s.Channel, s.Message, s.Tag, s.Extention)
+	if s.spec != nil {
+		s.Next = s.spec.Next(time.Now())
+		sc.save(s)
+		sc.arm(s)
+	} else {
+		delete(sc.schedules, id)
+		if sc.db != nil {
+			sc.db.Delete([]byte(SCHEDULE_PREFIX + id))
+		}
+	}
+	sc.firing.Add(1)
+	defer sc.firing.Done()
+	sc.mu.Unlock()
+
+	log.Printf("> [Publish] schedule %s ch:%s msg:%s\n", id, pmsg.Channel, pmsg.Message)
+	if logger != nil {
+		logger.Log(INFO, "new publish", logrus.Fields{"method": "schedule", "id": id, "channel": pmsg.Channel, "message": pmsg.Message, "tag": pmsg.Tag, "extention": pmsg.Extention})
+	}
+
+	EmitMessage(pmsg)
+}
+
+func (sc *Scheduler) save(s *ScheduledMessage) error {
+	if sc.db == nil {
+		return nil
+	}
+
+	j, _ := json.Marshal(s)
+	return sc.db.Put([]byte(SCHEDULE_PREFIX+s.Id), j)
+}
+
+//
+// Cron
+//
+
+// CronSpec is "MINUTE HOUR DAY_OF_MONTH MONTH DAY_OF_WEEK" in local time.
+type CronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+func ParseCron(expr string) (*CronSpec, error) {
+	f := strings.Fields(expr)
+	if len(f) != 5 {
+		return nil, errors.New("cron needs 5 fields [" + expr + "]")
+	}
+
+	spec := &CronSpec{
+		domStar: f[2] == "*",
+		dowStar: f[4] == "*",
+	}
+
+	var err error
+	if spec.minute, err = parseCronField(f[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if spec.hour, err = parseCronField(f[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if spec.dom, err = parseCronField(f[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if spec.month, err = parseCronField(f[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if spec.dow, err = parseCronField(f[4], 0, 7); err != nil {
+		return nil, err
+	}
+
+	// 7 is also sunday
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+
+	return spec, nil
+}
+
+// parseCronField reads "*", "N", "N-M" and "/STEP" in comma separated list.
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng = part[:i]
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("cron step is invalid [%s]", part)
+			}
+			step = s
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("cron field is invalid [%s]", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("cron field is invalid [%s]", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("cron field is out of range [%s]", part)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first matched minute after t, or zero time when nothing matches.
+func (c *CronSpec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(SCHEDULE_MAX_YEARS, 0, 0)
+
+	for t.Before(limit) {
+		y, mo, d := t.Date()
+		if c.month&(1<<uint(mo)) == 0 {
+			t = time.Date(y, mo+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(y, mo, d+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(y, mo, d, t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchDay is either day of month or day of week when both are restricted (same as cron).
+func (c *CronSpec) matchDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+//
+// Handlers
+//
+
+// ScheduleCommand runs ADD, LIST and CANCEL for http and websocket.
+func ScheduleCommand(msg *ScheduleMessage, infoAtRemote string) *ScheduleResultMessage {
+	switch strings.ToLower(msg.Command()) {
+	case "add":
+		s, err := NewScheduledMessage(msg, time.Now())
+		if err == nil {
+			err = scheds.Add(s)
+		}
+		if err != nil {
+			log.Printf("> [Warning] %s from %s\n", err, infoAtRemote)
+			if logger != nil {
+				logger.Log(WARN, "schedule failed", logrus.Fields{"method": "schedule", "channel": msg.Channel(), "error": err.Error(), "from": infoAtRemote})
+			}
+			return NewScheduleResultMessage("fail", err.Error(), "", nil)
+		}
+
+		log.Printf("> [Schedule] %s ch:%s next:%s from %s\n", s.Id, s.Channel, s.Next.Format(time.RFC3339), infoAtRemote)
+		if logger != nil {
+			logger.Log(INFO, "new schedule", logrus.Fields{"method": "schedule", "id": s.Id, "channel": s.Channel, "message": s.Message, "cron": s.Cron, "next": s.Next, "from": infoAtRemote})
+		}
+		return NewScheduleResultMessage("success", "", s.Id, nil)
+
+	case "list":
+		return NewScheduleResultMessage("success", "", "", scheds.List())
+
+	case "cancel":
+		if !scheds.Cancel(msg.Id) {
+			return NewScheduleResultMessage("fail", "schedule not found", "", nil)
+		}
+
+		log.Printf("> [Schedule] cancel %s from %s\n", msg.Id, infoAtRemote)
+		if logger != nil {
+			logger.Log(INFO, "cancel schedule", logrus.Fields{"method": "schedule", "id": msg.Id, "from": infoAtRemote})
+		}
+		return NewScheduleResultMessage("success", "", msg.Id, nil)
+
+	default:
+		return NewScheduleResultMessage("fail", "unknown command", "", nil)
+	}
+}
+
+func ScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	AllowCORS(w)
+
+	if !IpValidation(r.RemoteAddr) {
+		log.Printf("> [Warning] remote ip blocked from %s\n", r.RemoteAddr)
+		metrics.IpBlocked()
+		if logger != nil {
+			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
+		}
+
+		msg := NewResultMessage("fail", "remote ip blocked")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	if opts.SecureMode {
+		smsg := SecureHandler(r)
+		res, err := Authenticate(secret, smsg.Token(), host)
+		if !res || err != nil {
+			log.Printf("> [Warning] authentication failed from %s\n", r.RemoteAddr)
+			metrics.AuthFailed()
+			if logger != nil {
+				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "schedule", "token": smsg.Token(), "from": r.RemoteAddr})
+			}
+
+			msg := NewResultMessage("fail", "security error")
+			j, _ := json.Marshal(msg)
+			fmt.Fprint(w, string(j))
+			return
+		}
+	}
+
+	params := make(map[string]string)
+	query := r.URL.Query()
+	for _, s := range []string{"command", "cmd", "id", "channel", "ch", "message", "msg", "tag", "extention", "ext", "delay", "at", "cron"} {
+		param := query[s]
+		if len(param) > 0 {
+			params[s] = param[0]
+		} else {
+			params[s] = ""
+		}
+	}
+
+	// for GET url-param
+	msg := &ScheduleMessage{
+		RawCommand:   params["command"],
+		RawCmd:       params["cmd"],
+		Id:           params["id"],
+		RawChannel:   params["channel"],
+		RawCh:        params["ch"],
+		RawMessage:   params["message"],
+		RawMsg:       params["msg"],
+		RawTag:       params["tag"],
+		RawExtention: params["extention"],
+		RawExt:       params["ext"],
+		Delay:        params["delay"],
+		At:           params["at"],
+		Cron:         params["cron"],
+	}
+
+	// for POST form-data
+	if msg.Command() == "" {
+		r.ParseForm()
+		if data, ok := r.Form["json"]; ok && len(data) > 0 {
+			json.Unmarshal([]byte(data[0]), msg)
+		}
+	}
+
+	res := ScheduleCommand(msg, r.RemoteAddr)
+	j, _ := json.Marshal(res)
+	fmt.Fprint(w, string(j))
+}
+
+// Schedule is the websocket handler, and replies the result as message.
+func Schedule(conn *golem.Connection, msg *ScheduleMessage) {
+	if Rejected(conn) {
+		return
+	}
+
+	remoteAddr := conn.GetSocket().RemoteAddr().String()
+	infoAtRemote := remoteAddr
+	if info, exist := cliInfos.Load(remoteAddr); exist {
+		infoAtRemote = info.(string) + "@" + remoteAddr
+	}
+
+	res := ScheduleCommand(msg, infoAtRemote)
+	conn.Emit("message", &res)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func RequireScheduleRequest(t *testing.T, tgt string) *ScheduleResultMessage {
+	t.Helper()
+
+	r := httptest.NewRequest("GET", tgt, nil)
+	w := httptest.NewRecorder()
+	ScheduleHandler(w, r)
+
+	var msg ScheduleResultMessage
+	err := json.Unmarshal(w.Body.Bytes(), &msg)
+
+	require.NoError(t, err)
+
+	return &msg
+}
+
+func TestSchedule(t *testing.T) {
+	SetOptions(Options{UseStoreApi: true})
+	Prepare()
+	t.Cleanup(func() {
+		for _, s := range scheds.List() {
+			scheds.Cancel(s.Id)
+		}
+		scheds.Stop()
+		kvsDB.Close()
+	})
+
+	// start server
+	s := StartMockServer(t)
+	c1 := RequireConnectAndSubscribe(t, s.URL, "TEST_CH", "TEST_CLI_1")
+	time.Sleep(100 * time.Millisecond) // wait
+
+	// delay
+	msg := RequireScheduleRequest(t, "/postman/schedule?cmd=ADD&ch=TEST_CH&msg=TEST@DELAY&delay=0.2")
+
+	require.Equal(t, msg.Result, "success")
+	require.NotEmpty(t, msg.Id)
+
+	c1.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, rcv, err := c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@DELAY")
+
+	// one-shot is removed after published
+	require.Empty(t, RequireScheduleRequest(t, "/postman/schedule?cmd=LIST").Schedules)
+
+	// cron and absolute time
+	msg = RequireScheduleRequest(t, "/postman/schedule?cmd=ADD&ch=TEST_CH&msg=TEST@CRON&cron=0+10+*+*+*")
+	cronId := msg.Id
+
+	require.Equal(t, msg.Result, "success")
+
+	at := time.Now().Add(time.Hour).Format(time.RFC3339)
+	msg = RequireScheduleRequest(t, "/postman/schedule?cmd=ADD&ch=TEST_CH&msg=TEST@AT&at="+at)
+
+	require.Equal(t, msg.Result, "success")
+
+	msg = RequireScheduleRequest(t, "/postman/schedule?cmd=LIST")
+
+	require.Equal(t, len(msg.Schedules), 2)
+	require.False(t, msg.Schedules[1].Next.Before(msg.Schedules[0].Next))
+
+	// restored from store db
+	scheds.Stop()
+	scheds = NewScheduler(kvsDB)
+
+	require.Equal(t, len(scheds.List()), 2)
+
+	// cancel
+	msg = RequireScheduleRequest(t, "/postman/schedule?cmd=CANCEL&id="+cronId)
+
+	require.Equal(t, msg.Result, "success")
+	require.Equal(t, len(RequireScheduleRequest(t, "/postman/schedule?cmd=LIST").Schedules), 1)
+
+	msg = RequireScheduleRequest(t, "/postman/schedule?cmd=CANCEL&id="+cronId)
+
+	require.Equal(t, msg.Result, "fail")
+	require.Equal(t, msg.Error, "schedule not found")
+
+	// invalid
+	msg = RequireScheduleRequest(t, "/postman/schedule?cmd=ADD&ch=TEST_CH&delay=1&cron=*+*+*+*+*")
+
+	require.Equal(t, msg.Result, "fail")
+	require.Equal(t, msg.Error, "schedule needs one of delay, at or cron")
+
+	msg = RequireScheduleRequest(t, "/postman/schedule?cmd=ADD&ch=$store/k&delay=1")
+
+	require.Equal(t, msg.Result, "fail")
+	require.Equal(t, msg.Error, "store channel is reserved")
+}
+
+func TestScheduleRestoreInvalid(t *testing.T) {
+	SetOptions(Options{UseStoreApi: true})
+	Prepare()
+	t.Cleanup(func() {
+		iter := kvsDB.NewIterator(KvsPrefix([]byte(SCHEDULE_PREFIX)))
+		for iter.Next() {
+			kvsDB.Delete(iter.Key())
+		}
+		iter.Release()
+		scheds.Stop()
+		kvsDB.Close()
+	})
+
+	next := time.Now().Add(time.Hour)
+	valid, _ := json.Marshal(&ScheduledMessage{Id: "TEST_VALID", Channel: "TEST_CH", Next: next})
+	other, _ := json.Marshal(&ScheduledMessage{Id: "TEST_OTHER", Channel: "TEST_CH", Next: next})
+	noCh, _ := json.Marshal(&ScheduledMessage{Id: "TEST_NO_CH", Next: next})
+	kvsDB.Put([]byte(SCHEDULE_PREFIX+"TEST_VALID"), valid)
+	kvsDB.Put([]byte(SCHEDULE_PREFIX+"TEST_FORGED"), other)
+	kvsDB.Put([]byte(SCHEDULE_PREFIX+"TEST_NO_CH"), noCh)
+	kvsDB.Put([]byte(SCHEDULE_PREFIX+"TEST_BROKEN"), []byte("{"))
+
+	// only records written by the scheduler are restored
+	scheds.Stop()
+	scheds = NewScheduler(kvsDB)
+	list := scheds.List()
+
+	require.Equal(t, len(list), 1)
+	require.Equal(t, list[0].Id, "TEST_VALID")
+
+	// not writable through the store api
+	res := StoreCommand(&StoreMessage{RawCmd: "SET", RawKey: SCHEDULE_PREFIX + "TEST_STORE", RawVal: string(valid)}, "TEST")
+
+	require.Equal(t, res.(*ResultMessage).Error, "store key is invalid")
+}
+
+func TestScheduleWebsocket(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	s := StartMockServer(t)
+	c1 := RequireConnectAndSubscribe(t, s.URL, "TEST_CH", "TEST_CLI_1")
+
+	j, _ := json.Marshal(&ScheduleMessage{RawCmd: "add", RawCh: "TEST_CH", RawMsg: "TEST@DELAY", Delay: "0.1"})
+	err := c1.WriteMessage(websocket.TextMessage, []byte("schedule "+string(j)))
+
+	require.NoError(t, err)
+
+	// result
+	c1.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err := c1.ReadMessage()
+
+	require.NoError(t, err)
+	require.Contains(t, string(rcv), `"result":"success"`)
+
+	// published
+	c1.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, rcv, err = c1.ReadMessage()
+
+	require.NoError(t, err)
+	RequireGolemClientProtocolMessage(t, rcv, "TEST@DELAY")
+}
+
+func TestCron(t *testing.T) {
+	base := time.Date(2024, 1, 31, 9, 30, 15, 0, time.Local) // wednesday
+
+	var tests = []struct {
+		expr   string
+		expect time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 9, 31, 0, 0, time.Local)},
+		{"0 10 * * *", time.Date(2024, 1, 31, 10, 0, 0, 0, time.Local)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 9, 45, 0, 0, time.Local)},
+		{"0 9 * * *", time.Date(2024, 2, 1, 9, 0, 0, 0, time.Local)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.Local)},
+		{"0 8 * * 1-5", time.Date(2024, 2, 1, 8, 0, 0, 0, time.Local)},
+		{"0 0 * * 7", time.Date(2024, 2, 4, 0, 0, 0, 0, time.Local)},
+		{"30 12 15,31 * *", time.Date(2024, 1, 31, 12, 30, 0, 0, time.Local)},
+	}
+
+	for _, tt := range tests {
+		spec, err := ParseCron(tt.expr)
+
+		require.NoError(t, err)
+		require.Equal(t, spec.Next(base), tt.expect, tt.expr)
+	}
+
+	// never
+	spec, _ := ParseCron("0 0 31 2 *")
+
+	require.True(t, spec.Next(base).IsZero())
+
+	// invalid
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "a * * * *"} {
+		_, err := ParseCron(expr)
+
+		require.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SSE_HISTORY       = 256
+	SSE_KEEPALIVE_SEC = 15
+	SSE_RETRY_MSEC    = 3000
+	SSE_SEND_BUFFER   = 512
+)
+
+//
+// Event Log
+//
+
+// EventLog numbers the published messages and keeps the latest ones to resume.
+type EventLog struct {
+	mu     sync.Mutex
+	seq    uint64
+	events []*PublishSendMessage
+}
+
+func NewEventLog() *EventLog {
+	l := &EventLog{
+		events: make([]*PublishSendMessage, 0, SSE_HISTORY),
+	}
+	return l
+}
+
+func (l *EventLog) Record(pmsg *PublishSendMessage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	pmsg.id = l.seq
+
+	if len(l.events) >= SSE_HISTORY {
+		l.events = l.events[1:]
+	}
+	l.events = append(l.events, pmsg)
+}
+
+// Since returns the kept messages after the id.
+func (l *EventLog) Since(id uint64) []*PublishSendMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	msgs := []*PublishSendMessage{}
+	for _, pmsg := range l.events {
+		if pmsg.id > id {
+			msgs = append(msgs, pmsg)
+		}
+	}
+	return msgs
+}
+
+//
+// Client
+//
+
+type sseEvent struct {
+	name string
+	id   uint64
+	data []byte
+}
+
+type SseClient struct {
+	info       string
+	remoteAddr string
+	out        chan *sseEvent
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func NewSseClient(info string, remoteAddr string) *SseClient {
+	c := &SseClient{
+		info:       info,
+		remoteAddr: remoteAddr,
+		out:        make(chan *sseEvent, SSE_SEND_BUFFER),
+		done:       make(chan struct{}),
+	}
+	return c
+}
+
+func (c *SseClient) Info() string {
+	return c.info
+}
+
+func (c *SseClient) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+func (c *SseClient) Send(ch string, pmsg *PublishSendMessage) bool {
+	j, _ := json.Marshal(pmsg)
+
+	select {
+	case <-c.done:
+		return false
+	case c.out <- &sseEvent{name: "message", id: pmsg.id, data: j}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *SseClient) Shutdown(retryAfter int) {
+	msg := NewShutdownMessage("shutdown", retryAfter)
+	j, _ := json.Marshal(msg)
+
+	select {
+	case c.out <- &sseEvent{name: "shutdown", data: j}:
+	default:
+	}
+	c.Close()
+}
+
+func (c *SseClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *SseClient) write(w http.ResponseWriter, e *sseEvent) {
+	if e.id > 0 {
+		fmt.Fprintf(w, "id: %d\n", e.id)
+	}
+	if e.name == "shutdown" {
+		fmt.Fprintf(w, "retry: %d\n", SSE_RETRY_MSEC)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.name, e.data)
+}
+
+//
+// Handler
+//
+
+func SseHandler(w http.ResponseWriter, r *http.Request) {
+	AllowCORS(w)
+
+	if !IpValidation(r.RemoteAddr) {
+		log.Printf("> [Warning] remote ip blocked from %s\n", r.RemoteAddr)
+		metrics.IpBlocked()
+		if logger != nil {
+			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
+		}
+
+		msg := NewResultMessage("fail", "remote ip blocked")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	if opts.SecureMode {
+		smsg := SecureHandler(r)
+		res, err := Authenticate(secret, smsg.Token(), host)
+		if !res || err != nil {
+			log.Printf("> [Warning] authentication failed from %s\n", r.RemoteAddr)
+			metrics.AuthFailed()
+			if logger != nil {
+				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "sse", "token": smsg.Token(), "from": r.RemoteAddr})
+			}
+
+			msg := NewResultMessage("fail", "security error")
+			j, _ := json.Marshal(msg)
+			fmt.Fprint(w, string(j))
+			return
+		}
+	}
+
+	if draining.Load() {
+		msg := NewResultMessage("fail", "server is draining")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	query := r.URL.Query()
+	info := query.Get("ci")
+	if info == "" {
+		info = query.Get("client_info")
+	}
+
+	remote := r.RemoteAddr
+	infoAtRemote := remote
+	if info != "" {
+		infoAtRemote = info + "@" + remote
+	}
+
+	// ?ch=A&ch=B or ?ch=A,B
+	chs := []string{}
+	for _, s := range append(query["channel"], query["ch"]...) {
+		for _, ch := range strings.Split(s, ",") {
+			if ch != "" {
+				chs = append(chs, ch)
+			}
+		}
+	}
+
+	if len(chs) == 0 {
+		log.Printf("> [Warning] subscribe channel is empty from %s\n", infoAtRemote)
+		if logger != nil {
+			logger.Log(WARN, "subscribe channel is empty", logrus.Fields{"method": "sse", "channel": "", "from": infoAtRemote})
+		}
+
+		msg := NewResultMessage("fail", "subscribe channel is empty")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	for _, ch := range chs {
+		if !SafeChannel(ch) {
+			log.Printf("> [Warning] whitelist does not contain subscribe channel from %s\n", infoAtRemote)
+			if logger != nil {
+				logger.Log(WARN, "whitelist does not contain subscribe channel", logrus.Fields{"method": "sse", "channel": ch, "from": infoAtRemote})
+			}
+
+			msg := NewResultMessage("fail", "whitelist does not contain subscribe channel")
+			j, _ := json.Marshal(msg)
+			fmt.Fprint(w, string(j))
+			return
+		}
+
+		if !StoreChannelAllowed(ch, SecureHandler(r).Token()) {
+			log.Printf("> [Warning] store channel is not allowed from %s\n", infoAtRemote)
+			if logger != nil {
+				logger.Log(WARN, "store channel is not allowed", logrus.Fields{"method": "sse", "channel": ch, "from": infoAtRemote})
+			}
+
+			msg := NewResultMessage("fail", "store channel is not allowed")
+			j, _ := json.Marshal(msg)
+			fmt.Fprint(w, string(j))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		msg := NewResultMessage("fail", "streaming unsupported")
+		j, _ := json.Marshal(msg)
+		fmt.Fprint(w, string(j))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	c := NewSseClient(info, remote)
+	sseClients.Store(c, true)
+	metrics.Connected()
+
+	log.Printf("> [Subscribe] sse ch:%s from %s\n", strings.Join(chs, ","), infoAtRemote)
+	if logger != nil {
+		logger.Log(INFO, "new subscribe", logrus.Fields{"method": "sse", "channel": strings.Join(chs, ","), "from": infoAtRemote})
+	}
+
+	for _, ch := range chs {
+		broker.Attach(ch, c)
+		metrics.Subscribed(c, ch)
+	}
+
+	fmt.Fprintf(w, "retry: %d\n\n", SSE_RETRY_MSEC)
+
+	// resume from Last-Event-ID
+	var sent uint64
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = query.Get("last_event_id")
+	}
+	if id, err := strconv.ParseUint(lastId, 10, 64); err == nil && events != nil {
+		for _, pmsg := range events.Since(id) {
+			for _, ch := range chs {
+				if ChannelMatch(pmsg.Channel, ch) {
+					j, _ := json.Marshal(pmsg)
+					c.write(w, &sseEvent{name: "message", id: pmsg.id, data: j})
+					sent = pmsg.id
+				}
+			}
+		}
+	}
+	flusher.Flush()
+
+	defer func() {
+		c.Close()
+		broker.DetachAll(c)
+		metrics.Closed(c)
+		sseClients.Delete(c)
+
+		log.Printf("> [Closed] sse from %s\n", infoAtRemote)
+		if logger != nil {
+			logger.Log(INFO, "connection close", logrus.Fields{"method": "sse", "from": infoAtRemote})
+		}
+	}()
+
+	ticker := time.NewTicker(SSE_KEEPALIVE_SEC * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-c.done:
+			// flush the last events like shutdown
+			for {
+				select {
+				case e := <-c.out:
+					c.write(w, e)
+				default:
+					flusher.Flush()
+					return
+				}
+			}
+
+		case e := <-c.out:
+			if e.id > 0 && e.id <= sent {
+				continue // already resumed
+			}
+			c.write(w, e)
+			flusher.Flush()
+
+		case <-ticker.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func StartMockSseServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	s := httptest.NewServer(http.HandlerFunc(SseHandler))
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func RequireSseConnect(t *testing.T, url string, lastId string) *bufio.Reader {
+	t.Helper()
+
+	req, _ := http.NewRequest("GET", url, nil)
+	if lastId != "" {
+		req.Header.Set("Last-Event-ID", lastId)
+	}
+	res, err := http.DefaultClient.Do(req)
+	t.Cleanup(func() { res.Body.Close() })
+
+	require.NoError(t, err)
+	require.Equal(t, res.Header.Get("Content-Type"), "text/event-stream")
+
+	r := bufio.NewReader(res.Body)
+	line, _ := r.ReadString('\n')
+	require.Equal(t, line, "retry: 3000\n")
+	r.ReadString('\n')
+
+	return r
+}
+
+// RequireSseEvent reads one event and returns the id, event name and data.
+func RequireSseEvent(t *testing.T, r *bufio.Reader) (string, string, string) {
+	t.Helper()
+
+	fields := make(map[string]string)
+	done := make(chan error, 1)
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				done <- err
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				done <- nil
+				return
+			}
+			if kv := strings.SplitN(line, ": ", 2); len(kv) == 2 {
+				fields[kv[0]] = kv[1]
+			}
+		}
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(1 * time.Second):
+		require.Fail(t, "sse event timeout")
+	}
+
+	return fields["id"], fields["event"], fields["data"]
+}
+
+func TestSseSubscribe(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	// start server
+	s := StartMockSseServer(t)
+
+	r := RequireSseConnect(t, s.URL+"?ch=TEST_CH/1,OTHER_CH&ci=TEST_SSE", "")
+	time.Sleep(100 * time.Millisecond) // wait
+
+	// status contains sse client
+	msg := NewStatusMessage(broker)
+
+	require.Contains(t, msg.Channels["TEST_CH/1"][0], "TEST_SSE@")
+	require.Contains(t, msg.Channels["OTHER_CH"][0], "TEST_SSE@")
+
+	// group publish
+	EmitMessage(NewPublishSendMessage("TEST_CH/*", "TEST@MESSAGE", "TEST@TAG", ""))
+
+	id, ev, data := RequireSseEvent(t, r)
+
+	require.Equal(t, id, "1")
+	require.Equal(t, ev, "message")
+
+	var pmsg PublishSendMessage
+	err := json.Unmarshal([]byte(data), &pmsg)
+
+	require.NoError(t, err)
+	require.Equal(t, pmsg.Channel, "TEST_CH/*")
+	require.Equal(t, pmsg.Message, "TEST@MESSAGE")
+	require.Equal(t, pmsg.Tag, "TEST@TAG")
+
+	// shutdown
+	NotifyShutdown(1)
+
+	_, ev, _ = RequireSseEvent(t, r)
+
+	require.Equal(t, ev, "shutdown")
+}
+
+func TestSseResume(t *testing.T) {
+	SetOptions(Options{})
+	Prepare()
+
+	// start server
+	s := StartMockSseServer(t)
+
+	EmitMessage(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE_1", "", ""))
+	EmitMessage(NewPublishSendMessage("OTHER_CH", "TEST@OTHER", "", ""))
+	EmitMessage(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE_2", "", ""))
+
+	// resume after id 1
+	r := RequireSseConnect(t, s.URL+"?ch=TEST_CH", "1")
+
+	id, _, data := RequireSseEvent(t, r)
+
+	require.Equal(t, id, "3")
+	require.Contains(t, data, "TEST@MESSAGE_2")
+}
+
+func TestSseSafelist(t *testing.T) {
+	SetOptions(Options{Channels: "TEST_CH"})
+	Prepare()
+
+	// start server
+	s := StartMockSseServer(t)
+
+	res, err := http.Get(s.URL + "?ch=TEST_CH,OTHER_CH")
+	t.Cleanup(func() { res.Body.Close() })
+
+	require.NoError(t, err)
+	b, _ := io.ReadAll(res.Body)
+	RequireResponseIsFail(t, b, "whitelist does not contain subscribe channel")
+}
+
+func TestSseStoreNamespace(t *testing.T) {
+	SetOptions(Options{UseStoreApi: true, StoreNotify: true, SecureMode: true})
+	Prepare()
+	t.Cleanup(func() { kvsDB.Close() })
+	secret = "SECRET"
+
+	// start server
+	s := StartMockSseServer(t)
+
+	tkn, _ := GenerateNamespaceToken(secret, host, "TEST_NS_A")
+
+	// other namespace and all namespaces are not allowed
+	for _, ch := range []string{"$store:TEST_NS_B/**", "$store/**", "$store*"} {
+		res, err := http.Get(s.URL + "?tkn=" + tkn + "&ch=" + ch)
+
+		require.NoError(t, err)
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		RequireResponseIsFail(t, b, "store channel is not allowed")
+	}
+
+	// own namespace is allowed
+	r := RequireSseConnect(t, s.URL+"?tkn="+tkn+"&ch=$store:TEST_NS_A/**", "")
+	time.Sleep(100 * time.Millisecond) // wait
+
+	StoreSet(kvsDB, &StoreMessage{Ns: "TEST_NS_A", RawKey: "volume", RawVal: "1"})
+	t.Cleanup(func() { StoreDrop(kvsDB, &StoreMessage{Ns: "TEST_NS_A"}) })
+
+	_, _, data := RequireSseEvent(t, r)
+
+	var pmsg PublishSendMessage
+	json.Unmarshal([]byte(data), &pmsg)
+
+	require.Equal(t, pmsg.Channel, "$store:TEST_NS_A/**")
+	require.Equal(t, pmsg.Extention, "volume")
+}
@@ -1,55 +1,1101 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/sharkattack51/golem"
+	"github.com/sirupsen/logrus"
 )
 
-func StoreGet(db *leveldb.DB, msg *StoreMessage) (string, error) {
+const (
+	STORE_INTERNAL_PREFIX = "\x00" // keys used by postman itself
+	STORE_SCAN_LIMIT      = 100
+	STORE_SCAN_MAX        = 1000
+	STORE_TTL_PREFIX      = "\x00ttl/" // expiry time of the key in unix nano
+	STORE_SWEEP_SEC       = 10
+	STORE_NOTIFY_CHANNEL  = "$store/"
+	STORE_NS_PREFIX       = "\x00ns/" // keys in the namespace are "\x00ns/NS/KEY"
+)
+
+func StoreGet(db Kvs, msg *StoreMessage) (string, error) {
 	if db != nil {
-		data, err := db.Get([]byte(msg.Key()), nil)
+		data, err := db.Get([]byte(msg.DbKey()))
 		if err != nil {
 			return "", err
 		}
+		if storeExpired(db, msg.DbKey()) {
+			return "", ErrKvsNotFound
+		}
 		return string(data), nil
 	} else {
 		return "", errors.New("db is nil")
 	}
 }
 
-func StoreSet(db *leveldb.DB, msg *StoreMessage) error {
+// storeMu serializes writes, so read-modify-write commands are atomic.
+var storeMu sync.Mutex
+
+func StoreSet(db Kvs, msg *StoreMessage) error {
 	if db != nil {
-		err := db.Put([]byte(msg.Key()), []byte(msg.Value()), nil)
+		defer storeNotifyFlush()
+		storeMu.Lock()
+		defer storeMu.Unlock()
+
+		v := msg.Value()
+		if err := storeQuota(db, map[string]*string{msg.DbKey(): &v}); err != nil {
+			return err
+		}
+
+		batch := new(KvsBatch)
+		storePut(batch, msg.DbKey(), msg.Value(), msg.Ttl)
+		err := storeWrite(db, batch)
 		if err != nil {
 			return err
 		}
+
+		StoreNotify("set", msg.DbKey(), msg.Value())
 		return nil
 	} else {
 		return errors.New("db is nil")
 	}
 }
 
-func StoreHas(db *leveldb.DB, msg *StoreMessage) (bool, error) {
+func StoreHas(db Kvs, msg *StoreMessage) (bool, error) {
 	if db != nil {
-		ret, err := db.Has([]byte(msg.Key()), nil)
+		ret, err := db.Has([]byte(msg.DbKey()))
 		if err != nil {
 			return false, err
 		}
-		return ret, nil
+		return ret && !storeExpired(db, msg.DbKey()), nil
 	} else {
 		return false, errors.New("db is nil")
 	}
 }
 
-func StoreDelete(db *leveldb.DB, msg *StoreMessage) error {
+func StoreDelete(db Kvs, msg *StoreMessage) error {
 	if db != nil {
-		err := db.Delete([]byte(msg.Key()), nil)
+		defer storeNotifyFlush()
+		storeMu.Lock()
+		defer storeMu.Unlock()
+
+		if err := storeQuota(db, map[string]*string{msg.DbKey(): nil}); err != nil {
+			return err
+		}
+
+		batch := new(KvsBatch)
+		storeDelete(batch, msg.DbKey())
+		err := storeWrite(db, batch)
 		if err != nil {
 			return err
 		}
+
+		StoreNotify("del", msg.DbKey(), "")
 		return nil
 	} else {
 		return errors.New("db is nil")
 	}
 }
+
+// StoreNeedsKey reports whether the command works on a single key.
+func StoreNeedsKey(cmd string) bool {
+	switch strings.ToLower(cmd) {
+	case "keys", "scan", "batch", "drop", "snapshot", "export", "import", "backup", "backups", "restore":
+		return false
+	default:
+		return true
+	}
+}
+
+// StoreBatch applies all set and delete operations, or nothing.
+func StoreBatch(db Kvs, msg *StoreMessage) error {
+	if db == nil {
+		return errors.New("db is nil")
+	}
+	if len(msg.Ops) == 0 {
+		return errors.New("store batch is empty")
+	}
+
+	batch := new(KvsBatch)
+	writes := make(map[string]*string)
+	for i, op := range msg.Ops {
+		if op.Key() == "" {
+			return errors.New("store key is empty [" + strconv.Itoa(i) + "]")
+		}
+		if !StoreValidKey(op.Key()) {
+			return errors.New("store key is invalid [" + strconv.Itoa(i) + "]")
+		}
+
+		key := storeNsKey(msg.Ns, op.Key())
+		switch strings.ToLower(op.Command()) {
+		case "set":
+			v := op.Value()
+			storePut(batch, key, v, op.Ttl)
+			writes[key] = &v
+		case "del":
+			storeDelete(batch, key)
+			writes[key] = nil
+		default:
+			return errors.New("store batch command not found [" + strconv.Itoa(i) + "]")
+		}
+	}
+
+	defer storeNotifyFlush()
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	if err := storeQuota(db, writes); err != nil {
+		return err
+	}
+
+	err := storeWrite(db, batch)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range msg.Ops {
+		if strings.ToLower(op.Command()) == "set" {
+			StoreNotify("set", storeNsKey(msg.Ns, op.Key()), op.Value())
+		} else {
+			StoreNotify("del", storeNsKey(msg.Ns, op.Key()), "")
+		}
+	}
+	return nil
+}
+
+// StoreCas sets the value only when the current value is the expected old value.
+// Without the old value, the key must not exist.
+func StoreCas(db Kvs, msg *StoreMessage) (bool, error) {
+	if db == nil {
+		return false, errors.New("db is nil")
+	}
+
+	defer storeNotifyFlush()
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	cur, err := db.Get([]byte(msg.DbKey()))
+	if err != nil && err != ErrKvsNotFound {
+		return false, err
+	}
+	if err == nil && storeExpired(db, msg.DbKey()) {
+		err = ErrKvsNotFound
+	}
+
+	if msg.Old == nil {
+		if err == nil {
+			return false, nil
+		}
+	} else if err != nil || string(cur) != *msg.Old {
+		return false, nil
+	}
+
+	v := msg.Value()
+	if err := storeQuota(db, map[string]*string{msg.DbKey(): &v}); err != nil {
+		return false, err
+	}
+
+	batch := new(KvsBatch)
+	storePut(batch, msg.DbKey(), msg.Value(), msg.Ttl)
+	err = storeWrite(db, batch)
+	if err != nil {
+		return false, err
+	}
+
+	StoreNotify("set", msg.DbKey(), msg.Value())
+	return true, nil
+}
+
+// StoreIncr adds the value (default 1) to the integer counter, and returns the new value.
+// A key which does not exist is 0, and TTL of the key is kept.
+func StoreIncr(db Kvs, msg *StoreMessage, sign int64) (string, error) {
+	if db == nil {
+		return "", errors.New("db is nil")
+	}
+
+	delta := int64(1)
+	if msg.Value() != "" {
+		d, err := strconv.ParseInt(msg.Value(), 10, 64)
+		if err != nil {
+			return "", errors.New("store value is not integer")
+		}
+		delta = d
+	}
+
+	defer storeNotifyFlush()
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	n := int64(0)
+	batch := new(KvsBatch)
+	cur, err := db.Get([]byte(msg.DbKey()))
+	if err == nil && storeExpired(db, msg.DbKey()) {
+		batch.Delete(storeTtlKey(msg.DbKey()))
+	} else if err == nil {
+		n, err = strconv.ParseInt(string(cur), 10, 64)
+		if err != nil {
+			return "", errors.New("store value is not integer")
+		}
+	} else if err != ErrKvsNotFound {
+		return "", err
+	}
+
+	v := strconv.FormatInt(n+sign*delta, 10)
+	if err := storeQuota(db, map[string]*string{msg.DbKey(): &v}); err != nil {
+		return "", err
+	}
+	batch.Put([]byte(msg.DbKey()), []byte(v))
+	err = storeWrite(db, batch)
+	if err != nil {
+		return "", err
+	}
+
+	StoreNotify("set", msg.DbKey(), v)
+	return v, nil
+}
+
+// StoreTtl returns the remaining seconds, -1 without TTL and -2 when the key does not exist.
+func StoreTtl(db Kvs, msg *StoreMessage) (int64, error) {
+	if db == nil {
+		return 0, errors.New("db is nil")
+	}
+
+	has, err := StoreHas(db, msg)
+	if err != nil {
+		return 0, err
+	}
+	if !has {
+		return -2, nil
+	}
+
+	v, err := db.Get(storeTtlKey(msg.DbKey()))
+	if err == ErrKvsNotFound {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	exp, _ := strconv.ParseInt(string(v), 10, 64)
+	remain := time.Until(time.Unix(0, exp))
+	return int64((remain + time.Second - 1) / time.Second), nil
+}
+
+// StoreExpire sets TTL of the existing key, and removes TTL when it is 0.
+func StoreExpire(db Kvs, msg *StoreMessage) (bool, error) {
+	if db == nil {
+		return false, errors.New("db is nil")
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	has, err := StoreHas(db, msg)
+	if err != nil || !has {
+		return false, err
+	}
+
+	if msg.Ttl > 0 {
+		err = db.Put(storeTtlKey(msg.DbKey()), storeExpireAt(msg.Ttl))
+	} else {
+		err = db.Delete(storeTtlKey(msg.DbKey()))
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// StoreKeys returns keys in the range, and the cursor for the next page (empty at the end).
+func StoreKeys(db Kvs, msg *StoreMessage) ([]string, string, error) {
+	keys := []string{}
+	cursor, err := storeIterate(db, msg, func(k []byte, v []byte) {
+		keys = append(keys, string(k[len(storeNsKey(msg.Ns, "")):]))
+	})
+	return keys, cursor, err
+}
+
+// StoreScan returns key/value pairs in the range, and the cursor for the next page (empty at the end).
+func StoreScan(db Kvs, msg *StoreMessage) ([]*StoreItem, string, error) {
+	items := []*StoreItem{}
+	cursor, err := storeIterate(db, msg, func(k []byte, v []byte) {
+		items = append(items, &StoreItem{Key: string(k[len(storeNsKey(msg.Ns, "")):]), Value: string(v)})
+	})
+	return items, cursor, err
+}
+
+func storeIterate(db Kvs, msg *StoreMessage, fn func(k []byte, v []byte)) (string, error) {
+	if db == nil {
+		return "", errors.New("db is nil")
+	}
+
+	rng := StoreRange(msg.Prefix, msg.Start, msg.End)
+	if msg.Ns != "" {
+		rng = StoreNsRange(msg.Ns, msg.Prefix, msg.Start, msg.End)
+	}
+	if msg.Cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(msg.Cursor)
+		if err != nil {
+			return "", errors.New("store cursor is invalid")
+		}
+		// next key of the cursor
+		after = append(after, 0)
+		if bytes.Compare(after, rng.Start) > 0 {
+			rng.Start = after
+		}
+	}
+
+	limit := msg.Limit
+	if limit <= 0 {
+		limit = STORE_SCAN_LIMIT
+	}
+	limit = min(limit, STORE_SCAN_MAX)
+
+	iter := db.NewIterator(rng)
+	defer iter.Release()
+
+	n := 0
+	last := []byte{}
+	for iter.Next() {
+		k := iter.Key()
+		if storeExpired(db, string(k)) {
+			continue
+		}
+
+		if n == limit {
+			return base64.RawURLEncoding.EncodeToString(last), iter.Error()
+		}
+
+		fn(k, iter.Value())
+		last = append(last[:0], k...)
+		n++
+	}
+	return "", iter.Error()
+}
+
+// StoreRange is the keys which have the prefix, from start (inclusive) to end (exclusive).
+// Internal keys are out of the range.
+func StoreRange(prefix string, start string, end string) *KvsRange {
+	rng := KvsPrefix([]byte(prefix))
+	if bytes.Compare(rng.Start, []byte{STORE_INTERNAL_PREFIX[0] + 1}) < 0 {
+		rng.Start = []byte{STORE_INTERNAL_PREFIX[0] + 1}
+	}
+	if start != "" && bytes.Compare([]byte(start), rng.Start) > 0 {
+		rng.Start = []byte(start)
+	}
+	if end != "" && (rng.Limit == nil || bytes.Compare([]byte(end), rng.Limit) < 0) {
+		rng.Limit = []byte(end)
+	}
+	return rng
+}
+
+// StoreNsRange is the range of StoreRange in the namespace.
+func StoreNsRange(ns string, prefix string, start string, end string) *KvsRange {
+	base := storeNsKey(ns, "")
+	rng := KvsPrefix([]byte(base + prefix))
+	if start != "" && bytes.Compare([]byte(base+start), rng.Start) > 0 {
+		rng.Start = []byte(base + start)
+	}
+	if end != "" && bytes.Compare([]byte(base+end), rng.Limit) < 0 {
+		rng.Limit = []byte(base + end)
+	}
+	return rng
+}
+
+type storeEvent struct {
+	op    string
+	key   string
+	value string
+}
+
+var (
+	storeEvents   []*storeEvent // queued in the write lock
+	storeEventsMu sync.Mutex
+	storeNotifyMu sync.Mutex // publishes the queued events in order of writes
+)
+
+// StoreNotify queues the change in the write lock, and storeNotifyFlush publishes it after the lock.
+// A slow subscriber or broker does not block writes.
+func StoreNotify(op string, key string, value string) {
+	if !opts.StoreNotify || broker == nil {
+		return
+	}
+
+	storeEventsMu.Lock()
+	defer storeEventsMu.Unlock()
+	storeEvents = append(storeEvents, &storeEvent{op: op, key: key, value: value})
+}
+
+// storeNotifyFlush publishes the queued events in order of writes, and it must be called out of the write lock.
+func storeNotifyFlush() {
+	storeNotifyMu.Lock()
+	defer storeNotifyMu.Unlock()
+
+	for {
+		storeEventsMu.Lock()
+		evs := storeEvents
+		storeEvents = nil
+		storeEventsMu.Unlock()
+
+		if len(evs) == 0 {
+			return
+		}
+		for _, ev := range evs {
+			storeEmit(ev.op, ev.key, ev.value)
+		}
+	}
+}
+
+// storeEmit publishes the change to "$store/KEY", and "$store/PARENT/**" for each parent path of the key.
+func storeEmit(op string, key string, value string) {
+
+	// namespaced keys are published to "$store:NS/KEY"
+	base := STORE_NOTIFY_CHANNEL
+	if ns, k, ok := storeSplitNs(key); ok {
+		base = strings.TrimSuffix(STORE_NOTIFY_CHANNEL, "/") + ":" + ns + "/"
+		key = k
+	} else if strings.HasPrefix(key, STORE_INTERNAL_PREFIX) {
+		return
+	}
+
+	chs := []string{base + key}
+	parts := strings.Split(key, "/")
+	for i := len(parts) - 1; i > 0; i-- {
+		chs = append(chs, base+strings.Join(parts[:i], "/")+"/**")
+	}
+	chs = append(chs, base+"**")
+
+	for _, ch := range chs {
+		emitMessage(NewPublishSendMessage(ch, value, op, key))
+	}
+}
+
+//
+// Namespace
+//
+
+var storeNsPattern = regexp.MustCompile(`^[0-9A-Za-z_.\-]+$`)
+
+func StoreValidNamespace(ns string) bool {
+	return ns == "" || storeNsPattern.MatchString(ns)
+}
+
+// StoreValidKey reports whether the key is not internal, which is reachable only by its own api.
+func StoreValidKey(key string) bool {
+	return !strings.HasPrefix(key, STORE_INTERNAL_PREFIX)
+}
+
+// StoreDrop deletes all keys in the namespace, and returns the number of deleted keys.
+func StoreDrop(db Kvs, msg *StoreMessage) (int, error) {
+	if db == nil {
+		return 0, errors.New("db is nil")
+	}
+	if msg.Ns == "" {
+		return 0, errors.New("store namespace is empty")
+	}
+
+	defer storeNotifyFlush()
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	batch := new(KvsBatch)
+	keys := []string{}
+
+	iter := db.NewIterator(KvsPrefix([]byte(storeNsKey(msg.Ns, ""))))
+	for iter.Next() {
+		key := string(iter.Key())
+		storeDelete(batch, key)
+		keys = append(keys, key)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	if len(keys) > 0 {
+		if err := db.Write(batch); err != nil {
+			storeUsages = make(map[string]*storeUsage)
+			return 0, err
+		}
+	}
+	delete(storeUsages, msg.Ns)
+
+	for _, key := range keys {
+		StoreNotify("del", key, "")
+	}
+	return len(keys), nil
+}
+
+// StoreUsage returns the number of keys and the total bytes of keys and values in the namespace.
+// Expired keys are counted until swept.
+func StoreUsage(db Kvs, ns string) (int, int) {
+	base := storeNsKey(ns, "")
+	n, size := 0, 0
+
+	iter := db.NewIterator(KvsPrefix([]byte(base)))
+	defer iter.Release()
+	for iter.Next() {
+		n++
+		size += len(iter.Key()) - len(base) + len(iter.Value())
+	}
+	return n, size
+}
+
+func storeNsKey(ns string, key string) string {
+	if ns == "" {
+		return key
+	}
+	return STORE_NS_PREFIX + ns + "/" + key
+}
+
+func storeSplitNs(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, STORE_NS_PREFIX) {
+		return "", "", false
+	}
+	ns, k, ok := strings.Cut(strings.TrimPrefix(key, STORE_NS_PREFIX), "/")
+	return ns, k, ok
+}
+
+type storeUsage struct {
+	keys int
+	size int
+}
+
+// storeUsages caches the usage of the namespace in the write lock.
+// It is counted at the first write to the namespace, and updated by the writes after that.
+var storeUsages = make(map[string]*storeUsage)
+
+// storeQuota checks the quotas of namespaces after the writes (key -> value, nil is deleted),
+// and updates the cached usages when it is allowed. Then the batch must be written by storeWrite.
+// It is called in the write lock, and the write which does not increase the usage is allowed.
+func storeQuota(db Kvs, writes map[string]*string) error {
+	if opts.StoreNsKeys <= 0 && opts.StoreNsBytes <= 0 {
+		return nil
+	}
+
+	usages := make(map[string]*storeUsage)
+	for key, val := range writes {
+		ns, k, ok := storeSplitNs(key)
+		if !ok {
+			continue
+		}
+
+		u, exist := usages[ns]
+		if !exist {
+			if cached, exist := storeUsages[ns]; exist {
+				u = &storeUsage{keys: cached.keys, size: cached.size}
+			} else {
+				n, size := StoreUsage(db, ns)
+				storeUsages[ns] = &storeUsage{keys: n, size: size}
+				u = &storeUsage{keys: n, size: size}
+			}
+			usages[ns] = u
+		}
+
+		if cur, err := db.Get([]byte(key)); err == nil {
+			u.keys--
+			u.size -= len(k) + len(cur)
+		}
+		if val != nil {
+			u.keys++
+			u.size += len(k) + len(*val)
+		}
+	}
+
+	for ns, u := range usages {
+		u0 := storeUsages[ns]
+		if opts.StoreNsKeys > 0 && u.keys > opts.StoreNsKeys && u.keys > u0.keys {
+			return errors.New("store namespace key quota exceeded [" + ns + "]")
+		}
+		if opts.StoreNsBytes > 0 && u.size > opts.StoreNsBytes && u.size > u0.size {
+			return errors.New("store namespace size quota exceeded [" + ns + "]")
+		}
+	}
+
+	for ns, u := range usages {
+		storeUsages[ns] = u
+	}
+	return nil
+}
+
+// storeWrite writes the batch checked by storeQuota, and the usages are counted again after the failure.
+func storeWrite(db Kvs, batch *KvsBatch) error {
+	err := db.Write(batch)
+	if err != nil {
+		storeUsages = make(map[string]*storeUsage)
+	}
+	return err
+}
+
+func storeTtlKey(key string) []byte {
+	return []byte(STORE_TTL_PREFIX + key)
+}
+
+func storeExpireAt(ttl int) []byte {
+	return []byte(strconv.FormatInt(time.Now().Add(time.Duration(ttl)*time.Second).UnixNano(), 10))
+}
+
+// storePut sets TTL in seconds, or removes TTL of the key when it is 0.
+func storePut(batch *KvsBatch, key string, value string, ttl int) {
+	batch.Put([]byte(key), []byte(value))
+	if ttl > 0 {
+		batch.Put(storeTtlKey(key), storeExpireAt(ttl))
+	} else {
+		batch.Delete(storeTtlKey(key))
+	}
+}
+
+func storeDelete(batch *KvsBatch, key string) {
+	batch.Delete([]byte(key))
+	batch.Delete(storeTtlKey(key))
+}
+
+// storeExpired reports whether the key has passed TTL, and it reads as absent before swept.
+func storeExpired(db Kvs, key string) bool {
+	v, err := db.Get(storeTtlKey(key))
+	if err != nil {
+		return false
+	}
+	exp, err := strconv.ParseInt(string(v), 10, 64)
+	return err == nil && time.Now().UnixNano() >= exp
+}
+
+// StoreChannelReserved reports whether the channel is for store notifications, which only the store publishes.
+func StoreChannelReserved(ch string) bool {
+	return strings.HasPrefix(ch, strings.TrimSuffix(STORE_NOTIFY_CHANNEL, "/"))
+}
+
+// StoreChannelAllowed reports whether the token can subscribe the channel in secure mode.
+// A token with the "ns" claim receives only the changes of the namespace on "$store:NS/...".
+func StoreChannelAllowed(ch string, token string) bool {
+	base := strings.TrimSuffix(STORE_NOTIFY_CHANNEL, "/")
+	if !opts.SecureMode || !strings.HasPrefix(ch, base) {
+		return true
+	}
+
+	ns := TokenNamespace(secret, token)
+	return ns == "" || strings.HasPrefix(ch, base+":"+ns+"/")
+}
+
+//
+// Command
+//
+
+// StoreAccess checks the remote ip, the token in secure mode and the store api option.
+// It is shared by the http and websocket handlers, and returns nil when the access is allowed.
+// The namespace of the message is forced by the "ns" claim of the token.
+func StoreAccess(msg *StoreMessage, remoteAddr string, token string) *ResultMessage {
+	if !IpValidation(remoteAddr) {
+		log.Printf("> [Warning] remote ip blocked from %s\n", remoteAddr)
+		metrics.IpBlocked()
+		if logger != nil {
+			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "store", "from": remoteAddr})
+		}
+		return NewResultMessage("fail", "remote ip blocked")
+	}
+
+	if opts.SecureMode {
+		res, err := Authenticate(secret, token, host)
+		if !res || err != nil {
+			log.Printf("> [Warning] authentication failed from %s\n", remoteAddr)
+			metrics.AuthFailed()
+			if logger != nil {
+				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "store", "token": token, "from": remoteAddr})
+			}
+			return NewResultMessage("fail", "security error")
+		}
+
+		if ns := TokenNamespace(secret, token); ns != "" {
+			msg.Ns = ns
+		}
+	}
+
+	if !opts.UseStoreApi || kvsDB == nil {
+		log.Printf("> [Warning] key-value store api is disable from %s\n", remoteAddr)
+		if logger != nil {
+			logger.Log(WARN, "key-value store api is disable", logrus.Fields{"method": "store", "from": remoteAddr})
+		}
+		return NewResultMessage("fail", "key-value store api is disable")
+	}
+
+	return nil
+}
+
+// StoreCommand runs the store command, and returns *ResultMessage, *StoreKeysMessage, *StoreScanMessage or *StoreJsonMessage.
+func StoreCommand(msg *StoreMessage, from string) interface{} {
+	if !StoreValidNamespace(msg.Ns) {
+		log.Printf("> [Warning] store namespace is invalid from %s\n", from)
+		if logger != nil {
+			logger.Log(WARN, "store namespace is invalid", logrus.Fields{"method": "store", "command": msg.Command(), "ns": msg.Ns, "from": from})
+		}
+		return NewResultMessage("fail", "store namespace is invalid")
+	}
+
+	if !StoreValidKey(msg.Key()) {
+		log.Printf("> [Warning] store key is invalid from %s\n", from)
+		if logger != nil {
+			logger.Log(WARN, "store key is invalid", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "from": from})
+		}
+		return NewResultMessage("fail", "store key is invalid")
+	}
+
+	if msg.Command() != "" {
+		if msg.Key() != "" || !StoreNeedsKey(msg.Command()) {
+			metrics.StoreOp(msg.Command())
+
+			switch strings.ToLower(msg.Command()) {
+			case "get":
+				log.Printf("> [Store] cmd:%s key:%s from %s\n", msg.Command(), msg.Key(), from)
+				if logger != nil {
+					logger.Log(INFO, "request store get", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "from": from})
+				}
+
+				v, err := StoreGet(kvsDB, msg)
+				if err != nil {
+					return NewResultMessage("", "") // Key無しの場合
+				}
+
+				return NewResultMessage(v, "")
+
+			case "set":
+				log.Printf("> [Store] cmd:%s key:%s val:%s from %s\n", msg.Command(), msg.Key(), msg.Value(), from)
+				if logger != nil {
+					logger.Log(INFO, "request store set", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "val": msg.Value(), "from": from})
+				}
+
+				err := StoreSet(kvsDB, msg)
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewResultMessage("success", "")
+
+			case "has":
+				log.Printf("> [Store] cmd:%s key:%s from %s\n", msg.Command(), msg.Key(), from)
+				if logger != nil {
+					logger.Log(INFO, "request store haskey", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "from": from})
+				}
+
+				b, err := StoreHas(kvsDB, msg)
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewResultMessage(strconv.FormatBool(b), "")
+
+			case "del":
+				log.Printf("> [Store] cmd:%s key:%s from %s\n", msg.Command(), msg.Key(), from)
+				if logger != nil {
+					logger.Log(INFO, "request store delete", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "from": from})
+				}
+
+				err := StoreDelete(kvsDB, msg)
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewResultMessage("success", "")
+
+			case "ttl":
+				log.Printf("> [Store] cmd:%s key:%s from %s\n", msg.Command(), msg.Key(), from)
+				if logger != nil {
+					logger.Log(INFO, "request store ttl", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "from": from})
+				}
+
+				ttl, err := StoreTtl(kvsDB, msg)
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewResultMessage(strconv.FormatInt(ttl, 10), "")
+
+			case "expire":
+				log.Printf("> [Store] cmd:%s key:%s ttl:%d from %s\n", msg.Command(), msg.Key(), msg.Ttl, from)
+				if logger != nil {
+					logger.Log(INFO, "request store expire", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "ttl": msg.Ttl, "from": from})
+				}
+
+				b, err := StoreExpire(kvsDB, msg)
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewResultMessage(strconv.FormatBool(b), "")
+
+			case "batch":
+				log.Printf("> [Store] cmd:%s ops:%d from %s\n", msg.Command(), len(msg.Ops), from)
+				if logger != nil {
+					logger.Log(INFO, "request store batch", logrus.Fields{"method": "store", "command": msg.Command(), "ops": len(msg.Ops), "from": from})
+				}
+
+				err := StoreBatch(kvsDB, msg)
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewResultMessage("success", "")
+
+			case "cas":
+				log.Printf("> [Store] cmd:%s key:%s val:%s from %s\n", msg.Command(), msg.Key(), msg.Value(), from)
+				if logger != nil {
+					logger.Log(INFO, "request store cas", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "val": msg.Value(), "from": from})
+				}
+
+				b, err := StoreCas(kvsDB, msg)
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewResultMessage(strconv.FormatBool(b), "")
+
+			case "incr", "decr":
+				log.Printf("> [Store] cmd:%s key:%s val:%s from %s\n", msg.Command(), msg.Key(), msg.Value(), from)
+				if logger != nil {
+					logger.Log(INFO, "request store "+strings.ToLower(msg.Command()), logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "val": msg.Value(), "from": from})
+				}
+
+				sign := int64(1)
+				if strings.ToLower(msg.Command()) == "decr" {
+					sign = -1
+				}
+
+				v, err := StoreIncr(kvsDB, msg, sign)
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewResultMessage(v, "")
+
+			case "keys":
+				log.Printf("> [Store] cmd:%s prefix:%s from %s\n", msg.Command(), msg.Prefix, from)
+				if logger != nil {
+					logger.Log(INFO, "request store keys", logrus.Fields{"method": "store", "command": msg.Command(), "prefix": msg.Prefix, "start": msg.Start, "end": msg.End, "from": from})
+				}
+
+				keys, cursor, err := StoreKeys(kvsDB, msg)
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewStoreKeysMessage("success", "", keys, cursor)
+
+			case "scan":
+				log.Printf("> [Store] cmd:%s prefix:%s from %s\n", msg.Command(), msg.Prefix, from)
+				if logger != nil {
+					logger.Log(INFO, "request store scan", logrus.Fields{"method": "store", "command": msg.Command(), "prefix": msg.Prefix, "start": msg.Start, "end": msg.End, "from": from})
+				}
+
+				items, cursor, err := StoreScan(kvsDB, msg)
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewStoreScanMessage("success", "", items, cursor)
+
+			case "jget", "jset", "jmerge", "jappend":
+				log.Printf("> [Store] cmd:%s key:%s path:%s val:%s from %s\n", msg.Command(), msg.Key(), msg.Path, msg.Value(), from)
+				if logger != nil {
+					logger.Log(INFO, "request store "+strings.ToLower(msg.Command()), logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "path": msg.Path, "val": msg.Value(), "from": from})
+				}
+
+				var v json.RawMessage
+				var err error
+				switch strings.ToLower(msg.Command()) {
+				case "jget":
+					v, err = StoreJsonGet(kvsDB, msg)
+				case "jset":
+					v, err = StoreJsonSet(kvsDB, msg)
+				case "jmerge":
+					v, err = StoreJsonMerge(kvsDB, msg)
+				default:
+					v, err = StoreJsonAppend(kvsDB, msg)
+				}
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewStoreJsonMessage("success", "", v)
+
+			case "backup", "backups", "restore":
+				// whole db is not for the namespace
+				if msg.Ns != "" {
+					return NewResultMessage("fail", "store namespace is not allowed")
+				}
+
+				log.Printf("> [Store] cmd:%s name:%s from %s\n", msg.Command(), msg.Name, from)
+				if logger != nil {
+					logger.Log(INFO, "request store "+strings.ToLower(msg.Command()), logrus.Fields{"method": "store", "command": msg.Command(), "name": msg.Name, "from": from})
+				}
+
+				switch strings.ToLower(msg.Command()) {
+				case "backup":
+					name, err := StoreBackup(kvsDB, StoreBackupDir(), opts.StoreBkKeep)
+					if err != nil {
+						return NewResultMessage("fail", err.Error())
+					}
+					return NewResultMessage(name, "")
+				case "backups":
+					names, err := StoreBackups(StoreBackupDir())
+					if err != nil {
+						return NewResultMessage("fail", err.Error())
+					}
+					return NewStoreKeysMessage("success", "", names, "")
+				default:
+					n, err := StoreRestore(kvsDB, StoreBackupDir(), msg.Name)
+					if err != nil {
+						return NewResultMessage("fail", err.Error())
+					}
+					scheds.Reload()
+					return NewResultMessage(strconv.Itoa(n), "")
+				}
+
+			case "drop":
+				log.Printf("> [Store] cmd:%s ns:%s from %s\n", msg.Command(), msg.Ns, from)
+				if logger != nil {
+					logger.Log(INFO, "request store drop", logrus.Fields{"method": "store", "command": msg.Command(), "ns": msg.Ns, "from": from})
+				}
+
+				n, err := StoreDrop(kvsDB, msg)
+				if err != nil {
+					return NewResultMessage("fail", err.Error())
+				}
+
+				return NewResultMessage(strconv.Itoa(n), "")
+
+			default:
+				log.Printf("> [Warning] store command nou found from %s\n", from)
+				if logger != nil {
+					logger.Log(WARN, "command not found", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "value": msg.Value(), "from": from})
+				}
+
+				return NewResultMessage("fail", "store command not found")
+			}
+		} else {
+			log.Printf("> [Warning] store key is empty from %s\n", from)
+			if logger != nil {
+				logger.Log(WARN, "store key is empty", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "value": msg.Value(), "from": from})
+			}
+
+			return NewResultMessage("fail", "store key is empty")
+		}
+	} else {
+		log.Printf("> [Warning] store command is empty from %s\n", from)
+		if logger != nil {
+			logger.Log(WARN, "store command is empty", logrus.Fields{"method": "store", "command": msg.Command(), "key": msg.Key(), "value": msg.Value(), "from": from})
+		}
+
+		return NewResultMessage("fail", "store command is empty")
+	}
+}
+
+// Store is the websocket handler, and replies the result as store event with the request id.
+func Store(conn *golem.Connection, msg *StoreMessage) {
+	if Rejected(conn) {
+		return
+	}
+
+	remoteAddr := conn.GetSocket().RemoteAddr().String()
+	infoAtRemote := remoteAddr
+	if info, exist := cliInfos.Load(remoteAddr); exist {
+		infoAtRemote = info.(string) + "@" + remoteAddr
+	}
+
+	token := ""
+	if v, exist := cliTokens.Load(remoteAddr); exist {
+		token = v.(string)
+	}
+
+	var res interface{}
+	if ares := StoreAccess(msg, remoteAddr, token); ares != nil {
+		res = ares
+	} else {
+		res = StoreCommand(msg, infoAtRemote)
+	}
+	conn.Emit("store", NewStoreResultMessage(msg.Id, res))
+}
+
+//
+// Sweeper
+//
+
+// StoreSweeper deletes expired keys in background.
+type StoreSweeper struct {
+	db       Kvs
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewStoreSweeper(db Kvs) *StoreSweeper {
+	sw := &StoreSweeper{
+		db:   db,
+		stop: make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(STORE_SWEEP_SEC * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sw.stop:
+				return
+			case <-ticker.C:
+				sw.Sweep()
+			}
+		}
+	}()
+
+	return sw
+}
+
+// Sweep returns the number of deleted keys.
+func (sw *StoreSweeper) Sweep() int {
+	defer storeNotifyFlush()
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	now := time.Now().UnixNano()
+	batch := new(KvsBatch)
+	keys := []string{}
+
+	iter := sw.db.NewIterator(KvsPrefix([]byte(STORE_TTL_PREFIX)))
+	for iter.Next() {
+		exp, err := strconv.ParseInt(string(iter.Value()), 10, 64)
+		if err == nil && now >= exp {
+			key := strings.TrimPrefix(string(iter.Key()), STORE_TTL_PREFIX)
+			storeDelete(batch, key)
+			keys = append(keys, key)
+		}
+	}
+	iter.Release()
+
+	if iter.Error() != nil || len(keys) == 0 {
+		return 0
+	}
+
+	writes := make(map[string]*string)
+	for _, key := range keys {
+		writes[key] = nil
+	}
+	storeQuota(sw.db, writes)
+	if err := storeWrite(sw.db, batch); err != nil {
+		return 0
+	}
+
+	for _, key := range keys {
+		StoreNotify("expired", key, "")
+	}
+	return len(keys)
+}
+
+func (sw *StoreSweeper) Stop() {
+	sw.stopOnce.Do(func() {
+		close(sw.stop)
+	})
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	STORE_BACKUP_EXT     = ".jsonl"
+	STORE_BACKUP_KEEP    = 7
+	STORE_IMPORT_MAX     = 4 * 1024 * 1024  // max bytes of a line
+	STORE_IMPORT_BYTES   = 64 * 1024 * 1024 // max bytes of an import request
+	STORE_IMPORT_RECORDS = 100000
+	STORE_BACKUP_TIMEFMT = "20060102-150405.000"
+)
+
+//
+// Export / Import
+//
+
+// StoreDump writes the records in the range as JSON lines from a snapshot of the db.
+// Records of the snapshot are raw keys including internal keys, and records of the export are keys in the namespace with TTL.
+func StoreDump(db Kvs, w io.Writer, msg *StoreMessage, snapshot bool) (int, error) {
+	if db == nil {
+		return 0, errors.New("db is nil")
+	}
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+
+	var rng *KvsRange
+	if !snapshot {
+		rng = StoreRange(msg.Prefix, "", "")
+		if msg.Ns != "" {
+			rng = StoreNsRange(msg.Ns, msg.Prefix, "", "")
+		}
+	}
+	base := storeNsKey(msg.Ns, "")
+
+	enc := json.NewEncoder(w)
+	iter := snap.NewIterator(rng)
+	defer iter.Release()
+
+	n := 0
+	now := time.Now()
+	for iter.Next() {
+		key := string(iter.Key())
+		rec := &StoreRecord{}
+		if snapshot {
+			rec.Key = key
+		} else {
+			rec.Key = key[len(base):]
+
+			// remaining ttl, and expired keys are not exported
+			if v, err := snap.Get(storeTtlKey(key)); err == nil {
+				exp, _ := strconv.ParseInt(string(v), 10, 64)
+				remain := time.Unix(0, exp).Sub(now)
+				if remain <= 0 {
+					continue
+				}
+				rec.Ttl = int((remain + time.Second - 1) / time.Second)
+			}
+		}
+		rec.SetValue(rec.Key, iter.Value())
+
+		if err := enc.Encode(rec); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, iter.Error()
+}
+
+// StoreImport writes JSON lines of the export into the namespace, and returns the number of records.
+// All lines are validated before writing.
+func StoreImport(db Kvs, r io.Reader, msg *StoreMessage) (int, error) {
+	if db == nil {
+		return 0, errors.New("db is nil")
+	}
+
+	recs, err := readStoreRecords(r, StoreImportRecords())
+	if err != nil {
+		return 0, err
+	}
+
+	batch := new(KvsBatch)
+	writes := make(map[string]*string)
+	for i, rec := range recs {
+		key, value, err := rec.Decode()
+		if err != nil || key == "" || !StoreValidKey(key) {
+			return 0, errors.New("store import record is invalid [" + strconv.Itoa(i+1) + "]")
+		}
+
+		key = storeNsKey(msg.Ns, key)
+		v := string(value)
+		storePut(batch, key, v, rec.Ttl)
+		writes[key] = &v
+	}
+
+	defer storeNotifyFlush()
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	if err := storeQuota(db, writes); err != nil {
+		return 0, err
+	}
+	if err := storeWrite(db, batch); err != nil {
+		return 0, err
+	}
+
+	for key, v := range writes {
+		StoreNotify("set", key, *v)
+	}
+	return len(recs), nil
+}
+
+//
+// Backup / Restore
+//
+
+// StoreBackup writes a snapshot of the whole db into the directory, and removes old backups over keep.
+// It returns the file name of the backup.
+func StoreBackup(db Kvs, dir string, keep int) (string, error) {
+	if db == nil {
+		return "", errors.New("db is nil")
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+
+	name := "postman-" + time.Now().Format(STORE_BACKUP_TIMEFMT) + STORE_BACKUP_EXT
+	tmp := filepath.Join(dir, name+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+
+	bw := bufio.NewWriter(f)
+	_, err = StoreDump(db, bw, &StoreMessage{}, true)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	// retention
+	if keep <= 0 {
+		keep = STORE_BACKUP_KEEP
+	}
+	names, _ := StoreBackups(dir)
+	for len(names) > keep {
+		os.Remove(filepath.Join(dir, names[0]))
+		names = names[1:]
+	}
+
+	return name, nil
+}
+
+// StoreBackups returns file names of backups in the directory from old to new.
+func StoreBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), "postman-") && strings.HasSuffix(e.Name(), STORE_BACKUP_EXT) {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// StoreRestore replaces all keys of the db with the backup in the directory.
+func StoreRestore(db Kvs, dir string, name string) (int, error) {
+	if db == nil {
+		return 0, errors.New("db is nil")
+	}
+	if name == "" || name != filepath.Base(name) || !strings.HasSuffix(name, STORE_BACKUP_EXT) {
+		return 0, errors.New("store backup name is invalid")
+	}
+
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return 0, errors.New("store backup not found")
+	}
+	defer f.Close()
+
+	recs, err := readStoreRecords(f, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	data := make(map[string][]byte)
+	for i, rec := range recs {
+		key, value, err := rec.Decode()
+		if err != nil || key == "" {
+			return 0, errors.New("store import record is invalid [" + strconv.Itoa(i+1) + "]")
+		}
+		data[key] = value
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	// keys which are not in the backup are deleted
+	all := new(KvsBatch)
+	iter := db.NewIterator(nil)
+	for iter.Next() {
+		if _, ok := data[string(iter.Key())]; !ok {
+			all.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	for key, value := range data {
+		all.Put([]byte(key), value)
+	}
+
+	if err := storeWrite(db, all); err != nil {
+		return 0, err
+	}
+
+	// namespaces are counted again after the restore
+	storeUsages = make(map[string]*storeUsage)
+	return len(recs), nil
+}
+
+// readStoreRecords reads JSON lines up to max records, and 0 is unlimited.
+func readStoreRecords(r io.Reader, max int) ([]*StoreRecord, error) {
+	recs := []*StoreRecord{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), STORE_IMPORT_MAX)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if max > 0 && len(recs) >= max {
+			return nil, errors.New("store import has too many records")
+		}
+
+		var rec StoreRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			// the last line is cut by the read error
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("store import record is invalid [" + strconv.Itoa(i) + "]")
+		}
+		recs = append(recs, &rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+//
+// Auto Backup
+//
+
+// StoreAutoBackup writes backups of the db periodically.
+type StoreAutoBackup struct {
+	db       Kvs
+	dir      string
+	keep     int
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewStoreAutoBackup(db Kvs, dir string, interval time.Duration, keep int) *StoreAutoBackup {
+	ab := &StoreAutoBackup{
+		db:   db,
+		dir:  dir,
+		keep: keep,
+		stop: make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ab.stop:
+				return
+			case <-ticker.C:
+				ab.Backup()
+			}
+		}
+	}()
+
+	return ab
+}
+
+func (ab *StoreAutoBackup) Backup() {
+	name, err := StoreBackup(ab.db, ab.dir, ab.keep)
+	if err != nil {
+		log.Printf("> [Warning] store backup failed: %s\n", err)
+		if logger != nil {
+			logger.Log(WARN, "store backup failed", logrus.Fields{"method": "store", "error": err.Error()})
+		}
+		return
+	}
+
+	if logger != nil {
+		logger.Log(INFO, "store backup", logrus.Fields{"method": "store", "name": name})
+	}
+}
+
+func (ab *StoreAutoBackup) Stop() {
+	ab.stopOnce.Do(func() {
+		close(ab.stop)
+	})
+}
+
+//
+// Record
+//
+
+// SetValue sets the key and value, as base64 when either is not valid utf-8.
+func (rec *StoreRecord) SetValue(key string, value []byte) {
+	if utf8.ValidString(key) && utf8.Valid(value) {
+		rec.Key = key
+		rec.Value = string(value)
+		rec.Encoding = ""
+	} else {
+		rec.Key = base64.StdEncoding.EncodeToString([]byte(key))
+		rec.Value = base64.StdEncoding.EncodeToString(value)
+		rec.Encoding = "base64"
+	}
+}
+
+func (rec *StoreRecord) Decode() (string, []byte, error) {
+	switch rec.Encoding {
+	case "":
+		return rec.Key, []byte(rec.Value), nil
+	case "base64":
+		k, err := base64.StdEncoding.DecodeString(rec.Key)
+		if err != nil {
+			return "", nil, err
+		}
+		v, err := base64.StdEncoding.DecodeString(rec.Value)
+		if err != nil {
+			return "", nil, err
+		}
+		return string(k), v, nil
+	default:
+		return "", nil, errors.New("store record encoding is invalid")
+	}
+}
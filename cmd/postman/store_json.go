@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var storeJsonPointerEscaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// StoreJsonGet returns the value at the path (JSON pointer) of the JSON document.
+func StoreJsonGet(db Kvs, msg *StoreMessage) (json.RawMessage, error) {
+	tokens, err := storeJsonPointer(msg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := StoreGet(db, msg)
+	if err == ErrKvsNotFound {
+		return nil, errors.New("store key not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	doc, err := storeJsonDecode([]byte(v))
+	if err != nil {
+		return nil, errors.New("store value is not json")
+	}
+
+	target, ok := storeJsonGet(doc, tokens)
+	if !ok {
+		return nil, errors.New("store json path not found")
+	}
+	return storeJsonEncode(target)
+}
+
+// StoreJsonSet sets the value at the path, and objects on the way are created.
+// A key which does not exist is null, and TTL of the key is kept.
+func StoreJsonSet(db Kvs, msg *StoreMessage) (json.RawMessage, error) {
+	value, err := storeJsonDecode([]byte(msg.Value()))
+	if err != nil {
+		return nil, errors.New("store value is not json")
+	}
+
+	return storeJsonUpdate(db, msg, func(doc interface{}, tokens []string) (interface{}, error) {
+		return storeJsonSet(doc, tokens, value)
+	})
+}
+
+// StoreJsonMerge applies the value as JSON merge patch (RFC 7396) to the value at the path.
+func StoreJsonMerge(db Kvs, msg *StoreMessage) (json.RawMessage, error) {
+	patch, err := storeJsonDecode([]byte(msg.Value()))
+	if err != nil {
+		return nil, errors.New("store value is not json")
+	}
+
+	return storeJsonUpdate(db, msg, func(doc interface{}, tokens []string) (interface{}, error) {
+		target, _ := storeJsonGet(doc, tokens)
+		return storeJsonSet(doc, tokens, storeJsonMerge(target, patch))
+	})
+}
+
+// StoreJsonAppend appends the value to the array at the path, and the array is created when the path does not exist.
+func StoreJsonAppend(db Kvs, msg *StoreMessage) (json.RawMessage, error) {
+	value, err := storeJsonDecode([]byte(msg.Value()))
+	if err != nil {
+		return nil, errors.New("store value is not json")
+	}
+
+	return storeJsonUpdate(db, msg, func(doc interface{}, tokens []string) (interface{}, error) {
+		arr := []interface{}{}
+		if target, ok := storeJsonGet(doc, tokens); ok && target != nil {
+			a, ok := target.([]interface{})
+			if !ok {
+				return nil, errors.New("store json value is not array")
+			}
+			arr = a
+		}
+		return storeJsonSet(doc, tokens, append(arr, value))
+	})
+}
+
+// storeJsonUpdate reads, modifies and writes the document in the write lock, and returns the new document.
+func storeJsonUpdate(db Kvs, msg *StoreMessage, fn func(doc interface{}, tokens []string) (interface{}, error)) (json.RawMessage, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+
+	tokens, err := storeJsonPointer(msg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer storeNotifyFlush()
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	var doc interface{}
+	batch := new(KvsBatch)
+	cur, err := db.Get([]byte(msg.DbKey()))
+	if err == nil && storeExpired(db, msg.DbKey()) {
+		batch.Delete(storeTtlKey(msg.DbKey()))
+	} else if err == nil {
+		doc, err = storeJsonDecode(cur)
+		if err != nil {
+			return nil, errors.New("store value is not json")
+		}
+	} else if err != ErrKvsNotFound {
+		return nil, err
+	}
+
+	doc, err = fn(doc, tokens)
+	if err != nil {
+		return nil, err
+	}
+	j, err := storeJsonEncode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	v := string(j)
+	if err := storeQuota(db, map[string]*string{msg.DbKey(): &v}); err != nil {
+		return nil, err
+	}
+	batch.Put([]byte(msg.DbKey()), j)
+	err = storeWrite(db, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	StoreNotify("set", msg.DbKey(), v)
+	return j, nil
+}
+
+// storeJsonPointer splits the JSON pointer (RFC 6901) into reference tokens, and "" is the whole document.
+func storeJsonPointer(path string) ([]string, error) {
+	if path == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("store json path is invalid")
+	}
+
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = storeJsonPointerEscaper.Replace(t)
+	}
+	return tokens, nil
+}
+
+// storeJsonIndex parses the array index without leading zeros.
+func storeJsonIndex(token string) (int, bool) {
+	i, err := strconv.Atoi(token)
+	return i, err == nil && i >= 0 && strconv.Itoa(i) == token
+}
+
+func storeJsonGet(doc interface{}, tokens []string) (interface{}, bool) {
+	for _, t := range tokens {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[t]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []interface{}:
+			i, ok := storeJsonIndex(t)
+			if !ok || i >= len(d) {
+				return nil, false
+			}
+			doc = d[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// storeJsonSet returns the document with the value at the path.
+// Missing members and null on the way are created as objects, and "-" or the length of an array appends.
+func storeJsonSet(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	t := tokens[0]
+	switch d := doc.(type) {
+	case nil:
+		child, err := storeJsonSet(nil, tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{t: child}, nil
+	case map[string]interface{}:
+		child, err := storeJsonSet(d[t], tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		d[t] = child
+		return d, nil
+	case []interface{}:
+		i, ok := storeJsonIndex(t)
+		if t == "-" {
+			i, ok = len(d), true
+		}
+		if !ok || i > len(d) {
+			return nil, errors.New("store json path not found")
+		}
+
+		var cur interface{}
+		if i < len(d) {
+			cur = d[i]
+		}
+		child, err := storeJsonSet(cur, tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		if i == len(d) {
+			return append(d, child), nil
+		}
+		d[i] = child
+		return d, nil
+	default:
+		return nil, errors.New("store json path not found")
+	}
+}
+
+// storeJsonMerge is JSON merge patch (RFC 7396).
+func storeJsonMerge(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = storeJsonMerge(t[k], v)
+		}
+	}
+	return t
+}
+
+// storeJsonDecode keeps numbers as they are, and trailing data is invalid.
+func storeJsonDecode(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("store value is not json")
+	}
+	return doc, nil
+}
+
+func storeJsonEncode(doc interface{}) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(bytes.TrimRight(buf.Bytes(), "\n")), nil
+}
@@ -257,3 +257,9 @@ func RequireContainsStdLog(t *testing.T, fn func(), expect string, linesAgo int)
 	logs := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
 	require.Contains(t, logs[len(logs)-1-linesAgo], expect)
 }
+
+// SetOptions replaces the options after the previous run is stopped, so its goroutines do not read them.
+func SetOptions(o Options) {
+	StopServices()
+	opts = o
+}
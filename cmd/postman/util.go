@@ -5,10 +5,13 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"regexp"
 	"runtime"
 	"strings"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/sharkattack51/golem"
 )
 
@@ -64,6 +67,111 @@ func GetRemoteIPfromConn(conn *golem.Connection) string {
 	return SplitAddr(ip)
 }
 
+func CountConnections() int {
+	n := 0
+	conns.Range(func(a interface{}, c interface{}) bool {
+		n++
+		return true
+	})
+
+	return n
+}
+
+// CloseConnections closes websocket connections, and waits for the close handlers.
+func CloseConnections() {
+	conns.Range(func(k interface{}, c interface{}) bool {
+		conn := c.(*golem.Connection)
+
+		// golem rooms send to the closed connection until it leaves, and the room manager
+		// handles requests in order, so the second LeaveAll returns after the first is done.
+		broker.LeaveAll(conn)
+		broker.LeaveAll(conn)
+		CloseConnection(conn, websocket.CloseGoingAway, "server shutdown")
+		return true
+	})
+	wsConns.Wait()
+}
+
+// SafeEmit returns false when the connection has already been closed.
+func SafeEmit(conn *golem.Connection, event string, data interface{}) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	conn.Emit(event, data)
+	return true
+}
+
+// CloseConnection closes the socket, and golem unregisters the connection after its last read.
+func CloseConnection(conn *golem.Connection, code int, reason string) {
+	deadline := time.Now().Add(time.Second)
+	conn.GetSocket().WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	conn.GetSocket().Close()
+}
+
+// ChannelMatch reports whether a message published to pubCh reaches subscribers of subCh.
+func ChannelMatch(pubCh string, subCh string) bool {
+	if strings.HasSuffix(pubCh, "/*") {
+		groupCh := strings.TrimSuffix(pubCh, "/*")
+		if strings.HasPrefix(subCh, groupCh) {
+			ck := strings.TrimPrefix(subCh, groupCh)
+			return len(ck) > 0 && strings.HasPrefix(ck, "/")
+		}
+		return false
+	}
+
+	return pubCh == subCh
+}
+
+// ChannelPattern reports whether the channel matches the pattern in config.
+// "*" matches one level of channel, and trailing "/**" matches any levels below.
+func ChannelPattern(pattern string, ch string) bool {
+	if pattern == "**" {
+		return true
+	}
+
+	if strings.HasSuffix(pattern, "/**") {
+		base := strings.TrimSuffix(pattern, "/**")
+		n := strings.Count(base, "/") + 1
+		levels := strings.Split(ch, "/")
+		if len(levels) <= n {
+			return false
+		}
+		ok, _ := path.Match(base, strings.Join(levels[:n], "/"))
+		return ok
+	}
+
+	ok, _ := path.Match(pattern, ch)
+	return ok
+}
+
+// SafeChannel reports whether the channel is allowed to subscribe by the safelist.
+func SafeChannel(ch string) bool {
+	if len(safeList) == 0 {
+		return true
+	}
+
+	for _, c := range safeList {
+		if ch == c {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitList splits comma separated option values.
+func SplitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func SplitAddr(ip string) string {
 	if strings.Contains(ip, ":") {
 		ip = strings.Split(ip, ":")[0]
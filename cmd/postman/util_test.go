@@ -11,7 +11,7 @@ import (
 )
 
 func TestGetRemoteIPfromConn(t *testing.T) {
-	opts = Options{}
+	SetOptions(Options{})
 	Prepare()
 
 	// start server
@@ -55,3 +55,13 @@ func TestGetHostIP(t *testing.T) {
 	}
 	require.True(t, found || strings.Contains(host, "127.0.0.1"))
 }
+
+func TestChannelPattern(t *testing.T) {
+	require.True(t, ChannelPattern("TEST_CH", "TEST_CH"))
+	require.True(t, ChannelPattern("TEST_CH/*", "TEST_CH/1"))
+	require.False(t, ChannelPattern("TEST_CH/*", "TEST_CH/1/2"))
+	require.True(t, ChannelPattern("TEST_CH/**", "TEST_CH/1/2"))
+	require.True(t, ChannelPattern("*/door/**", "sensor/door/1"))
+	require.False(t, ChannelPattern("TEST_CH/**", "TEST_CH"))
+	require.True(t, ChannelPattern("**", "TEST_CH/1"))
+}
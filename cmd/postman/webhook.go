@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	WEBHOOK_QUEUE        = 1024
+	WEBHOOK_RETRY        = 3
+	WEBHOOK_BACKOFF_MSEC = 1000
+	WEBHOOK_MAX_BACKOFF  = 30 * time.Second
+	WEBHOOK_TIMEOUT_SEC  = 10
+	WEBHOOK_DEAD_PREFIX  = "\x00webhook/dead/"
+)
+
+//
+// Config
+//
+
+type WebhooksData struct {
+	Webhooks []*Webhook `json:"webhooks"`
+}
+
+type Webhook struct {
+	Name        string            `json:"name"`
+	Channel     string            `json:"channel"` // channel pattern
+	Url         string            `json:"url"`
+	Headers     map[string]string `json:"headers"`
+	Secret      string            `json:"secret"` // HMAC-SHA256 key for signature
+	Retry       int               `json:"retry"`
+	BackoffMsec int               `json:"backoff_ms"`
+
+	queue chan *PublishSendMessage
+}
+
+func LoadWebhooks(path string) (*WebhooksData, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var data WebhooksData
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, w := range data.Webhooks {
+		if w.Channel == "" || w.Url == "" {
+			return nil, errors.New("webhook needs channel and url [" + strconv.Itoa(i) + "]")
+		}
+		if w.Name == "" {
+			w.Name = w.Url
+		}
+		if w.Retry <= 0 {
+			w.Retry = WEBHOOK_RETRY
+		}
+		if w.BackoffMsec <= 0 {
+			w.BackoffMsec = WEBHOOK_BACKOFF_MSEC
+		}
+	}
+
+	return &data, nil
+}
+
+//
+// Dead Letter
+//
+
+type DeadLetter struct {
+	Webhook  string              `json:"webhook"`
+	Url      string              `json:"url"`
+	Message  *PublishSendMessage `json:"message"`
+	Error    string              `json:"error"`
+	Attempts int                 `json:"attempts"`
+	Time     time.Time           `json:"time"`
+}
+
+//
+// Dispatcher
+//
+
+type WebhookDispatcher struct {
+	hooks    []*Webhook
+	client   *http.Client
+	deadq    chan *DeadLetter // written to store db out of the publish path
+	seq      atomic.Uint64    // dead letters in the same nanosecond
+	ctx      context.Context
+	cancel   context.CancelFunc
+	workers  sync.WaitGroup
+	writer   sync.WaitGroup
+	mu       sync.RWMutex
+	stopped  bool
+	stopOnce sync.Once
+}
+
+func NewWebhookDispatcher(data *WebhooksData) *WebhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &WebhookDispatcher{
+		hooks:  data.Webhooks,
+		client: &http.Client{Timeout: WEBHOOK_TIMEOUT_SEC * time.Second},
+		deadq:  make(chan *DeadLetter, WEBHOOK_QUEUE),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	// a worker for each webhook not to be blocked by other slow endpoints
+	for _, w := range d.hooks {
+		w.queue = make(chan *PublishSendMessage, WEBHOOK_QUEUE)
+		d.workers.Add(1)
+		go d.work(w)
+	}
+
+	d.writer.Add(1)
+	go func() {
+		defer d.writer.Done()
+		for dl := range d.deadq {
+			d.put(dl)
+		}
+	}()
+
+	return d
+}
+
+// Dispatch queues the message for matched webhooks without blocking.
+func (d *WebhookDispatcher) Dispatch(pmsg *PublishSendMessage) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.stopped {
+		return
+	}
+
+	for _, w := range d.hooks {
+		if !ChannelPattern(w.Channel, pmsg.Channel) {
+			continue
+		}
+
+		select {
+		case w.queue <- pmsg:
+		default:
+			metrics.Dropped("webhook_queue_full")
+			dl := d.dead(w, pmsg, errors.New("queue is full"), 0)
+			select {
+			case d.deadq <- dl:
+			default:
+				metrics.Dropped("webhook_dead_full")
+			}
+		}
+	}
+}
+
+// Stop cancels deliveries, and keeps queued messages as dead letters.
+func (d *WebhookDispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		d.mu.Lock()
+		d.stopped = true
+		d.mu.Unlock()
+
+		d.cancel()
+		d.workers.Wait()
+
+		close(d.deadq)
+		d.writer.Wait()
+
+		for _, w := range d.hooks {
+			for len(w.queue) > 0 {
+				d.put(d.dead(w, <-w.queue, errors.New("server is stopped"), 0))
+			}
+		}
+	})
+}
+
+func (d *WebhookDispatcher) work(w *Webhook) {
+	defer d.workers.Done()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case pmsg := <-w.queue:
+			d.deliver(w, pmsg)
+		}
+	}
+}
+
+func (d *WebhookDispatcher) deliver(w *Webhook, pmsg *PublishSendMessage) {
+	body, _ := json.Marshal(pmsg)
+	backoff := time.Duration(w.BackoffMsec) * time.Millisecond
+
+	var err error
+	i := 1
+	for ; i <= w.Retry; i++ {
+		if err = d.post(w, pmsg, body); err == nil {
+			return
+		}
+		if d.ctx.Err() != nil {
+			break
+		}
+
+		log.Printf("> [Warning] webhook %s failed (%d/%d): %s\n", w.Name, i, w.Retry, err)
+		if logger != nil {
+			logger.Log(WARN, "webhook failed", logrus.Fields{"method": "webhook", "webhook": w.Name, "channel": pmsg.Channel, "attempt": i, "error": err.Error()})
+		}
+
+		if i < w.Retry {
+			select {
+			case <-d.ctx.Done():
+				d.put(d.dead(w, pmsg, errors.New("server is stopped"), i))
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, WEBHOOK_MAX_BACKOFF)
+		}
+	}
+
+	if d.ctx.Err() != nil {
+		err = errors.New("server is stopped")
+	}
+	d.put(d.dead(w, pmsg, err, min(i, w.Retry)))
+}
+
+func (d *WebhookDispatcher) post(w *Webhook, pmsg *PublishSendMessage, body []byte) error {
+	req, err := http.NewRequestWithContext(d.ctx, "POST", w.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "postman/"+VERSION)
+	req.Header.Set("X-Postman-Channel", pmsg.Channel)
+	if w.Secret != "" {
+		req.Header.Set("X-Postman-Signature", "sha256="+WebhookSignature(w.Secret, body))
+	}
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// dead returns the dead letter of the undelivered message.
+func (d *WebhookDispatcher) dead(w *Webhook, pmsg *PublishSendMessage, err error, attempts int) *DeadLetter {
+	log.Printf("> [Warning] webhook %s gave up ch:%s\n", w.Name, pmsg.Channel)
+	if logger != nil {
+		logger.Log(WARN, "webhook gave up", logrus.Fields{"method": "webhook", "webhook": w.Name, "channel": pmsg.Channel, "message": pmsg.Message, "error": err.Error()})
+	}
+
+	return &DeadLetter{
+		Webhook:  w.Name,
+		Url:      w.Url,
+		Message:  pmsg,
+		Error:    err.Error(),
+		Attempts: attempts,
+		Time:     time.Now(),
+	}
+}
+
+// put keeps the dead letter in store db.
+func (d *WebhookDispatcher) put(dl *DeadLetter) {
+	if kvsDB == nil {
+		return
+	}
+
+	j, _ := json.Marshal(dl)
+	kvsDB.Put([]byte(fmt.Sprintf("%s%020d-%010d", WEBHOOK_DEAD_PREFIX, dl.Time.UnixNano(), d.seq.Add(1))), j)
+}
+
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func WriteWebhookConfig(t *testing.T, hooks []*Webhook) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "webhook.json")
+	j, _ := json.Marshal(&WebhooksData{Webhooks: hooks})
+	err := os.WriteFile(path, j, 0644)
+
+	require.NoError(t, err)
+
+	return path
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	var mu sync.Mutex
+	reqs := []*http.Request{}
+	bodies := [][]byte{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		reqs = append(reqs, r)
+		bodies = append(bodies, b)
+		mu.Unlock()
+	}))
+	t.Cleanup(s.Close)
+
+	path := WriteWebhookConfig(t, []*Webhook{
+		{Name: "TEST_HOOK", Channel: "TEST_CH/*", Url: s.URL, Headers: map[string]string{"Authorization": "Bearer TEST"}, Secret: "SECRET"},
+	})
+
+	SetOptions(Options{Webhook: path})
+	Prepare()
+	t.Cleanup(webhooks.Stop)
+
+	EmitMessage(NewPublishSendMessage("TEST_CH/1", "TEST@MESSAGE", "TEST@TAG", ""))
+	EmitMessage(NewPublishSendMessage("OTHER_CH", "TEST@OTHER", "", ""))
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(reqs) == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond) // wait
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Equal(t, len(reqs), 1)
+	require.Equal(t, reqs[0].Header.Get("Authorization"), "Bearer TEST")
+	require.Equal(t, reqs[0].Header.Get("X-Postman-Channel"), "TEST_CH/1")
+	require.Equal(t, reqs[0].Header.Get("X-Postman-Signature"), "sha256="+WebhookSignature("SECRET", bodies[0]))
+
+	var pmsg PublishSendMessage
+	json.Unmarshal(bodies[0], &pmsg)
+
+	require.Equal(t, pmsg.Message, "TEST@MESSAGE")
+	require.Equal(t, pmsg.Tag, "TEST@TAG")
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	var mu sync.Mutex
+	n := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n++
+		mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(s.Close)
+
+	path := WriteWebhookConfig(t, []*Webhook{
+		{Name: "TEST_HOOK", Channel: "TEST_CH", Url: s.URL, Retry: 2, BackoffMsec: 10},
+	})
+
+	SetOptions(Options{Webhook: path, UseStoreApi: true})
+	Prepare()
+	t.Cleanup(func() {
+		webhooks.Stop()
+		kvsDB.Close()
+	})
+
+	EmitMessage(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "", ""))
+
+	var dl DeadLetter
+	require.Eventually(t, func() bool {
+		iter := kvsDB.NewIterator(KvsPrefix([]byte(WEBHOOK_DEAD_PREFIX)))
+		defer iter.Release()
+		for iter.Next() {
+			json.Unmarshal(iter.Value(), &dl)
+			kvsDB.Delete(iter.Key())
+			return true
+		}
+		return false
+	}, 3*time.Second, 50*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Equal(t, n, 2)
+	require.Equal(t, dl.Webhook, "TEST_HOOK")
+	require.Equal(t, dl.Attempts, 2)
+	require.Equal(t, dl.Error, "status 500")
+	require.Equal(t, dl.Message.Message, "TEST@MESSAGE")
+}
+
+func TestWebhookStop(t *testing.T) {
+	block := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(func() {
+		close(block)
+		s.Close()
+	})
+
+	path := WriteWebhookConfig(t, []*Webhook{
+		{Name: "TEST_HOOK", Channel: "TEST_CH", Url: s.URL},
+	})
+
+	SetOptions(Options{Webhook: path, UseStoreApi: true})
+	Prepare()
+	t.Cleanup(func() { kvsDB.Close() })
+
+	for i := 0; i < 5; i++ {
+		EmitMessage(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "", ""))
+	}
+	time.Sleep(100 * time.Millisecond) // wait
+
+	// delivering and queued messages are kept as dead letters
+	webhooks.Stop()
+
+	dls := []*DeadLetter{}
+	iter := kvsDB.NewIterator(KvsPrefix([]byte(WEBHOOK_DEAD_PREFIX)))
+	for iter.Next() {
+		var dl DeadLetter
+		json.Unmarshal(iter.Value(), &dl)
+		dls = append(dls, &dl)
+		kvsDB.Delete(iter.Key())
+	}
+	iter.Release()
+
+	require.Len(t, dls, 5)
+	for _, dl := range dls {
+		require.Equal(t, dl.Error, "server is stopped")
+	}
+
+	// no dispatch after stop
+	EmitMessage(NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "", ""))
+	RequireKvsKeys(t, kvsDB, KvsPrefix([]byte(WEBHOOK_DEAD_PREFIX)))
+}
+
+func TestWebhookDeadLetterKey(t *testing.T) {
+	SetOptions(Options{UseStoreApi: true})
+	Prepare()
+	t.Cleanup(func() { kvsDB.Close() })
+
+	// dead letters in the same nanosecond
+	d := NewWebhookDispatcher(&WebhooksData{})
+	t.Cleanup(d.Stop)
+
+	w := &Webhook{Name: "TEST_HOOK", Url: "http://127.0.0.1"}
+	dl := d.dead(w, NewPublishSendMessage("TEST_CH", "TEST@MESSAGE", "", ""), errors.New("queue is full"), 0)
+	d.put(dl)
+	d.put(dl)
+
+	n := 0
+	iter := kvsDB.NewIterator(KvsPrefix([]byte(WEBHOOK_DEAD_PREFIX)))
+	for iter.Next() {
+		n++
+		kvsDB.Delete(iter.Key())
+	}
+	iter.Release()
+
+	require.Equal(t, n, 2)
+}
+
+func TestWebhookInvalidConfig(t *testing.T) {
+	path := WriteWebhookConfig(t, []*Webhook{{Name: "TEST_HOOK"}})
+
+	_, err := LoadWebhooks(path)
+
+	require.Error(t, err)
+}
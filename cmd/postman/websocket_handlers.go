@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/sharkattack51/golem"
@@ -23,27 +23,34 @@ func CreateRouter() *golem.Router {
 	router.On("unsubscribe", Unsubscribe)
 	router.On("publish", Publish)
 	router.On("status", Status)
+	router.On("schedule", Schedule)
+	router.On("store", Store)
 	router.OnClose(Closed)
 
 	return router
 }
 
 func Connected(conn *golem.Connection, r *http.Request) {
+	wsConns.Add(1)
+
+	if draining.Load() {
+		log.Printf("> [Warning] server is draining from %s\n", r.RemoteAddr)
+		if logger != nil {
+			logger.Log(WARN, "server is draining", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
+		}
+
+		Reject(conn, "server is draining")
+		return
+	}
+
 	if !IpValidation(r.RemoteAddr) {
 		log.Printf("> [Warning] remote ip blocked from %s\n", r.RemoteAddr)
+		metrics.IpBlocked()
 		if logger != nil {
 			logger.Log(WARN, "remote ip blocked", logrus.Fields{"method": "connect", "from": r.RemoteAddr})
 		}
 
-		msg := NewResultMessage("fail", "remote ip blocked")
-		j, _ := json.Marshal(msg)
-		conn.Emit("message", string(j))
-
-		go func(c *golem.Connection) {
-			time.Sleep(time.Millisecond * 1)
-			c.Close()
-		}(conn)
-
+		Reject(conn, "remote ip blocked")
 		return
 	}
 
@@ -52,21 +59,17 @@ func Connected(conn *golem.Connection, r *http.Request) {
 		res, err := Authenticate(secret, smsg.Token(), host)
 		if !res || err != nil {
 			log.Printf("> [Warning] authentication failed from %s\n", r.RemoteAddr)
+			metrics.AuthFailed()
 			if logger != nil {
 				logger.Log(WARN, "authentication failed", logrus.Fields{"method": "connect", "token": smsg.Token(), "from": r.RemoteAddr})
 			}
 
-			msg := NewResultMessage("fail", "security error")
-			j, _ := json.Marshal(msg)
-			conn.Emit("message", string(j))
-
-			go func(c *golem.Connection) {
-				time.Sleep(time.Millisecond * 1)
-				c.Close()
-			}(conn)
-
+			Reject(conn, "security error")
 			return
 		}
+
+		// for store commands over websocket
+		cliTokens.Store(conn.GetSocket().RemoteAddr().String(), smsg.Token())
 	}
 
 	remoteAddr := GetRemoteAddr(r)
@@ -77,13 +80,10 @@ func Connected(conn *golem.Connection, r *http.Request) {
 		}
 
 		hasconn.(*golem.Connection).Close()
-
-		go func(c *golem.Connection) {
-			time.Sleep(time.Millisecond * 1)
-			c.Close()
-		}(conn)
+		Reject(conn, "")
 	} else {
 		conns.Store(remoteAddr, conn)
+		metrics.Connected()
 
 		log.Printf("> [Connected] from %s\n", remoteAddr)
 		if logger != nil {
@@ -92,11 +92,40 @@ func Connected(conn *golem.Connection, r *http.Request) {
 	}
 }
 
+// Reject sends the fail reason and closes the connection, and its messages are ignored until closed.
+func Reject(conn *golem.Connection, reason string) {
+	rejected.Store(conn, true)
+
+	if reason != "" {
+		msg := NewResultMessage("fail", reason)
+		j, _ := json.Marshal(msg)
+		conn.Emit("message", string(j))
+	}
+
+	go func(c *golem.Connection) {
+		time.Sleep(time.Millisecond * 1)
+		c.Close()
+	}(conn)
+}
+
+func Rejected(conn *golem.Connection) bool {
+	_, exist := rejected.Load(conn)
+	return exist
+}
+
 func Ping(conn *golem.Connection) {
+	if Rejected(conn) {
+		return
+	}
+
 	conn.Emit("message", "pong")
 }
 
 func Subscribe(conn *golem.Connection, msg *SubscribeMessage) {
+	if Rejected(conn) {
+		return
+	}
+
 	remoteAddr := conn.GetSocket().RemoteAddr().String()
 	infoAtRemote := remoteAddr
 	if msg.Info() != "" {
@@ -111,18 +140,31 @@ func Subscribe(conn *golem.Connection, msg *SubscribeMessage) {
 		return
 	}
 
-	if len(safeList) > 0 {
-		contain := false
-		for _, ch := range safeList {
-			if msg.Channel() == ch {
-				contain = true
-				break
-			}
+	if !SafeChannel(msg.Channel()) {
+		log.Printf("> [Warning] whitelist does not contain subscribe channel from %s\n", infoAtRemote)
+		if logger != nil {
+			logger.Log(WARN, "whitelist does not contain subscribe channel", logrus.Fields{"method": "subscribe", "channel": msg.Channel(), "from": infoAtRemote})
+		}
+		return
+	}
+
+	token := ""
+	if v, exist := cliTokens.Load(remoteAddr); exist {
+		token = v.(string)
+	}
+	if !StoreChannelAllowed(msg.Channel(), token) {
+		log.Printf("> [Warning] store channel is not allowed from %s\n", infoAtRemote)
+		if logger != nil {
+			logger.Log(WARN, "store channel is not allowed", logrus.Fields{"method": "subscribe", "channel": msg.Channel(), "from": infoAtRemote})
 		}
-		if !contain {
-			log.Printf("> [Warning] whitelist does not contain subscribe channel from %s\n", infoAtRemote)
+		return
+	}
+
+	if msg.Filter != nil {
+		if err := msg.Filter.Validate(); err != nil {
+			log.Printf("> [Warning] %s from %s\n", err, infoAtRemote)
 			if logger != nil {
-				logger.Log(WARN, "whitelist does not contain subscribe channel", logrus.Fields{"method": "subscribe", "channel": msg.Channel(), "from": infoAtRemote})
+				logger.Log(WARN, "invalid subscribe filter", logrus.Fields{"method": "subscribe", "channel": msg.Channel(), "error": err.Error(), "from": infoAtRemote})
 			}
 			return
 		}
@@ -137,10 +179,31 @@ func Subscribe(conn *golem.Connection, msg *SubscribeMessage) {
 		cliInfos.Store(remoteAddr, msg.Info())
 	}
 
-	roomMg.Join(msg.Channel(), conn)
+	// subscribe again to change the filter
+	if v, exist := filtered.Load(conn); exist {
+		fc := v.(*FilteredConnection)
+		fc.Remove(msg.Channel())
+		broker.Detach(msg.Channel(), fc)
+	}
+
+	if msg.Filter != nil {
+		v, _ := filtered.LoadOrStore(conn, NewFilteredConnection(conn))
+		fc := v.(*FilteredConnection)
+		fc.Set(msg.Channel(), msg.Filter)
+
+		broker.Leave(msg.Channel(), conn)
+		broker.Attach(msg.Channel(), fc)
+	} else {
+		broker.Join(msg.Channel(), conn)
+	}
+	metrics.Subscribed(conn, msg.Channel())
 }
 
 func Unsubscribe(conn *golem.Connection, msg *SubscribeMessage) {
+	if Rejected(conn) {
+		return
+	}
+
 	remoteAddr := conn.GetSocket().RemoteAddr().String()
 	infoAtRemote := remoteAddr
 	if msg.Info() != "" {
@@ -161,10 +224,20 @@ func Unsubscribe(conn *golem.Connection, msg *SubscribeMessage) {
 	}
 
 	cliInfos.Delete(remoteAddr)
-	roomMg.Leave(msg.Channel(), conn)
+	broker.Leave(msg.Channel(), conn)
+	if v, exist := filtered.Load(conn); exist {
+		fc := v.(*FilteredConnection)
+		fc.Remove(msg.Channel())
+		broker.Detach(msg.Channel(), fc)
+	}
+	metrics.Unsubscribed(conn, msg.Channel())
 }
 
 func Publish(conn *golem.Connection, msg *PublishMessage) {
+	if Rejected(conn) {
+		return
+	}
+
 	remoteAddr := conn.GetSocket().RemoteAddr().String()
 	infoAtRemote := remoteAddr
 	if info, exist := cliInfos.Load(remoteAddr); exist {
@@ -187,31 +260,64 @@ func Publish(conn *golem.Connection, msg *PublishMessage) {
 	}
 
 	pmsg := NewPublishSendMessage(msg.Channel(), msg.Message(), msg.Tag(), msg.Extention())
-	if strings.HasSuffix(msg.Channel(), "/*") {
-		groupCh := strings.TrimSuffix(msg.Channel(), "/*")
-		for _, ri := range roomMg.GetRoomInfos() {
-			if strings.HasPrefix(ri.Topic, groupCh) {
-				ck := strings.TrimPrefix(ri.Topic, groupCh)
-				if len(ck) > 0 && strings.HasPrefix(ck, "/") {
-					roomMg.Emit(ri.Topic, "message", &pmsg)
-				}
-			}
+	EmitMessage(pmsg)
+}
+
+// EmitMessage publishes the message, and the store notification channels are reserved for storeEmit.
+func EmitMessage(pmsg *PublishSendMessage) error {
+	if StoreChannelReserved(pmsg.Channel) {
+		log.Printf("> [Warning] store channel is reserved ch:%s\n", pmsg.Channel)
+		if logger != nil {
+			logger.Log(WARN, "store channel is reserved", logrus.Fields{"method": "publish", "channel": pmsg.Channel})
+		}
+		return errors.New("store channel is reserved")
+	}
+
+	emitMessage(pmsg)
+	return nil
+}
+
+func emitMessage(pmsg *PublishSendMessage) {
+	metrics.Received(pmsg)
+
+	broker.Emit(pmsg)
+	if cluster != nil {
+		cluster.Relay(pmsg)
+	}
+
+	// only in the postman which the message is published to
+	if webhooks != nil {
+		webhooks.Dispatch(pmsg)
+	}
+	if oscGw != nil {
+		oscGw.Forward(pmsg)
+	}
+
+	if routes != nil {
+		for _, m := range routes.Apply(pmsg) {
+			EmitMessage(m)
 		}
-	} else {
-		roomMg.Emit(msg.Channel(), "message", &pmsg)
 	}
 }
 
 func Status(conn *golem.Connection) {
-	msg := NewStatusMessage(roomMg)
+	if Rejected(conn) {
+		return
+	}
+
+	msg := NewStatusMessage(broker)
 
 	conn.Emit("message", &msg)
 }
 
 func Closed(conn *golem.Connection) {
+	defer wsConns.Done()
+	defer rejected.Delete(conn)
+
 	remoteAddr := conn.GetSocket().RemoteAddr().String()
 
 	conns.Delete(remoteAddr)
+	cliTokens.Delete(remoteAddr)
 
 	infoAtRemote := remoteAddr
 	if info, exist := cliInfos.Load(remoteAddr); exist {
@@ -225,5 +331,10 @@ func Closed(conn *golem.Connection) {
 		logger.Log(INFO, "connection close", logrus.Fields{"method": "close", "from": infoAtRemote})
 	}
 
-	roomMg.LeaveAll(conn)
+	broker.LeaveAll(conn)
+	if v, loaded := filtered.LoadAndDelete(conn); loaded {
+		broker.DetachAll(v.(*FilteredConnection))
+		v.(*FilteredConnection).Close()
+	}
+	metrics.Closed(conn)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,11 +11,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 )
 
 func WebSocketMultipleConnectTester(t *testing.T) {
-	opts = Options{}
+	SetOptions(Options{})
 	Prepare()
 
 	// start server
@@ -35,7 +37,7 @@ func WebSocketMultipleConnectTester(t *testing.T) {
 }
 
 func WebSocketPublishTester(t *testing.T) {
-	opts = Options{}
+	SetOptions(Options{})
 	Prepare()
 
 	// start server
@@ -57,7 +59,7 @@ func WebSocketPublishTester(t *testing.T) {
 }
 
 func WebSocketPublishGroupTester(t *testing.T) {
-	opts = Options{}
+	SetOptions(Options{})
 	Prepare()
 
 	// start server
@@ -80,7 +82,7 @@ func WebSocketPublishGroupTester(t *testing.T) {
 }
 
 func WebSocketSubscribeIpValidationTester(t *testing.T) {
-	opts = Options{IpAddresses: "192.168.0.1"}
+	SetOptions(Options{IpAddresses: "192.168.0.1"})
 	Prepare()
 
 	// start server
@@ -98,7 +100,7 @@ func WebSocketSubscribeIpValidationTester(t *testing.T) {
 }
 
 func WebSocketSubscribeSecureModeFailTester(t *testing.T) {
-	opts = Options{SecureMode: true}
+	SetOptions(Options{SecureMode: true})
 	Prepare()
 
 	// start server
@@ -124,14 +126,14 @@ func WebSocketConnectSecureModeTester(t *testing.T) {
 	os.Setenv(ENV_SECRET, "SECRET")
 	t.Cleanup(func() { os.Unsetenv(ENV_SECRET) })
 
-	opts = Options{GenToken: true}
+	SetOptions(Options{GenToken: true})
 	Prepare()
 
 	// generate token
 	tkn := ReadFmtPrintOut(t, Prepare)
 	tkn = strings.Split(tkn, "genarated token: ")[1]
 
-	opts = Options{SecureMode: true}
+	SetOptions(Options{SecureMode: true})
 	Prepare()
 
 	// start server
@@ -159,7 +161,7 @@ func WebSocketConnectSecureModeTester(t *testing.T) {
 }
 
 func WebSocketPingTester(t *testing.T) {
-	opts = Options{}
+	SetOptions(Options{})
 	Prepare()
 
 	// start server
@@ -185,7 +187,7 @@ func WebSocketSameIpConnectionTester(t *testing.T) {
 			return strings.Split(r.RemoteAddr, ":")[0]
 		}
 
-		opts = Options{}
+		SetOptions(Options{})
 		Prepare()
 
 		// start server
@@ -213,7 +215,7 @@ func WebSocketSameIpConnectionTester(t *testing.T) {
 	time.Sleep(3000 * time.Millisecond) // wait
 
 	t.Run("difference ip connection is success", func(t *testing.T) {
-		opts = Options{}
+		SetOptions(Options{})
 		Prepare()
 
 		// start server
@@ -240,7 +242,7 @@ func WebSocketSameIpConnectionTester(t *testing.T) {
 }
 
 func WebSocketSubscribeChannelEmptyTester(t *testing.T) {
-	opts = Options{LogDir: "./log"}
+	SetOptions(Options{LogDir: "./log"})
 	Prepare()
 
 	// start server
@@ -253,7 +255,7 @@ func WebSocketSubscribeChannelEmptyTester(t *testing.T) {
 }
 
 func WebSocketSubscribeSafelistTester(t *testing.T) {
-	opts = Options{Channels: "TEST_WHITE_CH", LogDir: "./log"}
+	SetOptions(Options{Channels: "TEST_WHITE_CH", LogDir: "./log"})
 	Prepare()
 
 	// start server
@@ -275,7 +277,7 @@ func WebSocketSubscribeSafelistTester(t *testing.T) {
 }
 
 func WebSocketSatatusTester(t *testing.T) {
-	opts = Options{}
+	SetOptions(Options{})
 	Prepare()
 
 	// start server
@@ -299,7 +301,7 @@ func WebSocketSatatusTester(t *testing.T) {
 }
 
 func WebSocketUnsubscribeTester(t *testing.T) {
-	opts = Options{LogDir: "./log"}
+	SetOptions(Options{LogDir: "./log"})
 	Prepare()
 
 	// start server
@@ -313,7 +315,7 @@ func WebSocketUnsubscribeTester(t *testing.T) {
 }
 
 func WebSocketUnsubscribeChannelEmptyTester(t *testing.T) {
-	opts = Options{LogDir: "./log"}
+	SetOptions(Options{LogDir: "./log"})
 	Prepare()
 
 	// start server
@@ -327,7 +329,7 @@ func WebSocketUnsubscribeChannelEmptyTester(t *testing.T) {
 }
 
 func WebSocketPublishChannelEmptyTester(t *testing.T) {
-	opts = Options{LogDir: "./log"}
+	SetOptions(Options{LogDir: "./log"})
 	Prepare()
 
 	// start server
@@ -364,3 +366,135 @@ func TestWebSocketApi(t *testing.T) {
 
 	WebSocketMultipleConnectTester(t) // must last
 }
+
+func TestWebSocketGracefulDrain(t *testing.T) {
+	SetOptions(Options{DrainTimeout: 1})
+	Prepare()
+	t.Cleanup(func() { draining.Store(false) })
+
+	// start server
+	s := StartMockServer(t)
+
+	// connect and subscribe
+	c := RequireConnectAndSubscribe(t, s.URL, "TEST_CH", "TEST_CLI")
+
+	time.Sleep(100 * time.Millisecond) // wait
+
+	// drain
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	draining.Store(true)
+	NotifyShutdown(opts.DrainTimeout)
+
+	c.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err := c.ReadMessage()
+
+	require.NoError(t, err)
+	require.Equal(t, string(rcv[:9]), "shutdown ")
+
+	var msg ShutdownMessage
+	err = json.Unmarshal(rcv[9:], &msg)
+
+	require.NoError(t, err)
+	require.True(t, msg.Reconnect)
+	require.Equal(t, msg.RetryAfter, 1)
+
+	// new connection is rejected
+	c2 := RequireConnectAndPing(t, s.URL)
+	c2.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, rcv, err = c2.ReadMessage()
+
+	require.NoError(t, err)
+	j := RequireGolemClientProtocolMessageString(t, rcv)
+	RequireResponseIsFail(t, []byte(j), "server is draining")
+
+	// closed with going away
+	DrainConnections(ctx)
+
+	c.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, _, err = c.ReadMessage()
+
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+	require.Equal(t, CountConnections(), 0)
+}
+
+func TestWebSocketStore(t *testing.T) {
+	SetOptions(Options{UseStoreApi: true})
+	Prepare()
+	t.Cleanup(func() { kvsDB.Close() })
+
+	// start server
+	s := StartMockServer(t)
+	c := RequireConnectAndPing(t, s.URL)
+	c.ReadMessage()
+
+	request := func(msg *StoreMessage) *StoreResultMessage {
+		t.Helper()
+
+		j, _ := json.Marshal(msg)
+		err := c.WriteMessage(websocket.TextMessage, []byte("store "+string(j)))
+
+		require.NoError(t, err)
+
+		c.SetReadDeadline(time.Now().Add(1 * time.Second))
+		_, rcv, err := c.ReadMessage()
+
+		require.NoError(t, err)
+		require.Equal(t, string(rcv[:6]), "store ")
+
+		var res StoreResultMessage
+		err = json.Unmarshal(rcv[6:], &res)
+
+		require.NoError(t, err)
+		require.Equal(t, res.Id, msg.Id)
+
+		return &res
+	}
+
+	// set and get
+	res := request(&StoreMessage{Id: "1", RawCmd: "SET", RawKey: "TEST#WS", RawVal: "TEST@VALUE"})
+
+	require.Equal(t, res.Result, "success")
+
+	res = request(&StoreMessage{Id: "2", RawCmd: "GET", RawKey: "TEST#WS"})
+
+	require.Equal(t, res.Result, "TEST@VALUE")
+
+	// keys
+	res = request(&StoreMessage{Id: "3", RawCmd: "KEYS", Prefix: "TEST#WS"})
+
+	require.Equal(t, res.Result, "success")
+	require.Equal(t, res.Keys, []string{"TEST#WS"})
+
+	// json
+	res = request(&StoreMessage{Id: "3", RawCmd: "JSET", RawKey: "TEST#WS_DOC", Path: "/a", RawVal: `[1]`})
+
+	require.Equal(t, res.Result, "success")
+	require.JSONEq(t, string(res.Value), `{"a":[1]}`)
+
+	res = request(&StoreMessage{Id: "3", RawCmd: "DEL", RawKey: "TEST#WS_DOC"})
+
+	require.Equal(t, res.Result, "success")
+
+	// delete
+	res = request(&StoreMessage{Id: "4", RawCmd: "DEL", RawKey: "TEST#WS"})
+
+	require.Equal(t, res.Result, "success")
+
+	res = request(&StoreMessage{Id: "5", RawCmd: "HAS", RawKey: "TEST#WS"})
+
+	require.Equal(t, res.Result, "false")
+
+	// invalid
+	res = request(&StoreMessage{Id: "6", RawCmd: "GET"})
+
+	require.Equal(t, res.Result, "fail")
+	require.Equal(t, res.Error, "store key is empty")
+
+	// disabled
+	opts.UseStoreApi = false
+	res = request(&StoreMessage{Id: "7", RawCmd: "GET", RawKey: "TEST#WS"})
+
+	require.Equal(t, res.Result, "fail")
+	require.Equal(t, res.Error, "key-value store api is disable")
+}
@@ -11,6 +11,7 @@ require (
 	github.com/sirupsen/logrus v1.9.3
 	github.com/stretchr/testify v1.9.0
 	github.com/syndtr/goleveldb v1.0.0
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/sys v0.26.0
 )
 